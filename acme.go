@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/mholt/acmez/v2/acme"
+	"github.com/miekg/dns"
+)
+
+// isACMETLS returns true for the TLS modes of the API certificates issued with ACME
+func isACMETLS(mode string) bool {
+	return mode == "letsencrypt" || mode == "letsencryptstaging" || mode == "acme"
+}
+
+// acmeDirectory returns the directory URL of the CA of an ACME TLS mode
+func acmeDirectory(api httpapi, mode string) string {
+	switch mode {
+	case "letsencrypt":
+		return certmagic.LetsEncryptProductionCA
+	case "letsencryptstaging":
+		return certmagic.LetsEncryptStagingCA
+	}
+	return api.ACMEDirectory
+}
+
+// apiCertNames returns the names of the API certificate issued with ACME: api_domain, or the
+// domain of the general section if not set, followed by the alternative names
+func apiCertNames(config DNSConfig) []string {
+	first := config.API.Domain
+	if first == "" {
+		first = config.General.Domain
+	}
+	var names []string
+	for _, name := range append([]string{first}, config.API.AltNames...) {
+		name = normalizeZoneName(name)
+		if name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// inConfigZone checks if the name is the domain of one of the zones or a name in one of them
+func inConfigZone(config DNSConfig, name string) bool {
+	for _, z := range configZones(config) {
+		if zone := normalizeZoneName(z.Domain); zone != "" && dns.IsSubDomain(zone+".", name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareACMEConfig validates the CA options and the names of the API certificate
+func prepareACMEConfig(conf DNSConfig) error {
+	acmeMode := false
+	for _, lc := range configAPIListeners(conf) {
+		if lc.TLS == "acme" && conf.API.ACMEDirectory == "" {
+			return errors.New("missing api configuration option \"acme_directory\" for tls \"acme\"")
+		}
+		acmeMode = acmeMode || isACMETLS(lc.TLS)
+	}
+	// The DNS-01 challenges of the names are answered by acme-dns itself
+	if acmeMode {
+		if len(apiCertNames(conf)) == 0 {
+			return errors.New("missing general configuration option \"domain\" for the API certificate")
+		}
+		for _, name := range apiCertNames(conf) {
+			if !inConfigZone(conf, name) {
+				return fmt.Errorf("API certificate name %s is not in a zone of this acme-dns instance, the ACME challenge can not be answered", name)
+			}
+		}
+	}
+	if conf.API.ACMEDirectory != "" {
+		u, err := url.Parse(conf.API.ACMEDirectory)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid acme_directory %q, expected a https URL", conf.API.ACMEDirectory)
+		}
+	}
+	if (conf.API.ACMEEABKeyID == "") != (conf.API.ACMEEABHMAC == "") {
+		return errors.New("configuration options \"acme_eab_kid\" and \"acme_eab_hmac\" must be set together")
+	}
+	if conf.API.ACMEEABHMAC != "" {
+		if _, err := base64.RawURLEncoding.DecodeString(conf.API.ACMEEABHMAC); err != nil {
+			return fmt.Errorf("invalid acme_eab_hmac, expected base64url encoding: %v", err)
+		}
+	}
+	return nil
+}
+
+// configureACME sets the CA, the external account binding and the trusted root of the CA of the
+// ACME TLS mode to the issuer
+func configureACME(issuer *certmagic.ACMEIssuer, api httpapi, mode string) error {
+	issuer.CA = acmeDirectory(api, mode)
+	if mode == "acme" {
+		// The certificate is not retried from the Let's Encrypt staging CA
+		issuer.TestCA = ""
+	}
+	if api.ACMEEABKeyID != "" {
+		issuer.ExternalAccount = &acme.EAB{
+			KeyID:  api.ACMEEABKeyID,
+			MACKey: api.ACMEEABHMAC,
+		}
+	}
+	if api.ACMECARoot != "" {
+		roots, err := loadTrustedRoots(api.ACMECARoot)
+		if err != nil {
+			return err
+		}
+		issuer.TrustedRoots = roots
+	}
+	return nil
+}
+
+// loadTrustedRoots loads the PEM encoded root certificates of the CA from a file
+func loadTrustedRoots(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM encoded certificates in %s", path)
+	}
+	return roots, nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+)
+
+func TestPrepareACMEConfig(t *testing.T) {
+	for i, test := range []struct {
+		api   httpapi
+		valid bool
+	}{
+		{httpapi{TLS: "letsencrypt"}, true},
+		{httpapi{TLS: "acme", ACMEDirectory: "https://ca.example.org/acme/directory"}, true},
+		{httpapi{TLS: "acme", ACMEDirectory: "https://ca.example.org/acme/directory", ACMEEABKeyID: "kid", ACMEEABHMAC: "c2VjcmV0"}, true},
+		{httpapi{TLS: "acme"}, false},
+		{httpapi{TLS: "acme", ACMEDirectory: "http://ca.example.org/acme/directory"}, false},
+		{httpapi{TLS: "acme", ACMEDirectory: "ca.example.org"}, false},
+		{httpapi{TLS: "acme", ACMEDirectory: "https://ca.example.org/acme/directory", ACMEEABKeyID: "kid"}, false},
+		{httpapi{TLS: "acme", ACMEDirectory: "https://ca.example.org/acme/directory", ACMEEABKeyID: "kid", ACMEEABHMAC: "not base64!"}, false},
+	} {
+		err := prepareACMEConfig(DNSConfig{General: general{Domain: "auth.example.org"}, API: test.api})
+		if test.valid && err != nil {
+			t.Errorf("Test %d: Expected no error, got [%v]", i, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Test %d: Expected error, got none", i)
+		}
+	}
+
+	// The acme mode of an API listener needs the directory as well
+	err := prepareACMEConfig(DNSConfig{General: general{Domain: "auth.example.org"}, APIListeners: []apilistenerconfig{{Address: "0.0.0.0:443", TLS: "acme"}}})
+	if err == nil {
+		t.Errorf("Expected error for an API listener without the directory, got none")
+	}
+	if err = prepareACMEConfig(DNSConfig{API: httpapi{TLS: "letsencrypt"}}); err == nil {
+		t.Errorf("Expected error for an API certificate without names, got none")
+	}
+}
+
+func TestAPICertNames(t *testing.T) {
+	config := multiZoneConfig()
+	if names := apiCertNames(config); !reflect.DeepEqual(names, []string{"auth.example.org"}) {
+		t.Errorf("Expected the domain of the general section, got %v", names)
+	}
+	config.API.Domain = "ACME.auth.example.org."
+	config.API.AltNames = []string{"auth.brand.com", "acme.auth.example.org", ""}
+	if names := apiCertNames(config); !reflect.DeepEqual(names, []string{"acme.auth.example.org", "auth.brand.com"}) {
+		t.Errorf("Expected api_domain followed by the alternative names, got %v", names)
+	}
+
+	for i, test := range []struct {
+		domain   string
+		altNames []string
+		valid    bool
+	}{
+		{"", nil, true},
+		{"acme.auth.example.org", []string{"auth.brand.com", "api.auth.brand.com"}, true},
+		{"acme.example.org", nil, false},
+		{"", []string{"auth.brand.com", "brand.com"}, false},
+	} {
+		config := multiZoneConfig()
+		config.API.TLS = "letsencrypt"
+		config.API.Domain, config.API.AltNames = test.domain, test.altNames
+		err := prepareACMEConfig(config)
+		if test.valid && err != nil {
+			t.Errorf("Test %d: Expected no error, got [%v]", i, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Test %d: Expected error, got none", i)
+		}
+	}
+}
+
+func TestConfigureACME(t *testing.T) {
+	issuer := certmagic.ACMEIssuer{TestCA: certmagic.LetsEncryptStagingCA}
+	if err := configureACME(&issuer, httpapi{}, "letsencrypt"); err != nil {
+		t.Fatalf("Expected no error, got [%v]", err)
+	}
+	if issuer.CA != certmagic.LetsEncryptProductionCA || issuer.TestCA != certmagic.LetsEncryptStagingCA {
+		t.Errorf("Expected the Let's Encrypt CAs, got %s and %s", issuer.CA, issuer.TestCA)
+	}
+
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	root := writeCARoot(t, server)
+	api := httpapi{
+		ACMEDirectory: "https://ca.example.org/acme/directory",
+		ACMEEABKeyID:  "kid-1",
+		ACMEEABHMAC:   "c2VjcmV0",
+		ACMECARoot:    root,
+	}
+	issuer = certmagic.ACMEIssuer{TestCA: certmagic.LetsEncryptStagingCA}
+	if err := configureACME(&issuer, api, "acme"); err != nil {
+		t.Fatalf("Expected no error, got [%v]", err)
+	}
+	if issuer.CA != api.ACMEDirectory || issuer.TestCA != "" {
+		t.Errorf("Expected only the configured CA, got %s and %s", issuer.CA, issuer.TestCA)
+	}
+	if issuer.ExternalAccount == nil || issuer.ExternalAccount.KeyID != "kid-1" || issuer.ExternalAccount.MACKey != "c2VjcmV0" {
+		t.Errorf("Expected the external account binding, got %v", issuer.ExternalAccount)
+	}
+	if _, err := server.Certificate().Verify(x509.VerifyOptions{Roots: issuer.TrustedRoots}); err != nil {
+		t.Errorf("Expected the CA certificate to be trusted, got [%v]", err)
+	}
+
+	invalid := filepath.Join(t.TempDir(), "invalid.pem")
+	if err := os.WriteFile(invalid, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	for _, path := range []string{invalid, filepath.Join(t.TempDir(), "missing.pem")} {
+		api.ACMECARoot = path
+		if err := configureACME(&certmagic.ACMEIssuer{}, api, "acme"); err == nil {
+			t.Errorf("Expected error for the CA root %s, got none", path)
+		}
+	}
+}
+
+// TestACMEExternalAccountBinding registers an account with an ACME server stand-in trusted
+// through the configured root, and checks the external account binding it receives
+func TestACMEExternalAccountBinding(t *testing.T) {
+	var mu sync.Mutex
+	var eabKeyID string
+	mux := http.NewServeMux()
+	var server *httptest.Server
+	nonce := func(w http.ResponseWriter) {
+		w.Header().Set("Replay-Nonce", base64.RawURLEncoding.EncodeToString([]byte(generatePassword(16))))
+	}
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"newNonce":   server.URL + "/nonce",
+			"newAccount": server.URL + "/account",
+			"newOrder":   server.URL + "/order",
+			"meta":       map[string]interface{}{"externalAccountRequired": true},
+		})
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {
+		nonce(w)
+	})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		var jws struct {
+			Payload string `json:"payload"`
+		}
+		var account struct {
+			EAB struct {
+				Protected string `json:"protected"`
+			} `json:"externalAccountBinding"`
+		}
+		var protected struct {
+			KeyID string `json:"kid"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&jws)
+		payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+		_ = json.Unmarshal(payload, &account)
+		header, _ := base64.RawURLEncoding.DecodeString(account.EAB.Protected)
+		_ = json.Unmarshal(header, &protected)
+		mu.Lock()
+		eabKeyID = protected.KeyID
+		mu.Unlock()
+		nonce(w)
+		w.Header().Set("Location", server.URL+"/account/1")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"status": "valid"}`))
+	})
+	mux.HandleFunc("/order", func(w http.ResponseWriter, r *http.Request) {
+		nonce(w)
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"type": "urn:ietf:params:acme:error:rejectedIdentifier", "detail": "stand-in"}`))
+	})
+	server = httptest.NewTLSServer(mux)
+	defer server.Close()
+
+	api := httpapi{
+		ACMEDirectory: server.URL + "/directory",
+		ACMEEABKeyID:  "kid-1",
+		ACMEEABHMAC:   base64.RawURLEncoding.EncodeToString([]byte("secret")),
+		ACMECARoot:    writeCARoot(t, server),
+	}
+	template := certmagic.ACMEIssuer{Agreed: true, Email: "admin@example.org"}
+	if err := configureACME(&template, api, "acme"); err != nil {
+		t.Fatalf("Could not configure ACME: %v", err)
+	}
+	cache := certmagic.NewCache(certmagic.CacheOptions{
+		GetConfigForCert: func(cert certmagic.Certificate) (*certmagic.Config, error) {
+			return nil, nil
+		},
+	})
+	defer cache.Stop()
+	magic := certmagic.New(cache, certmagic.Config{Storage: &certmagic.FileStorage{Path: t.TempDir()}})
+	issuer := certmagic.NewACMEIssuer(magic, template)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "auth.example.org"},
+		DNSNames: []string{"auth.example.org"},
+	}, key)
+	if err != nil {
+		t.Fatalf("Could not create CSR: %v", err)
+	}
+	csr, _ := x509.ParseCertificateRequest(der)
+	// The stand-in rejects the order after the account is registered
+	if _, err = issuer.Issue(context.Background(), csr); err == nil {
+		t.Errorf("Expected the order to be rejected")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if eabKeyID != "kid-1" {
+		t.Errorf("Expected the account to be bound to kid-1, got %q", eabKeyID)
+	}
+}
+
+// writeCARoot writes the certificate of a TLS test server as the root of the CA
+func writeCARoot(t *testing.T, server *httptest.Server) string {
+	path := filepath.Join(t.TempDir(), "root.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Could not write the CA root: %v", err)
+	}
+	return path
+}
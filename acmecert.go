@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// acmeCertCheckInterval is the longest interval of checking if the API certificate is due for
+	// renewal, a short-lived certificate is checked when it becomes due
+	acmeCertCheckInterval = 12 * time.Hour
+	// acmeCertMinCheckInterval is the shortest interval of checking the API certificate
+	acmeCertMinCheckInterval = time.Minute
+	// acmeCertRetryInterval is the time waited before retrying a failed issuance
+	acmeCertRetryInterval = 10 * time.Minute
+	// acmeCertStoragePrefix is the prefix of the storage keys of the API certificate
+	acmeCertStoragePrefix = "acme-dns"
+)
+
+// errNoCertificate is returned by the TLS handshakes before the API certificate is issued
+var errNoCertificate = errors.New("the API certificate has not been issued yet")
+
+// acmeCertificate is the API certificate issued with ACME, covering all the names of the API.
+// certmagic manages a certificate for each name, so the certificate is issued with the ACME
+// issuer and stored in the storage of certmagic here, and renewed when two thirds of its lifetime
+// have passed. The instances sharing the storage share the certificate. The OCSP response is
+// stapled to it by watchCertificates, like to the certificates loaded from files.
+type acmeCertificate struct {
+	names   []string
+	issuer  certmagic.Issuer
+	storage certmagic.Storage
+	// certs serves the certificate and staples its OCSP response
+	certs *certReloader
+}
+
+func newACMECertificate(names []string, issuer certmagic.Issuer, storage certmagic.Storage) *acmeCertificate {
+	return &acmeCertificate{names: names, issuer: issuer, storage: storage, certs: &certReloader{}}
+}
+
+// GetCertificate returns the current certificate, for use in tls.Config
+func (a *acmeCertificate) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, _ := a.certs.GetCertificate(hello)
+	if cert == nil {
+		return nil, errNoCertificate
+	}
+	return cert, nil
+}
+
+// Run issues the certificate, or loads it from the storage, and renews it until the context is
+// done
+func (a *acmeCertificate) Run(ctx context.Context) {
+	fields := log.Fields{"domains": a.names}
+	for {
+		wait := acmeCertRetryInterval
+		if renewed, err := a.RenewIfDue(ctx); err != nil {
+			log.WithFields(fields).WithFields(log.Fields{"error": err.Error(), "retry": acmeCertRetryInterval.String()}).Error("Could not issue the API certificate")
+		} else {
+			if renewed {
+				log.WithFields(fields).Info("Issued the API certificate")
+			}
+			if cert, _ := a.certs.GetCertificate(nil); cert != nil {
+				wait = renewalWait(cert.Leaf, time.Now())
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// RenewIfDue loads the certificate from the storage if there is none yet, and issues a new one
+// if the certificate is missing, does not cover all the names or is due for renewal
+func (a *acmeCertificate) RenewIfDue(ctx context.Context) (bool, error) {
+	if cert, _ := a.certs.GetCertificate(nil); cert != nil && !renewalDue(cert.Leaf) {
+		return false, nil
+	}
+	if cert, err := a.load(ctx); err == nil && !renewalDue(cert.Leaf) {
+		a.certs.set(&loadedCertificate{cert: cert})
+		return false, nil
+	}
+
+	lockName := a.storageKey("issue")
+	if err := a.storage.Lock(ctx, lockName); err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = a.storage.Unlock(context.Background(), lockName)
+	}()
+	// Another instance sharing the storage may have renewed the certificate meanwhile
+	if cert, err := a.load(ctx); err == nil && !renewalDue(cert.Leaf) {
+		a.certs.set(&loadedCertificate{cert: cert})
+		return false, nil
+	}
+	cert, err := a.issue(ctx)
+	if err != nil {
+		return false, err
+	}
+	a.certs.set(&loadedCertificate{cert: cert})
+	return true, nil
+}
+
+// issue issues a new certificate for a new key, and stores them
+func (a *acmeCertificate) issue(ctx context.Context) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: a.names}, key)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+	issued, err := a.issuer.Issue(ctx, csr)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := a.parse(issued.Certificate, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("issued certificate: %v", err)
+	}
+	if err = a.storage.Store(ctx, a.storageKey("key"), keyPEM); err != nil {
+		return nil, err
+	}
+	if err = a.storage.Store(ctx, a.storageKey("crt"), issued.Certificate); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// load loads the certificate from the storage. Without one, the certificate certmagic has
+// stored for the primary name before the certificate covered all the names is used, so that
+// upgrading does not issue a new certificate.
+func (a *acmeCertificate) load(ctx context.Context) (*tls.Certificate, error) {
+	cert, err := a.loadKeys(ctx, a.storageKey("crt"), a.storageKey("key"))
+	if errors.Is(err, fs.ErrNotExist) {
+		issuerKey := a.issuer.IssuerKey()
+		return a.loadKeys(ctx, certmagic.StorageKeys.SiteCert(issuerKey, a.names[0]), certmagic.StorageKeys.SitePrivateKey(issuerKey, a.names[0]))
+	}
+	return cert, err
+}
+
+// loadKeys loads the certificate and the key stored at the storage keys
+func (a *acmeCertificate) loadKeys(ctx context.Context, certKey string, keyKey string) (*tls.Certificate, error) {
+	certPEM, err := a.storage.Load(ctx, certKey)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := a.storage.Load(ctx, keyKey)
+	if err != nil {
+		return nil, err
+	}
+	return a.parse(certPEM, keyPEM)
+}
+
+// parse parses the certificate chain and the key, and checks that the certificate covers all the
+// names
+func (a *acmeCertificate) parse(certPEM []byte, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	for _, name := range a.names {
+		if err = cert.Leaf.VerifyHostname(name); err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// storageKey returns the storage key of the certificate, the key or the lock, separate for each
+// CA and set of names
+func (a *acmeCertificate) storageKey(kind string) string {
+	return path.Join(acmeCertStoragePrefix, certmagic.StorageKeys.Safe(a.issuer.IssuerKey()), certmagic.StorageKeys.Safe(a.names[0])+"."+kind)
+}
+
+// renewalDue checks if two thirds of the lifetime of the certificate have passed
+func renewalDue(leaf *x509.Certificate) bool {
+	return time.Now().After(renewalTime(leaf))
+}
+
+// renewalTime returns the time two thirds of the lifetime of the certificate have passed at
+func renewalTime(leaf *x509.Certificate) time.Time {
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	return leaf.NotBefore.Add(lifetime * 2 / 3)
+}
+
+// renewalWait returns the time to wait before checking the certificate again: until it is due
+// for renewal, but at most acmeCertCheckInterval and at least acmeCertMinCheckInterval
+func renewalWait(leaf *x509.Certificate, now time.Time) time.Duration {
+	wait := renewalTime(leaf).Sub(now)
+	if wait > acmeCertCheckInterval {
+		return acmeCertCheckInterval
+	}
+	if wait < acmeCertMinCheckInterval {
+		return acmeCertMinCheckInterval
+	}
+	return wait
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// testIssuer issues the certificates of the CSRs with a test CA
+type testIssuer struct {
+	ca       *x509.Certificate
+	caKey    *ecdsa.PrivateKey
+	lifetime time.Duration
+	fail     atomic.Bool
+	issued   atomic.Int64
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	return &testIssuer{ca: ca, caKey: caKey, lifetime: time.Hour}
+}
+
+func (i *testIssuer) Issue(_ context.Context, csr *x509.CertificateRequest) (*certmagic.IssuedCertificate, error) {
+	if i.fail.Load() {
+		return nil, errors.New("issuance failed")
+	}
+	i.issued.Add(1)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(i.lifetime),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, i.ca, csr.PublicKey, i.caKey)
+	if err != nil {
+		return nil, err
+	}
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: i.ca.Raw})...)
+	return &certmagic.IssuedCertificate{Certificate: chain}, nil
+}
+
+func (i *testIssuer) IssuerKey() string {
+	return "test-ca"
+}
+
+func TestACMECertificate(t *testing.T) {
+	names := []string{"auth.example.org", "acme.auth.example.org", "auth.brand.com"}
+	issuer := newTestIssuer(t)
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	ctx := context.Background()
+
+	cert := newACMECertificate(names, issuer, storage)
+	if _, err := cert.GetCertificate(nil); err == nil {
+		t.Errorf("Expected error before the certificate is issued, got none")
+	}
+	if renewed, err := cert.RenewIfDue(ctx); !renewed || err != nil {
+		t.Fatalf("Expected the certificate to be issued, got %t [%v]", renewed, err)
+	}
+	served, err := cert.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Expected the issued certificate, got [%v]", err)
+	}
+	// A single certificate covers all the names
+	if !reflect.DeepEqual(served.Leaf.DNSNames, names) {
+		t.Errorf("Expected a certificate for %v, got %v", names, served.Leaf.DNSNames)
+	}
+	if renewed, err := cert.RenewIfDue(ctx); renewed || err != nil || issuer.issued.Load() != 1 {
+		t.Errorf("Expected the valid certificate to be kept, got %t [%v]", renewed, err)
+	}
+
+	// Another instance sharing the storage uses the stored certificate
+	other := newACMECertificate(names, issuer, storage)
+	if renewed, err := other.RenewIfDue(ctx); renewed || err != nil || issuer.issued.Load() != 1 {
+		t.Errorf("Expected the stored certificate to be used, got %t [%v]", renewed, err)
+	}
+	if stored, _ := other.GetCertificate(nil); stored == nil || !reflect.DeepEqual(stored.Certificate, served.Certificate) {
+		t.Errorf("Expected the stored certificate to be served")
+	}
+
+	// A stored certificate not covering an added name is replaced
+	more := newACMECertificate(append(names, "www.auth.example.org"), issuer, storage)
+	if renewed, err := more.RenewIfDue(ctx); !renewed || err != nil || issuer.issued.Load() != 2 {
+		t.Errorf("Expected a certificate for the added name to be issued, got %t [%v]", renewed, err)
+	}
+
+	// A failed issuance keeps the current certificate
+	issuer.fail.Store(true)
+	expiring := newACMECertificate([]string{"expiring.auth.example.org"}, issuer, storage)
+	if _, err := expiring.RenewIfDue(ctx); err == nil {
+		t.Errorf("Expected error for a failed issuance, got none")
+	}
+}
+
+func TestACMECertificateRenewal(t *testing.T) {
+	issuer := newTestIssuer(t)
+	// Two thirds of the lifetime of the certificates have passed when they are issued
+	issuer.lifetime = 30 * time.Second
+	cert := newACMECertificate([]string{"auth.example.org"}, issuer, &certmagic.FileStorage{Path: t.TempDir()})
+	ctx := context.Background()
+	if _, err := cert.RenewIfDue(ctx); err != nil {
+		t.Fatalf("Expected the certificate to be issued, got [%v]", err)
+	}
+	first, _ := cert.GetCertificate(nil)
+	if renewed, err := cert.RenewIfDue(ctx); !renewed || err != nil {
+		t.Errorf("Expected the certificate due for renewal to be renewed, got %t [%v]", renewed, err)
+	}
+	issuer.fail.Store(true)
+	second, _ := cert.GetCertificate(nil)
+	if second == first {
+		t.Errorf("Expected the renewed certificate to be served")
+	}
+	if _, err := cert.RenewIfDue(ctx); err == nil {
+		t.Errorf("Expected error for a failed renewal, got none")
+	}
+	if current, _ := cert.GetCertificate(nil); current != second {
+		t.Errorf("Expected the current certificate to be kept after a failed renewal")
+	}
+}
+
+func TestACMECertificateRenewalWait(t *testing.T) {
+	issuer := newTestIssuer(t)
+	// The default lifetime of the step-ca certificates
+	issuer.lifetime = 24 * time.Hour
+	cert := newACMECertificate([]string{"auth.example.org"}, issuer, &certmagic.FileStorage{Path: t.TempDir()})
+	if _, err := cert.RenewIfDue(context.Background()); err != nil {
+		t.Fatalf("Expected the certificate to be issued, got [%v]", err)
+	}
+	served, _ := cert.GetCertificate(nil)
+	due := renewalTime(served.Leaf)
+	for i, test := range []struct {
+		now      time.Time
+		expected time.Duration
+	}{
+		{time.Now(), acmeCertCheckInterval},
+		// The certificate is checked when it becomes due, before the next regular check
+		{due.Add(-4 * time.Hour), 4 * time.Hour},
+		{due.Add(-time.Second), acmeCertMinCheckInterval},
+		{due.Add(time.Hour), acmeCertMinCheckInterval},
+	} {
+		if wait := renewalWait(served.Leaf, test.now); wait != test.expected {
+			t.Errorf("Test %d: Expected to wait %s, got %s", i, test.expected, wait)
+		}
+	}
+}
+
+func TestACMECertificateCertmagicStorage(t *testing.T) {
+	issuer := newTestIssuer(t)
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	ctx := context.Background()
+
+	// The certificate certmagic stored for the primary name is used, if it covers all the names
+	stored := newACMECertificate([]string{"auth.example.org"}, issuer, storage)
+	if _, err := stored.RenewIfDue(ctx); err != nil {
+		t.Fatalf("Expected the certificate to be issued, got [%v]", err)
+	}
+	for _, kind := range []string{"crt", "key"} {
+		data, err := storage.Load(ctx, stored.storageKey(kind))
+		if err != nil {
+			t.Fatalf("Could not load the stored certificate: %v", err)
+		}
+		key := certmagic.StorageKeys.SiteCert(issuer.IssuerKey(), "auth.example.org")
+		if kind == "key" {
+			key = certmagic.StorageKeys.SitePrivateKey(issuer.IssuerKey(), "auth.example.org")
+		}
+		if err = storage.Store(ctx, key, data); err != nil {
+			t.Fatalf("Could not store the certificate: %v", err)
+		}
+		if err = storage.Delete(ctx, stored.storageKey(kind)); err != nil {
+			t.Fatalf("Could not delete the certificate: %v", err)
+		}
+	}
+	cert := newACMECertificate([]string{"auth.example.org"}, issuer, storage)
+	if renewed, err := cert.RenewIfDue(ctx); renewed || err != nil || issuer.issued.Load() != 1 {
+		t.Errorf("Expected the certificate of certmagic to be used, got %t [%v]", renewed, err)
+	}
+	more := newACMECertificate([]string{"auth.example.org", "auth.brand.com"}, issuer, storage)
+	if renewed, err := more.RenewIfDue(ctx); !renewed || err != nil || issuer.issued.Load() != 2 {
+		t.Errorf("Expected a certificate for all the names to be issued, got %t [%v]", renewed, err)
+	}
+}
@@ -14,6 +14,8 @@ type ACMETxt struct {
 	Password string
 	ACMETxtPost
 	AllowFrom cidrslice
+	// Zone is the domain of the zone the account is registered in, empty for the default zone
+	Zone string
 }
 
 // ACMETxtPost holds the DNS part of the ACMETxt struct
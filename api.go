@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
@@ -19,6 +21,33 @@ type RegResponse struct {
 	Allowfrom  []string `json:"allowfrom"`
 }
 
+// UpdateResponse is a struct for update response JSON
+type UpdateResponse struct {
+	TXT           string             `json:"txt"`
+	Visible       *bool              `json:"visible,omitempty"`
+	Servers       []ServerVisibility `json:"servers,omitempty"`
+	Replicated    *int               `json:"replicated,omitempty"`
+	QuorumReached *bool              `json:"quorum_reached,omitempty"`
+}
+
+// StatusResponse is a struct for status response JSON
+type StatusResponse struct {
+	Subdomain  string      `json:"subdomain"`
+	Fulldomain string      `json:"fulldomain"`
+	TXT        []TXTStatus `json:"txt"`
+}
+
+// TXTStatus holds the lookup status of a single TXT value in the status response JSON. The
+// lookups are the ones served by this node, the nameservers tell if the value is answered by
+// every DNS listener of this node and by the wait_nameservers, like the other nodes.
+type TXTStatus struct {
+	Value       string             `json:"value"`
+	Served      bool               `json:"served"`
+	LastServed  int64              `json:"last_served,omitempty"`
+	Resolvers   []ResolverLookup   `json:"resolvers"`
+	Nameservers []ServerVisibility `json:"nameservers"`
+}
+
 func webRegisterPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	var regStatus int
 	var reg []byte
@@ -48,8 +77,19 @@ func webRegisterPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 		return
 	}
 
+	// Fail with a zone that is not configured
+	zone, ok := zoneKey(Config, aTXT.Zone)
+	if !ok {
+		regStatus = http.StatusBadRequest
+		reg = jsonError("invalid_zone")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(regStatus)
+		_, _ = w.Write(reg)
+		return
+	}
+
 	// Create new user
-	nu, err := DB.Register(aTXT.AllowFrom)
+	nu, err := DB.Register(aTXT.AllowFrom, zone)
 	if err != nil {
 		errstr := fmt.Sprintf("%v", err)
 		reg = jsonError(errstr)
@@ -57,7 +97,8 @@ func webRegisterPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 		log.WithFields(log.Fields{"error": err.Error()}).Debug("Error in registration")
 	} else {
 		log.WithFields(log.Fields{"user": nu.Username.String()}).Debug("Created new user")
-		regStruct := RegResponse{nu.Username.String(), nu.Password, nu.Subdomain + "." + Config.General.Domain, nu.Subdomain, nu.AllowFrom.ValidEntries()}
+		replicateRegistration(nu)
+		regStruct := RegResponse{nu.Username.String(), nu.Password, fullDomain(nu.Subdomain, nu.Zone), nu.Subdomain, nu.AllowFrom.ValidEntries()}
 		regStatus = http.StatusCreated
 		reg, err = json.Marshal(regStruct)
 		if err != nil {
@@ -91,15 +132,51 @@ func webUpdatePost(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 		updStatus = http.StatusBadRequest
 		upd = jsonError("bad_txt")
 	} else if validSubdomain(a.Subdomain) && validTXT(a.Value) {
-		err := DB.Update(a.ACMETxtPost)
+		lastUpdate, err := DB.Update(a.ACMETxtPost)
 		if err != nil {
 			log.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to update record")
 			updStatus = http.StatusInternalServerError
 			upd = jsonError("db_error")
 		} else {
 			log.WithFields(log.Fields{"subdomain": a.Subdomain, "txt": a.Value}).Debug("TXT updated")
+			Webhooks.Notify(WebhookEvent{
+				Event:      webhookEventUpdate,
+				Subdomain:  a.Subdomain,
+				Fulldomain: fullDomain(a.Subdomain, a.Zone),
+				TXT:        []string{a.Value},
+			})
+			updStruct := UpdateResponse{TXT: a.Value}
+			// The peers resolve the conflicts by the update time stored here
+			results := Cluster.Replicate(ClusterMessage{
+				Type:      clusterMessageUpdate,
+				Subdomain: a.Subdomain,
+				TXT:       &dbTXT{Value: a.Value, LastUpdate: lastUpdate},
+			})
+			if Cluster != nil && Config.Cluster.Quorum > 0 {
+				replicated := waitQuorum(results, Config.Cluster.Quorum, time.Duration(Config.Cluster.Timeout)*time.Second)
+				reached := replicated >= Config.Cluster.Quorum
+				updStruct.Replicated = &replicated
+				updStruct.QuorumReached = &reached
+				if !reached {
+					// The value is committed locally and stays queued for the peers, so a retry
+					// by the client would only push the other TXT value out
+					log.WithFields(log.Fields{"subdomain": a.Subdomain, "replicated": replicated}).Warning("TXT update did not reach the replication quorum")
+				}
+			}
+			if wait, _ := strconv.ParseBool(r.URL.Query().Get("wait")); wait {
+				timeout := time.Duration(Config.API.WaitTimeout) * time.Second
+				updStruct.Servers = waitForVisibility(visibilityTargets(Config), fullDomain(a.Subdomain, a.Zone), a.Value, timeout)
+				visible := allVisible(updStruct.Servers)
+				updStruct.Visible = &visible
+				log.WithFields(log.Fields{"subdomain": a.Subdomain, "txt": a.Value, "visible": visible}).Debug("Waited for TXT visibility")
+			}
 			updStatus = http.StatusOK
-			upd = []byte("{\"txt\": \"" + a.Value + "\"}")
+			upd, err = json.Marshal(updStruct)
+			if err != nil {
+				updStatus = http.StatusInternalServerError
+				upd = jsonError("json_error")
+				log.WithFields(log.Fields{"error": "json"}).Debug("Could not marshal JSON")
+			}
 		}
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -107,6 +184,70 @@ func webUpdatePost(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	_, _ = w.Write(upd)
 }
 
+func webStatusGet(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var statStatus int
+	var stat []byte
+	a, ok := r.Context().Value(ACMETxtKey).(ACMETxt)
+	if !ok {
+		log.WithFields(log.Fields{"error": "context"}).Error("Context error")
+	}
+	txts, err := DB.GetTXTForDomain(a.Subdomain, a.Zone)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get record")
+		statStatus = http.StatusInternalServerError
+		stat = jsonError("db_error")
+	} else {
+		statStruct := StatusResponse{Subdomain: a.Subdomain, Fulldomain: fullDomain(a.Subdomain, a.Zone), TXT: []TXTStatus{}}
+		targets := visibilityTargets(Config)
+		for _, v := range txts {
+			if v == "" {
+				continue
+			}
+			lastServed, resolvers, served := Lookups.Get(a.Subdomain, v)
+			txtStatus := TXTStatus{Value: v, Served: served, Resolvers: resolvers}
+			// Each nameserver is queried once, without waiting
+			txtStatus.Nameservers = waitForVisibility(targets, statStruct.Fulldomain, v, 0)
+			if served {
+				txtStatus.LastServed = lastServed.Unix()
+			}
+			statStruct.TXT = append(statStruct.TXT, txtStatus)
+		}
+		statStatus = http.StatusOK
+		stat, err = json.Marshal(statStruct)
+		if err != nil {
+			statStatus = http.StatusInternalServerError
+			stat = jsonError("json_error")
+			log.WithFields(log.Fields{"error": "json"}).Debug("Could not marshal JSON")
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statStatus)
+	_, _ = w.Write(stat)
+}
+
+// replicateRegistration sends the new account, with the password hash from the database, to the
+// cluster peers
+func replicateRegistration(nu ACMETxt) {
+	if Cluster == nil {
+		return
+	}
+	stored, err := DB.GetByUsername(nu.Username)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "user": nu.Username.String()}).Error("Could not read the new user for replication")
+		return
+	}
+	Cluster.Replicate(ClusterMessage{
+		Type: clusterMessageRegister,
+		Record: &dbRecord{
+			Username:  stored.Username.String(),
+			Password:  stored.Password,
+			Subdomain: stored.Subdomain,
+			AllowFrom: stored.AllowFrom.ValidEntries(),
+			Zone:      stored.Zone,
+		},
+	})
+}
+
 // Endpoint used to check the readiness and/or liveness (health) of the server.
 func healthCheck(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	w.WriteHeader(http.StatusOK)
@@ -12,6 +12,7 @@ import (
 	"github.com/gavv/httpexpect"
 	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
 	"github.com/rs/cors"
 )
 
@@ -72,6 +73,7 @@ func setupRouter(debug bool, noauth bool) http.Handler {
 	})
 	api.POST("/register", webRegisterPost)
 	api.GET("/health", healthCheck)
+	api.GET("/status", AuthUser(webStatusGet))
 	if noauth {
 		api.POST("/update", noAuth(webUpdatePost))
 	} else {
@@ -202,7 +204,7 @@ func TestApiUpdateWithInvalidSubdomain(t *testing.T) {
 	server := httptest.NewServer(router)
 	defer server.Close()
 	e := getExpect(t, server)
-	newUser, err := DB.Register(cidrslice{})
+	newUser, err := DB.Register(cidrslice{}, "")
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
@@ -232,7 +234,7 @@ func TestApiUpdateWithInvalidTxt(t *testing.T) {
 	server := httptest.NewServer(router)
 	defer server.Close()
 	e := getExpect(t, server)
-	newUser, err := DB.Register(cidrslice{})
+	newUser, err := DB.Register(cidrslice{}, "")
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
@@ -274,7 +276,7 @@ func TestApiUpdateWithCredentials(t *testing.T) {
 	server := httptest.NewServer(router)
 	defer server.Close()
 	e := getExpect(t, server)
-	newUser, err := DB.Register(cidrslice{})
+	newUser, err := DB.Register(cidrslice{}, "")
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
@@ -330,20 +332,20 @@ func TestApiManyUpdateWithCredentials(t *testing.T) {
 	defer server.Close()
 	e := getExpect(t, server)
 	// User without defined CIDR masks
-	newUser, err := DB.Register(cidrslice{})
+	newUser, err := DB.Register(cidrslice{}, "")
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
 
 	// User with defined allow from - CIDR masks, all invalid
 	// (httpexpect doesn't provide a way to mock remote ip)
-	newUserWithCIDR, err := DB.Register(cidrslice{"192.168.1.1/32", "invalid"})
+	newUserWithCIDR, err := DB.Register(cidrslice{"192.168.1.1/32", "invalid"}, "")
 	if err != nil {
 		t.Errorf("Could not create new user with CIDR, got error [%v]", err)
 	}
 
 	// Another user with valid CIDR mask to match the httpexpect default
-	newUserWithValidCIDR, err := DB.Register(cidrslice{"10.1.2.3/32", "invalid"})
+	newUserWithValidCIDR, err := DB.Register(cidrslice{"10.1.2.3/32", "invalid"}, "")
 	if err != nil {
 		t.Errorf("Could not create new user with a valid CIDR, got error [%v]", err)
 	}
@@ -388,17 +390,17 @@ func TestApiManyUpdateWithIpCheckHeaders(t *testing.T) {
 	// Use header checks from default header (X-Forwarded-For)
 	Config.API.UseHeader = true
 	// User without defined CIDR masks
-	newUser, err := DB.Register(cidrslice{})
+	newUser, err := DB.Register(cidrslice{}, "")
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
 
-	newUserWithCIDR, err := DB.Register(cidrslice{"192.168.1.2/32", "invalid"})
+	newUserWithCIDR, err := DB.Register(cidrslice{"192.168.1.2/32", "invalid"}, "")
 	if err != nil {
 		t.Errorf("Could not create new user with CIDR, got error [%v]", err)
 	}
 
-	newUserWithIP6CIDR, err := DB.Register(cidrslice{"2002:c0a8::0/32"})
+	newUserWithIP6CIDR, err := DB.Register(cidrslice{"2002:c0a8::0/32"}, "")
 	if err != nil {
 		t.Errorf("Could not create a new user with IP6 CIDR, got error [%v]", err)
 	}
@@ -438,3 +440,140 @@ func TestApiHealthCheck(t *testing.T) {
 	e := getExpect(t, server)
 	e.GET("/health").Expect().Status(http.StatusOK)
 }
+
+func TestApiStatus(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	oldConfig := Config
+	defer func() { Config = oldConfig }()
+	Config.General.Domain = "auth.example.org"
+	Config.General.Listen = "127.0.0.1:15353"
+	Config.General.Proto = "udp"
+	newUser, err := DB.Register(cidrslice{}, "")
+	if err != nil {
+		t.Errorf("Could not create new user, got error [%v]", err)
+	}
+	servedTXT := "______________served_status_value__________"
+	pendingTXT := "______________pending_status_value_________"
+	newUser.Value = servedTXT
+	_, _ = DB.Update(newUser.ACMETxtPost)
+
+	resolv := resolver{server: "127.0.0.1:15353"}
+	_, err = resolv.lookup(newUser.Subdomain+".auth.example.org", dns.TypeTXT)
+	if err != nil {
+		t.Fatalf("Could not resolve TXT record: %v", err)
+	}
+	newUser.Value = pendingTXT
+	_, _ = DB.Update(newUser.ACMETxtPost)
+
+	response := e.GET("/status").
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	response.ValueEqual("subdomain", newUser.Subdomain)
+	txts := response.Value("txt").Array()
+	txts.Length().Equal(2)
+	for _, v := range txts.Iter() {
+		txt := v.Object()
+		// Both values are answered by the DNS listener
+		txt.Value("nameservers").Array().Length().Equal(1)
+		txt.Value("nameservers").Array().Element(0).Object().
+			ValueEqual("server", "127.0.0.1:15353").
+			ValueEqual("visible", true)
+		switch txt.Value("value").String().Raw() {
+		case servedTXT:
+			txt.ValueEqual("served", true)
+			txt.ContainsKey("last_served")
+			txt.Value("resolvers").Array().Length().Equal(1)
+			txt.Value("resolvers").Array().Element(0).Object().ValueEqual("ip", "127.0.0.1")
+		case pendingTXT:
+			txt.ValueEqual("served", false)
+			txt.NotContainsKey("last_served")
+			txt.Value("resolvers").Array().Empty()
+		default:
+			t.Errorf("Unexpected TXT value in status response")
+		}
+	}
+
+	e.GET("/status").
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx").
+		Expect().
+		Status(http.StatusUnauthorized).
+		JSON().Object().
+		ValueEqual("error", "forbidden")
+
+	restrictedUser, _ := DB.Register(cidrslice{"192.168.1.2/32"}, "")
+	e.GET("/status").
+		WithHeader("X-Api-User", restrictedUser.Username.String()).
+		WithHeader("X-Api-Key", restrictedUser.Password).
+		WithHeader("X-Forwarded-For", "10.0.0.1").
+		Expect().
+		Status(http.StatusUnauthorized)
+}
+
+func TestApiUpdateWait(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	oldConfig := Config
+	defer func() { Config = oldConfig }()
+	Config.General.Domain = "auth.example.org"
+	Config.General.Listen = "127.0.0.1:15353"
+	Config.General.Proto = "udp"
+	Config.API.WaitTimeout = 1
+	newUser, err := DB.Register(cidrslice{}, "")
+	if err != nil {
+		t.Errorf("Could not create new user, got error [%v]", err)
+	}
+	validTxtData := "______________wait_for_this_value__________"
+	updateJSON := map[string]interface{}{
+		"subdomain": newUser.Subdomain,
+		"txt":       validTxtData}
+
+	response := e.POST("/update").
+		WithQuery("wait", "true").
+		WithJSON(updateJSON).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	response.ValueEqual("txt", validTxtData)
+	response.ValueEqual("visible", true)
+	response.Value("servers").Array().Length().Equal(1)
+	response.Value("servers").Array().Element(0).Object().
+		ValueEqual("server", "127.0.0.1:15353").
+		ValueEqual("protocol", "udp").
+		ValueEqual("visible", true)
+
+	Config.API.WaitNameservers = []string{"127.0.0.1:1"}
+	response = e.POST("/update").
+		WithQuery("wait", "true").
+		WithJSON(updateJSON).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	response.ValueEqual("visible", false)
+	response.Value("servers").Array().Length().Equal(2)
+	response.Value("servers").Array().Element(1).Object().
+		ValueEqual("visible", false).
+		ContainsKey("error")
+
+	e.POST("/update").
+		WithJSON(updateJSON).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		NotContainsKey("visible").
+		NotContainsKey("servers")
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// apiRoutesACME are the endpoints used by the ACME clients: /register, /update and /status
+	apiRoutesACME = "acme"
+	// apiRoutesHealth are the health and readiness check endpoints
+	apiRoutesHealth = "health"
+	// apiRoutesCluster is the endpoint the cluster peers replicate the changes to
+	apiRoutesCluster = "cluster"
+	// apiRoutesAdmin are the admin endpoints, enabled by setting the admin token
+	apiRoutesAdmin = "admin"
+	// unixSocketPrefix is the prefix of the API listener addresses that are Unix socket paths
+	unixSocketPrefix = "unix:"
+)
+
+// apiRouteGroups are the route groups an API listener can serve
+var apiRouteGroups = []string{apiRoutesACME, apiRoutesHealth, apiRoutesCluster, apiRoutesAdmin}
+
+// apiDefaultRoutes are the route groups of an API listener without routes, and of the listener of
+// the api section. The cluster and admin endpoints are only served by the listeners they are
+// enabled for, so they are not exposed on the public ACME port by default.
+var apiDefaultRoutes = []string{apiRoutesACME, apiRoutesHealth}
+
+// apiTLSModes are the TLS modes of the API listeners
+var apiTLSModes = map[string]bool{
+	"none":               true,
+	"cert":               true,
+	"letsencrypt":        true,
+	"letsencryptstaging": true,
+	"acme":               true,
+}
+
+// prepareAPIListenerConfig validates the API listeners
+func prepareAPIListenerConfig(api httpapi, listeners []apilistenerconfig) ([]apilistenerconfig, error) {
+	seen := make(map[string]bool)
+	acmeMode := ""
+	for i := range listeners {
+		lc := &listeners[i]
+		lc.TLS = strings.ToLower(lc.TLS)
+		if lc.Address == "" {
+			return listeners, errors.New("missing api_listener configuration option \"address\"")
+		}
+		if !apiTLSModes[lc.TLS] {
+			return listeners, fmt.Errorf("invalid tls %q of API listener %s", lc.TLS, lc.Address)
+		}
+		if lc.TLS == "cert" && (lc.TLSCertFullchain == "" || lc.TLSCertPrivkey == "") && (api.TLSCertFullchain == "" || api.TLSCertPrivkey == "") {
+			return listeners, fmt.Errorf("missing api_listener configuration option \"tls_cert_fullchain\" or \"tls_cert_privkey\" for API listener %s", lc.Address)
+		}
+		// There is a single ACME account and certificate storage for the API certificate
+		if isACMETLS(lc.TLS) {
+			if acmeMode != "" && acmeMode != lc.TLS {
+				return listeners, fmt.Errorf("API listeners can not use both %s and %s", acmeMode, lc.TLS)
+			}
+			acmeMode = lc.TLS
+		}
+		for _, group := range lc.Routes {
+			if !slices.Contains(apiRouteGroups, group) {
+				return listeners, fmt.Errorf("invalid route group %q of API listener %s, expected one of %s", group, lc.Address, strings.Join(apiRouteGroups, ", "))
+			}
+		}
+		if seen[lc.Address] {
+			return listeners, fmt.Errorf("API listener %s is configured more than once", lc.Address)
+		}
+		seen[lc.Address] = true
+	}
+	return listeners, nil
+}
+
+// checkAPIRoutes checks that the enabled cluster and admin endpoints are served by an API listener
+func checkAPIRoutes(config DNSConfig) error {
+	enabled := map[string]bool{
+		apiRoutesCluster: len(config.Cluster.Peers) > 0,
+		apiRoutesAdmin:   config.API.AdminToken != "",
+	}
+	for _, group := range []string{apiRoutesCluster, apiRoutesAdmin} {
+		if !enabled[group] {
+			continue
+		}
+		served := false
+		for _, lc := range configAPIListeners(config) {
+			served = served || slices.Contains(lc.Routes, group)
+		}
+		if !served {
+			return fmt.Errorf("the %s endpoints are enabled, but no api_listener serves the %q routes", group, group)
+		}
+	}
+	return nil
+}
+
+// configAPIListeners returns the API listeners with the defaults of the api section filled in.
+// A listener is made of the api section if no listeners are configured.
+func configAPIListeners(config DNSConfig) []apilistenerconfig {
+	if len(config.APIListeners) == 0 {
+		return []apilistenerconfig{{
+			Address:          config.API.IP + ":" + config.API.Port,
+			TLS:              config.API.TLS,
+			TLSCertPrivkey:   config.API.TLSCertPrivkey,
+			TLSCertFullchain: config.API.TLSCertFullchain,
+			CorsOrigins:      config.API.CorsOrigins,
+			Routes:           apiDefaultRoutes,
+		}}
+	}
+	listeners := make([]apilistenerconfig, 0, len(config.APIListeners))
+	for _, lc := range config.APIListeners {
+		if lc.TLSCertFullchain == "" || lc.TLSCertPrivkey == "" {
+			lc.TLSCertFullchain = config.API.TLSCertFullchain
+			lc.TLSCertPrivkey = config.API.TLSCertPrivkey
+		}
+		if lc.CorsOrigins == nil {
+			lc.CorsOrigins = config.API.CorsOrigins
+		}
+		if len(lc.Routes) == 0 {
+			lc.Routes = apiDefaultRoutes
+		}
+		listeners = append(listeners, lc)
+	}
+	return listeners
+}
+
+// apiListener is a HTTP API listener with the handler of its routes and its certificate. The
+// certificate is nil unless the listener uses certificate files.
+type apiListener struct {
+	config   apilistenerconfig
+	listener net.Listener
+	handler  *apiHandler
+	certs    *certReloader
+}
+
+// newAPIRouter returns the router of the endpoints of the route groups
+func newAPIRouter(routes []string, reloader *configReloader) *httprouter.Router {
+	api := httprouter.New()
+	for _, group := range routes {
+		switch group {
+		case apiRoutesACME:
+			if !Config.API.DisableRegistration {
+				api.POST("/register", webRegisterPost)
+			}
+			api.POST("/update", Auth(webUpdatePost))
+			api.GET("/status", AuthUser(webStatusGet))
+		case apiRoutesHealth:
+			api.GET("/health", healthCheck)
+			api.GET("/ready", readinessCheck)
+		case apiRoutesCluster:
+			if Cluster != nil {
+				api.POST(clusterPath, webClusterReplicate)
+			}
+		case apiRoutesAdmin:
+			if Config.API.AdminToken != "" {
+				api.POST(adminReloadPath, AdminAuth(reloader.webAdminReload))
+			}
+		}
+	}
+	return api
+}
+
+// unixSocketPath returns the path of the Unix socket of an API listener address
+func unixSocketPath(address string) (string, bool) {
+	return strings.CutPrefix(address, unixSocketPrefix)
+}
+
+// listenAPI binds the address of an API listener, a TCP address or a Unix socket path prefixed
+// with "unix:"
+func listenAPI(address string) (net.Listener, error) {
+	path, ok := unixSocketPath(address)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	// Remove the socket left behind by a previous run
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// The umask allows only the owner, let the group of the on-host clients connect as well
+	if err = os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// localClients makes the clients of a Unix socket appear as loopback clients, so they can be
+// allowed by the allowfrom ranges of the accounts
+func localClients(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = "127.0.0.1:0"
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPrepareAPIListenerConfig(t *testing.T) {
+	withCert := httpapi{TLSCertFullchain: "cert.pem", TLSCertPrivkey: "key.pem"}
+	for i, test := range []struct {
+		api       httpapi
+		listeners []apilistenerconfig
+		valid     bool
+	}{
+		{httpapi{}, nil, true},
+		{httpapi{}, []apilistenerconfig{{Address: "0.0.0.0:443", TLS: "LetsEncrypt", Routes: []string{"acme"}}, {Address: "unix:/run/acme-dns/api.sock", TLS: "none"}}, true},
+		{withCert, []apilistenerconfig{{Address: "0.0.0.0:443", TLS: "cert"}}, true},
+		{httpapi{}, []apilistenerconfig{{Address: "0.0.0.0:443", TLS: "cert", TLSCertFullchain: "cert.pem", TLSCertPrivkey: "key.pem"}}, true},
+		{httpapi{}, []apilistenerconfig{{Address: "0.0.0.0:443", TLS: "cert"}}, false},
+		{httpapi{}, []apilistenerconfig{{Address: "0.0.0.0:443"}}, false},
+		{httpapi{}, []apilistenerconfig{{TLS: "none"}}, false},
+		{httpapi{}, []apilistenerconfig{{Address: "127.0.0.1:8080", TLS: "none", Routes: []string{"metrics"}}}, false},
+		{httpapi{}, []apilistenerconfig{{Address: "127.0.0.1:8080", TLS: "none"}, {Address: "127.0.0.1:8080", TLS: "none"}}, false},
+		{httpapi{}, []apilistenerconfig{{Address: "0.0.0.0:443", TLS: "letsencrypt"}, {Address: "0.0.0.0:8443", TLS: "letsencryptstaging"}}, false},
+	} {
+		_, err := prepareAPIListenerConfig(test.api, test.listeners)
+		if test.valid && err != nil {
+			t.Errorf("Test %d: Expected no error, got [%v]", i, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Test %d: Expected error, got none", i)
+		}
+	}
+}
+
+func TestConfigAPIListeners(t *testing.T) {
+	api := httpapi{
+		IP:               "0.0.0.0",
+		Port:             "443",
+		TLS:              "cert",
+		TLSCertFullchain: "cert.pem",
+		TLSCertPrivkey:   "key.pem",
+		CorsOrigins:      []string{"*"},
+	}
+	listeners := configAPIListeners(DNSConfig{API: api})
+	expected := []apilistenerconfig{{Address: "0.0.0.0:443", TLS: "cert", TLSCertFullchain: "cert.pem", TLSCertPrivkey: "key.pem", CorsOrigins: []string{"*"}, Routes: []string{"acme", "health"}}}
+	if !reflect.DeepEqual(listeners, expected) {
+		t.Errorf("Expected the listener of the api section %v, got %v", expected, listeners)
+	}
+
+	listeners = configAPIListeners(DNSConfig{API: api, APIListeners: []apilistenerconfig{
+		{Address: "0.0.0.0:443", TLS: "cert", Routes: []string{"acme"}},
+		{Address: "127.0.0.1:8080", TLS: "none", CorsOrigins: []string{}, TLSCertFullchain: "other.pem", TLSCertPrivkey: "other.key"},
+	}})
+	expected = []apilistenerconfig{
+		{Address: "0.0.0.0:443", TLS: "cert", TLSCertFullchain: "cert.pem", TLSCertPrivkey: "key.pem", CorsOrigins: []string{"*"}, Routes: []string{"acme"}},
+		{Address: "127.0.0.1:8080", TLS: "none", TLSCertFullchain: "other.pem", TLSCertPrivkey: "other.key", CorsOrigins: []string{}, Routes: []string{"acme", "health"}},
+	}
+	if !reflect.DeepEqual(listeners, expected) {
+		t.Errorf("Expected the listeners with the defaults %v, got %v", expected, listeners)
+	}
+}
+
+func TestCheckAPIRoutes(t *testing.T) {
+	admin := []apilistenerconfig{{Address: "127.0.0.1:8080", Routes: []string{"health", "admin"}}}
+	cluster := []apilistenerconfig{{Address: "10.0.0.1:8443", Routes: []string{"cluster"}}}
+	peers := clustersettings{Peers: []string{"https://peer"}}
+	for i, test := range []struct {
+		config    DNSConfig
+		shouldErr bool
+	}{
+		{DNSConfig{}, false},
+		// The api section does not serve the admin and cluster endpoints
+		{DNSConfig{API: httpapi{AdminToken: "secret"}}, true},
+		{DNSConfig{Cluster: peers}, true},
+		{DNSConfig{API: httpapi{AdminToken: "secret"}, APIListeners: admin}, false},
+		{DNSConfig{API: httpapi{AdminToken: "secret"}, Cluster: peers, APIListeners: admin}, true},
+		{DNSConfig{Cluster: peers, APIListeners: cluster}, false},
+	} {
+		if err := checkAPIRoutes(test.config); test.shouldErr != (err != nil) {
+			t.Errorf("Test %d: Expected error %t, got [%v]", i, test.shouldErr, err)
+		}
+	}
+}
+
+func TestNewAPIRouter(t *testing.T) {
+	oldToken := Config.API.AdminToken
+	Config.API.AdminToken = "secret"
+	defer func() { Config.API.AdminToken = oldToken }()
+	reloader := &configReloader{}
+	for i, test := range []struct {
+		routes  []string
+		method  string
+		path    string
+		present bool
+	}{
+		{[]string{apiRoutesACME}, "POST", "/register", true},
+		{[]string{apiRoutesACME}, "GET", "/health", false},
+		{[]string{apiRoutesHealth}, "GET", "/health", true},
+		{[]string{apiRoutesHealth}, "GET", "/ready", true},
+		{[]string{apiRoutesHealth}, "POST", "/update", false},
+		{[]string{apiRoutesHealth}, "POST", adminReloadPath, false},
+		{[]string{apiRoutesHealth, apiRoutesAdmin}, "POST", adminReloadPath, true},
+		{apiRouteGroups, "GET", "/status", true},
+	} {
+		handle, _, _ := newAPIRouter(test.routes, reloader).Lookup(test.method, test.path)
+		if (handle != nil) != test.present {
+			t.Errorf("Test %d: Expected %s %s present %t with routes %v", i, test.method, test.path, test.present, test.routes)
+		}
+	}
+}
+
+func TestListenAPIUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.sock")
+	l, err := listenAPI(unixSocketPrefix + path)
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0660 {
+		t.Errorf("Expected a socket with permissions 0660, got %v [%v]", info, err)
+	}
+	// The socket left behind by a previous run is replaced
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if l, err = listenAPI(unixSocketPrefix + path); err != nil {
+		t.Fatalf("Could not listen on a stale socket: %v", err)
+	}
+	server := &http.Server{Handler: localClients(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.RemoteAddr))
+	}))}
+	go func() { _ = server.Serve(l) }()
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://acme-dns/")
+	if err != nil {
+		t.Fatalf("Could not connect to the socket: %v", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "127.0.0.1:0" {
+		t.Errorf("Expected the client to appear as a loopback client, got %s", body)
+	}
+
+	if _, err = listenAPI("127.0.0.1:-1"); err == nil {
+		t.Errorf("Expected error for an invalid address, got none")
+	}
+}
+
+func TestLocalClients(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "@"
+	var remote string
+	localClients(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote = r.RemoteAddr
+	})).ServeHTTP(httptest.NewRecorder(), req)
+	if remote != "127.0.0.1:0" {
+		t.Errorf("Expected a loopback address, got %s", remote)
+	}
+}
+
+func TestChownToUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.sock")
+	if err := os.WriteFile(path, []byte{}, 0600); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	if err := chownToUser(path, "", ""); err != nil {
+		t.Errorf("Expected no error without a user, got [%v]", err)
+	}
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("Could not look up the current user: %v", err)
+	}
+	if err = chownToUser(path, current.Username, ""); err != nil {
+		t.Errorf("Expected no error for the current user, got [%v]", err)
+	}
+	if err = chownToUser(path, "acme-dns-nonexistent-user", ""); err == nil {
+		t.Errorf("Expected error for an unknown user, got none")
+	}
+}
@@ -44,6 +44,7 @@ func Auth(update httprouter.Handle) httprouter.Handle {
 			// Set user info to the decoded ACMETxt object
 			postData.Username = user.Username
 			postData.Password = user.Password
+			postData.Zone = user.Zone
 			// Set the ACMETxt struct to context to pull in from update function
 			ctx := context.WithValue(r.Context(), ACMETxtKey, postData)
 			update(w, r.WithContext(ctx), p)
@@ -55,6 +56,26 @@ func Auth(update httprouter.Handle) httprouter.Handle {
 	}
 }
 
+// AuthUser middleware for requests that are authenticated with the credentials only. The
+// authenticated user is set to the request context.
+func AuthUser(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user, err := getUserFromRequest(r)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Error while trying to get user")
+		} else if !updateAllowedFromIP(r, user) {
+			log.WithFields(log.Fields{"error": "ip_unauthorized"}).Error("Request not allowed from IP")
+		} else {
+			ctx := context.WithValue(r.Context(), ACMETxtKey, user)
+			handle(w, r.WithContext(ctx), p)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write(jsonError("forbidden"))
+	}
+}
+
 func getUserFromRequest(r *http.Request) (ACMETxt, error) {
 	uname := r.Header.Get("X-Api-User")
 	passwd := r.Header.Get("X-Api-Key")
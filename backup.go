@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ExportVersion is the version of the export document format
+var ExportVersion = 1
+
+// Import conflict handling modes, used when an imported account differs from an existing one
+const (
+	importSkip      = "skip"
+	importOverwrite = "overwrite"
+	importFail      = "fail"
+)
+
+// exportDocument is the JSON document written by export and read by import
+type exportDocument struct {
+	Version  int        `json:"version"`
+	Exported time.Time  `json:"exported"`
+	Records  []dbRecord `json:"records"`
+}
+
+// importResult holds the counts of the imported records
+type importResult struct {
+	Added     int
+	Updated   int
+	Unchanged int
+	Skipped   int
+}
+
+// exportRecords writes all the records of the database to w
+func exportRecords(db database, w io.Writer) (int, error) {
+	records, err := db.GetRecords()
+	if err != nil {
+		return 0, err
+	}
+	if records == nil {
+		records = []dbRecord{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(exportDocument{Version: ExportVersion, Exported: time.Now().UTC(), Records: records})
+	return len(records), err
+}
+
+// importRecords reads an export document from r and stores its records to the database. Records
+// equal to the existing ones are left alone, so importing the same document again does nothing.
+// When an account exists with different credentials, subdomain, zone or allowfrom, the conflict mode
+// decides if the existing account is kept, replaced, or if the import fails. Subdomains of other
+// accounts are never taken over, as that would break the CNAME records pointing to them.
+func importRecords(db database, r io.Reader, mode string) (importResult, error) {
+	var result importResult
+	var doc exportDocument
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return result, fmt.Errorf("invalid export document: %v", err)
+	}
+	if doc.Version < 1 || doc.Version > ExportVersion {
+		return result, fmt.Errorf("unsupported export document version %d", doc.Version)
+	}
+	existing, err := db.GetRecords()
+	if err != nil {
+		return result, err
+	}
+	byUsername := make(map[string]dbRecord)
+	subdomainOwner := make(map[string]string)
+	for _, rec := range existing {
+		byUsername[rec.Username] = rec
+		subdomainOwner[rec.Subdomain] = rec.Username
+	}
+
+	for _, rec := range doc.Records {
+		if rec.Username == "" || rec.Password == "" || rec.Subdomain == "" {
+			return result, fmt.Errorf("record %q is missing a username, password or subdomain", rec.Username)
+		}
+		if owner, ok := subdomainOwner[rec.Subdomain]; ok && owner != rec.Username {
+			if mode == importSkip {
+				log.WithFields(log.Fields{"username": rec.Username, "subdomain": rec.Subdomain}).Warning("Skipping record, the subdomain belongs to another account")
+				result.Skipped++
+				continue
+			}
+			return result, fmt.Errorf("subdomain %s of record %s belongs to another account", rec.Subdomain, rec.Username)
+		}
+		old, exists := byUsername[rec.Username]
+		if exists {
+			if sameAccount(old, rec) {
+				// Keep the most recent TXT values of both
+				rec.TXT = mergeTXT(old.TXT, rec.TXT)
+				if reflect.DeepEqual(recordTXTSlots(old.TXT), rec.TXT) {
+					result.Unchanged++
+					continue
+				}
+			} else {
+				switch mode {
+				case importSkip:
+					log.WithFields(log.Fields{"username": rec.Username}).Warning("Skipping record, the account differs from the existing one")
+					result.Skipped++
+					continue
+				case importFail:
+					return result, fmt.Errorf("record %s differs from the existing account", rec.Username)
+				}
+			}
+		}
+		if err = db.PutRecord(rec); err != nil {
+			return result, fmt.Errorf("could not write the record %s: %v", rec.Username, err)
+		}
+		if exists {
+			delete(subdomainOwner, old.Subdomain)
+			result.Updated++
+		} else {
+			result.Added++
+		}
+		byUsername[rec.Username] = rec
+		subdomainOwner[rec.Subdomain] = rec.Username
+	}
+	return result, nil
+}
+
+// sameAccount checks if the records have the same credentials, subdomain, zone and allowfrom
+func sameAccount(a dbRecord, b dbRecord) bool {
+	afromA, afromB := cidrslice(a.AllowFrom), cidrslice(b.AllowFrom)
+	return a.Username == b.Username && a.Password == b.Password && a.Subdomain == b.Subdomain &&
+		a.Zone == b.Zone && afromA.JSON() == afromB.JSON()
+}
+
+// mergeTXT returns the two most recent distinct TXT values of both slices
+func mergeTXT(a []dbTXT, b []dbTXT) []dbTXT {
+	merged := append([]dbTXT{}, a...)
+	for _, txt := range b {
+		found := false
+		for _, m := range merged {
+			if m == txt {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, txt)
+		}
+	}
+	return recordTXTSlots(merged)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func newTestMemoryDB(t *testing.T) *memorydb {
+	t.Helper()
+	d := new(memorydb)
+	if err := d.Init("memory", ""); err != nil {
+		t.Fatalf("Could not open memory database: %v", err)
+	}
+	return d
+}
+
+func TestExportImport(t *testing.T) {
+	src := newTestMemoryDB(t)
+	reg, err := src.Register(cidrslice{"10.0.0.0/8"}, "")
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	reg.Value = "exported"
+	_, _ = src.Update(reg.ACMETxtPost)
+	_, _ = src.Register(cidrslice{}, "")
+
+	var buf bytes.Buffer
+	if n, err := exportRecords(src, &buf); err != nil || n != 2 {
+		t.Fatalf("Expected 2 exported records, got %d (%v)", n, err)
+	}
+	exported := buf.String()
+
+	dst := new(acmedb)
+	if err := dst.Init("sqlite3", filepath.Join(t.TempDir(), "acme-dns.db")); err != nil {
+		t.Fatalf("Could not open sqlite database: %v", err)
+	}
+	defer dst.Close()
+	res, err := importRecords(dst, strings.NewReader(exported), importFail)
+	if err != nil || res.Added != 2 {
+		t.Fatalf("Expected 2 added records, got %+v (%v)", res, err)
+	}
+	// Importing again does not change anything
+	res, err = importRecords(dst, strings.NewReader(exported), importFail)
+	if err != nil || res.Unchanged != 2 || res.Added+res.Updated+res.Skipped != 0 {
+		t.Errorf("Expected 2 unchanged records, got %+v (%v)", res, err)
+	}
+	user, err := dst.GetByUsername(reg.Username)
+	if err != nil {
+		t.Fatalf("Could not get the imported user, got error [%v]", err)
+	}
+	if !correctPassword(reg.Password, user.Password) {
+		t.Errorf("The password does not match the imported hash")
+	}
+	if txts, _ := dst.GetTXTForDomain(reg.Subdomain, ""); !stringInSlice("exported", txts) {
+		t.Errorf("Expected the imported TXT value, got %q", txts)
+	}
+
+	// A newer TXT value in the database is kept when importing an older backup
+	reg.Value = "newer"
+	_, _ = dst.Update(reg.ACMETxtPost)
+	if _, err = importRecords(dst, strings.NewReader(exported), importFail); err != nil {
+		t.Errorf("Import failed, got error [%v]", err)
+	}
+	if txts, _ := dst.GetTXTForDomain(reg.Subdomain, ""); !stringInSlice("newer", txts) {
+		t.Errorf("Expected the newer TXT value to be kept, got %q", txts)
+	}
+}
+
+func TestImportConflicts(t *testing.T) {
+	existing := dbRecord{Username: uuid.New().String(), Password: "hash", Subdomain: "sub", AllowFrom: []string{}}
+	changed := existing
+	changed.Password = "otherhash"
+	taken := dbRecord{Username: uuid.New().String(), Password: "hash2", Subdomain: "sub"}
+	doc := func(rec dbRecord) string {
+		var buf bytes.Buffer
+		d := newTestMemoryDB(t)
+		_ = d.PutRecord(rec)
+		_, _ = exportRecords(d, &buf)
+		return buf.String()
+	}
+
+	for i, test := range []struct {
+		record    dbRecord
+		mode      string
+		shouldErr bool
+		password  string
+	}{
+		{changed, importSkip, false, "hash"},
+		{changed, importFail, true, "hash"},
+		{changed, importOverwrite, false, "otherhash"},
+		{taken, importSkip, false, "hash"},
+		{taken, importFail, true, "hash"},
+		{taken, importOverwrite, true, "hash"},
+	} {
+		d := newTestMemoryDB(t)
+		_ = d.PutRecord(existing)
+		_, err := importRecords(d, strings.NewReader(doc(test.record)), test.mode)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: expected error, got none", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: expected no error, got [%v]", i, err)
+		}
+		user, _ := d.GetByUsername(uuid.MustParse(existing.Username))
+		if user.Password != test.password {
+			t.Errorf("Test %d: expected password %q, got %q", i, test.password, user.Password)
+		}
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	d := newTestMemoryDB(t)
+	for i, input := range []string{
+		"not json",
+		`{"version": 1000, "records": []}`,
+		`{"version": 1, "records": [{"username": "user"}]}`,
+	} {
+		if _, err := importRecords(d, strings.NewReader(input), importSkip); err == nil {
+			t.Errorf("Test %d: expected error, got none", i)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BoltVersion is the version of the on-disk format of the bolt database engine
+var BoltVersion = 1
+
+// Buckets of the bolt database
+var (
+	// meta holds the format version
+	boltMetaBucket = []byte("meta")
+	// records holds the accounts keyed by username
+	boltRecordsBucket = []byte("records")
+	// subdomains maps the subdomains to the usernames of the accounts owning them
+	boltSubdomainsBucket = []byte("subdomains")
+	// txt holds the TXT values keyed by subdomain
+	boltTXTBucket = []byte("txt")
+)
+
+var boltVersionKey = []byte("version")
+
+// boltdb is a database backend storing the data in a single file with the pure Go bbolt
+// key-value store, so acme-dns can be built without CGO
+type boltdb struct {
+	DB *bolt.DB
+}
+
+// boltAccount is the stored form of an account in the records bucket
+type boltAccount struct {
+	Password  string   `json:"password"`
+	Subdomain string   `json:"subdomain"`
+	AllowFrom []string `json:"allowfrom"`
+	Zone      string   `json:"zone,omitempty"`
+}
+
+func (d *boltdb) Init(engine string, connection string) error {
+	db, err := bolt.Open(connection, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltMetaBucket, boltRecordsBucket, boltSubdomainsBucket, boltTXTBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(boltMetaBucket)
+		v := meta.Get(boltVersionKey)
+		if v == nil {
+			return meta.Put(boltVersionKey, []byte(strconv.Itoa(BoltVersion)))
+		}
+		version, err := strconv.Atoi(string(v))
+		if err != nil {
+			return fmt.Errorf("invalid bolt database version %q", v)
+		}
+		if version > BoltVersion {
+			return fmt.Errorf("bolt database version %d is newer than the supported version %d", version, BoltVersion)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	d.DB = db
+	return nil
+}
+
+// InitReadOnly opens an existing bolt database for reading, without creating the buckets or
+// writing the version
+func (d *boltdb) InitReadOnly(engine string, connection string) error {
+	if _, err := os.Stat(connection); err != nil {
+		return err
+	}
+	db, err := bolt.Open(connection, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(boltMetaBucket)
+		if meta == nil || meta.Get(boltVersionKey) == nil {
+			return errors.New("not an acme-dns bolt database")
+		}
+		version, err := strconv.Atoi(string(meta.Get(boltVersionKey)))
+		if err != nil {
+			return fmt.Errorf("invalid bolt database version %q", meta.Get(boltVersionKey))
+		}
+		if version != BoltVersion {
+			return fmt.Errorf("bolt database version %d is not the supported version %d", version, BoltVersion)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	d.DB = db
+	return nil
+}
+
+func (d *boltdb) Register(afrom cidrslice, zone string) (ACMETxt, error) {
+	a := newACMETxt()
+	a.AllowFrom = cidrslice(afrom.ValidEntries())
+	a.Zone = zone
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(a.Password), 10)
+	if err != nil {
+		return a, err
+	}
+	err = d.DB.Update(func(tx *bolt.Tx) error {
+		return boltPutRecord(tx, dbRecord{
+			Username:  a.Username.String(),
+			Password:  string(passwordHash),
+			Subdomain: a.Subdomain,
+			AllowFrom: a.AllowFrom,
+			Zone:      a.Zone,
+		})
+	})
+	return a, err
+}
+
+func (d *boltdb) GetByUsername(u uuid.UUID) (ACMETxt, error) {
+	var txt ACMETxt
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltRecordsBucket).Get([]byte(u.String()))
+		if v == nil {
+			return errors.New("no user")
+		}
+		var acc boltAccount
+		if err := json.Unmarshal(v, &acc); err != nil {
+			return err
+		}
+		txt.Username = u
+		txt.Password = acc.Password
+		txt.Subdomain = acc.Subdomain
+		txt.AllowFrom = cidrslice(acc.AllowFrom)
+		txt.Zone = acc.Zone
+		return nil
+	})
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	return txt, nil
+}
+
+func (d *boltdb) GetTXTForDomain(domain string, zone string) ([]string, error) {
+	domain = sanitizeString(domain)
+	var txts []string
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		owner := tx.Bucket(boltSubdomainsBucket).Get([]byte(domain))
+		if owner == nil {
+			return nil
+		}
+		var acc boltAccount
+		if err := json.Unmarshal(tx.Bucket(boltRecordsBucket).Get(owner), &acc); err != nil {
+			return err
+		}
+		if acc.Zone != zone {
+			return nil
+		}
+		values, err := boltGetTXT(tx, domain)
+		for _, v := range values {
+			txts = append(txts, v.Value)
+		}
+		return err
+	})
+	return txts, err
+}
+
+func (d *boltdb) Update(a ACMETxtPost) (int64, error) {
+	timenow := time.Now().Unix()
+	return timenow, d.DB.Update(func(tx *bolt.Tx) error {
+		values, err := boltGetTXT(tx, a.Subdomain)
+		if err != nil || len(values) == 0 {
+			return err
+		}
+		// Replace the least recently updated value
+		oldest := 0
+		for i, v := range values {
+			if v.LastUpdate < values[oldest].LastUpdate {
+				oldest = i
+			}
+		}
+		values[oldest] = dbTXT{Value: a.Value, LastUpdate: timenow}
+		return boltPutTXT(tx, a.Subdomain, values)
+	})
+}
+
+// MergeTXT stores a TXT value with its update time, replacing the least recently updated value
+// of the subdomain, unless the value is older than both of the current values
+func (d *boltdb) MergeTXT(subdomain string, txt dbTXT) (bool, error) {
+	merged := false
+	err := d.DB.Update(func(tx *bolt.Tx) error {
+		values, err := boltGetTXT(tx, subdomain)
+		if err != nil {
+			return err
+		}
+		if len(values) == 0 {
+			return errUnknownSubdomain
+		}
+		i, ok := txtMergeSlot(values, txt)
+		if !ok {
+			return nil
+		}
+		values[i] = txt
+		merged = true
+		return boltPutTXT(tx, subdomain, values)
+	})
+	return merged, err
+}
+
+// GetRecords returns all the accounts with their TXT values
+func (d *boltdb) GetRecords() ([]dbRecord, error) {
+	var records []dbRecord
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRecordsBucket).ForEach(func(k, v []byte) error {
+			var acc boltAccount
+			if err := json.Unmarshal(v, &acc); err != nil {
+				return err
+			}
+			values, err := boltGetTXT(tx, acc.Subdomain)
+			if err != nil {
+				return err
+			}
+			rec := dbRecord{
+				Username:  string(k),
+				Password:  acc.Password,
+				Subdomain: acc.Subdomain,
+				AllowFrom: acc.AllowFrom,
+				Zone:      acc.Zone,
+				TXT:       values,
+			}
+			if rec.AllowFrom == nil {
+				rec.AllowFrom = []string{}
+			}
+			if rec.TXT == nil {
+				rec.TXT = []dbTXT{}
+			}
+			records = append(records, rec)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// PutRecord stores the account with its TXT values, replacing an existing account with the same username
+func (d *boltdb) PutRecord(rec dbRecord) error {
+	return d.DB.Update(func(tx *bolt.Tx) error {
+		return boltPutRecord(tx, rec)
+	})
+}
+
+func (d *boltdb) Close() {
+	d.DB.Close()
+}
+
+// GetBackend returns nil, as the bolt engine is not an SQL database
+func (d *boltdb) GetBackend() *sql.DB {
+	return nil
+}
+
+func (d *boltdb) SetBackend(backend *sql.DB) {}
+
+func boltGetTXT(tx *bolt.Tx, subdomain string) ([]dbTXT, error) {
+	var values []dbTXT
+	v := tx.Bucket(boltTXTBucket).Get([]byte(subdomain))
+	if v == nil {
+		return values, nil
+	}
+	err := json.Unmarshal(v, &values)
+	return values, err
+}
+
+func boltPutTXT(tx *bolt.Tx, subdomain string, values []dbTXT) error {
+	v, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltTXTBucket).Put([]byte(subdomain), v)
+}
+
+// boltPutRecord stores the account, replacing the subdomain and TXT values of an existing account
+// with the same username
+func boltPutRecord(tx *bolt.Tx, rec dbRecord) error {
+	records := tx.Bucket(boltRecordsBucket)
+	subdomains := tx.Bucket(boltSubdomainsBucket)
+	if owner := subdomains.Get([]byte(rec.Subdomain)); owner != nil && string(owner) != rec.Username {
+		return fmt.Errorf("subdomain %s is already registered", rec.Subdomain)
+	}
+	if v := records.Get([]byte(rec.Username)); v != nil {
+		var old boltAccount
+		if err := json.Unmarshal(v, &old); err != nil {
+			return err
+		}
+		if err := subdomains.Delete([]byte(old.Subdomain)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltTXTBucket).Delete([]byte(old.Subdomain)); err != nil {
+			return err
+		}
+	}
+	afrom := cidrslice(rec.AllowFrom)
+	acc, err := json.Marshal(boltAccount{
+		Password:  rec.Password,
+		Subdomain: rec.Subdomain,
+		AllowFrom: afrom.ValidEntries(),
+		Zone:      rec.Zone,
+	})
+	if err != nil {
+		return err
+	}
+	if err = records.Put([]byte(rec.Username), acc); err != nil {
+		return err
+	}
+	if err = subdomains.Put([]byte(rec.Subdomain), []byte(rec.Username)); err != nil {
+		return err
+	}
+	return boltPutTXT(tx, rec.Subdomain, recordTXTSlots(rec.TXT))
+}
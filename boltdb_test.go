@@ -0,0 +1,133 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestBoltDB(t *testing.T) *boltdb {
+	t.Helper()
+	d := new(boltdb)
+	if err := d.Init("bolt", filepath.Join(t.TempDir(), "acme-dns.db")); err != nil {
+		t.Fatalf("Could not open bolt database: %v", err)
+	}
+	t.Cleanup(d.Close)
+	return d
+}
+
+func TestBoltRegisterUpdate(t *testing.T) {
+	d := newTestBoltDB(t)
+	reg, err := d.Register(cidrslice{"10.0.0.0/8", "invalid"}, "")
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	user, err := d.GetByUsername(reg.Username)
+	if err != nil {
+		t.Fatalf("Could not get test user, got error [%v]", err)
+	}
+	if user.Subdomain != reg.Subdomain {
+		t.Errorf("GetByUsername subdomain [%q] did not match the original [%q]", user.Subdomain, reg.Subdomain)
+	}
+	if !correctPassword(reg.Password, user.Password) {
+		t.Errorf("The password [%s] does not match the hash [%s]", reg.Password, user.Password)
+	}
+	if len(user.AllowFrom) != 1 || user.AllowFrom[0] != "10.0.0.0/8" {
+		t.Errorf("Expected AllowFrom [10.0.0.0/8], got %v", user.AllowFrom)
+	}
+	if _, err = d.GetByUsername(uuid.New()); err == nil {
+		t.Errorf("Expected error for a nonexistent user, got none")
+	}
+
+	txts, _ := d.GetTXTForDomain(reg.Subdomain, "")
+	if len(txts) != 2 || txts[0] != "" || txts[1] != "" {
+		t.Errorf("Expected two empty TXT values for a new subdomain, got %q", txts)
+	}
+	for i, value := range []string{"first", "second", "third"} {
+		reg.Value = value
+		if _, err = d.Update(reg.ACMETxtPost); err != nil {
+			t.Errorf("Test %d: update failed, got error [%v]", i, err)
+		}
+	}
+	txts, err = d.GetTXTForDomain(reg.Subdomain, "")
+	if err != nil {
+		t.Errorf("Could not get TXT values, got error [%v]", err)
+	}
+	if len(txts) != 2 || !stringInSlice("third", txts) {
+		t.Errorf("Expected two TXT values including the latest, got %q", txts)
+	}
+	if txts, _ = d.GetTXTForDomain("does-not-exist", ""); len(txts) > 0 {
+		t.Errorf("No records should be returned.")
+	}
+	if txts, _ = d.GetTXTForDomain(reg.Subdomain, "auth.brand.com"); len(txts) > 0 {
+		t.Errorf("No records should be returned for another zone.")
+	}
+	// Updating a nonexistent subdomain is not an error, as with the SQL engines
+	if _, err = d.Update(ACMETxtPost{Subdomain: "does-not-exist", Value: "x"}); err != nil {
+		t.Errorf("Expected no error when updating a nonexistent subdomain, got [%v]", err)
+	}
+}
+
+func TestBoltPutRecord(t *testing.T) {
+	d := newTestBoltDB(t)
+	rec := dbRecord{
+		Username:  uuid.New().String(),
+		Password:  "hash",
+		Subdomain: "sub1",
+		AllowFrom: []string{"192.168.0.0/16"},
+		TXT:       []dbTXT{{"old", 1}, {"newer", 3}, {"new", 2}},
+	}
+	if err := d.PutRecord(rec); err != nil {
+		t.Fatalf("PutRecord failed, got error [%v]", err)
+	}
+	// Replacing the account moves it to the new subdomain
+	rec.Subdomain = "sub2"
+	if err := d.PutRecord(rec); err != nil {
+		t.Fatalf("PutRecord failed, got error [%v]", err)
+	}
+	if txts, _ := d.GetTXTForDomain("sub1", ""); len(txts) > 0 {
+		t.Errorf("Expected the TXT values of the old subdomain to be removed, got %q", txts)
+	}
+	records, err := d.GetRecords()
+	if err != nil {
+		t.Fatalf("GetRecords failed, got error [%v]", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("Expected one record, got %d", len(records))
+	}
+	got := records[0]
+	if got.Subdomain != "sub2" || got.Password != "hash" || len(got.AllowFrom) != 1 {
+		t.Errorf("Unexpected record %+v", got)
+	}
+	if len(got.TXT) != 2 || got.TXT[0].Value != "newer" || got.TXT[1].Value != "new" {
+		t.Errorf("Expected the two most recent TXT values, got %+v", got.TXT)
+	}
+
+	other := rec
+	other.Username = uuid.New().String()
+	if err := d.PutRecord(other); err == nil {
+		t.Errorf("Expected error when storing an account with a subdomain of another account, got none")
+	}
+}
+
+func TestBoltVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acme-dns.db")
+	d := new(boltdb)
+	if err := d.Init("bolt", path); err != nil {
+		t.Fatalf("Could not open bolt database: %v", err)
+	}
+	err := d.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMetaBucket).Put(boltVersionKey, []byte(strconv.Itoa(BoltVersion+1)))
+	})
+	if err != nil {
+		t.Fatalf("Could not set the version: %v", err)
+	}
+	d.Close()
+
+	if err = new(boltdb).Init("bolt", path); err == nil {
+		t.Errorf("Expected error when opening a database with a newer version, got none")
+	}
+}
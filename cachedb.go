@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+const (
+	// txtCacheDefaultSize is the default maximum number of subdomains held in the TXT cache
+	txtCacheDefaultSize = 100000
+	// txtCacheEvictSample is the number of entries looked at to choose the entry to evict
+	txtCacheEvictSample = 8
+)
+
+// txtCache wraps a database and keeps the TXT values of the subdomains in memory, so answering
+// to TXT questions does not need a database round-trip. Subdomains that do not exist are cached
+// as well. Entries are invalidated when updated through this instance, and expire after the TTL
+// to pick up changes made by other acme-dns instances sharing the database.
+type txtCache struct {
+	database
+	ttl     time.Duration
+	size    int
+	mu      sync.RWMutex
+	gen     uint64
+	entries map[string]txtCacheEntry
+	purged  time.Time
+}
+
+type txtCacheEntry struct {
+	zone    string
+	values  []string
+	expires time.Time
+}
+
+func newTXTCache(db database, ttl time.Duration, size int) *txtCache {
+	if size <= 0 {
+		size = txtCacheDefaultSize
+	}
+	return &txtCache{
+		database: db,
+		ttl:      ttl,
+		size:     size,
+		entries:  make(map[string]txtCacheEntry),
+	}
+}
+
+func (c *txtCache) GetTXTForDomain(domain string, zone string) ([]string, error) {
+	key := sanitizeString(domain)
+	now := time.Now()
+	c.mu.RLock()
+	entry, ok := c.entries[key]
+	gen := c.gen
+	c.mu.RUnlock()
+	if ok && entry.zone == zone && now.Before(entry.expires) {
+		return append([]string(nil), entry.values...), nil
+	}
+	values, err := c.database.GetTXTForDomain(domain, zone)
+	if err != nil {
+		return values, err
+	}
+	c.mu.Lock()
+	// Do not store values read before an invalidation that happened during the read
+	if gen == c.gen {
+		if _, cached := c.entries[key]; !cached && len(c.entries) >= c.size {
+			c.evict(now)
+		}
+		c.entries[key] = txtCacheEntry{zone: zone, values: append([]string(nil), values...), expires: now.Add(c.ttl)}
+	}
+	c.mu.Unlock()
+	return values, nil
+}
+
+func (c *txtCache) Register(afrom cidrslice, zone string) (ACMETxt, error) {
+	a, err := c.database.Register(afrom, zone)
+	if err == nil {
+		// Drop a possible negative entry of the new subdomain
+		c.Invalidate(a.Subdomain)
+	}
+	return a, err
+}
+
+func (c *txtCache) Update(a ACMETxtPost) (int64, error) {
+	timenow, err := c.database.Update(a)
+	c.Invalidate(a.Subdomain)
+	return timenow, err
+}
+
+func (c *txtCache) PutRecord(rec dbRecord) error {
+	err := c.database.PutRecord(rec)
+	c.Invalidate(rec.Subdomain)
+	return err
+}
+
+func (c *txtCache) MergeTXT(subdomain string, txt dbTXT) (bool, error) {
+	merged, err := c.database.MergeTXT(subdomain, txt)
+	c.Invalidate(subdomain)
+	return merged, err
+}
+
+func (c *txtCache) SetBackend(backend *sql.DB) {
+	c.database.SetBackend(backend)
+	c.Flush()
+}
+
+// Invalidate removes the cached TXT values of the subdomain
+func (c *txtCache) Invalidate(subdomain string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	delete(c.entries, sanitizeString(subdomain))
+}
+
+// Changed invalidates the subdomain reported by a change feed, or flushes the cache if the
+// subdomain is empty
+func (c *txtCache) Changed(subdomain string) {
+	if subdomain == "" {
+		c.Flush()
+		return
+	}
+	c.Invalidate(subdomain)
+}
+
+// Flush removes all the entries from the cache
+func (c *txtCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.entries = make(map[string]txtCacheEntry)
+}
+
+// evict makes room for a new entry in the full cache. The expired entries are removed, at most
+// once a second as it goes through all the entries, and if the cache is still full, an entry of
+// a random sample is evicted. Negative entries are evicted first, so a flood of lookups for
+// random names does not push out the TXT values. Caller must hold the write lock.
+func (c *txtCache) evict(now time.Time) {
+	if now.Sub(c.purged) >= time.Second {
+		c.purgeExpired(now)
+		c.purged = now
+	}
+	if len(c.entries) < c.size {
+		return
+	}
+	victim, sampled := "", 0
+	// The iteration order of a map is random
+	for k, v := range c.entries {
+		if v.negative() {
+			victim = k
+			break
+		}
+		if victim == "" {
+			victim = k
+		}
+		if sampled++; sampled >= txtCacheEvictSample {
+			break
+		}
+	}
+	delete(c.entries, victim)
+}
+
+// negative checks if the entry has no TXT values
+func (e txtCacheEntry) negative() bool {
+	for _, v := range e.values {
+		if v != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// purgeExpired removes the expired entries. Caller must hold the write lock.
+func (c *txtCache) purgeExpired(now time.Time) {
+	for k, v := range c.entries {
+		if !now.Before(v.expires) {
+			delete(c.entries, k)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/erikstmartin/go-testdb"
+)
+
+// countingDB counts the TXT lookups that reach the wrapped database
+type countingDB struct {
+	database
+	lookups int64
+}
+
+func (c *countingDB) GetTXTForDomain(domain string, zone string) ([]string, error) {
+	atomic.AddInt64(&c.lookups, 1)
+	return c.database.GetTXTForDomain(domain, zone)
+}
+
+func (c *countingDB) count() int64 {
+	return atomic.LoadInt64(&c.lookups)
+}
+
+func TestTXTCacheHit(t *testing.T) {
+	backend := &countingDB{database: DB}
+	cache := newTXTCache(backend, time.Minute, 0)
+	reg, err := cache.Register(cidrslice{}, "")
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	reg.Value = "__________________cached_value_____________"
+	if _, err := cache.Update(reg.ACMETxtPost); err != nil {
+		t.Fatalf("Update failed, got error [%v]", err)
+	}
+	for i := 0; i < 5; i++ {
+		values, err := cache.GetTXTForDomain(reg.Subdomain, "")
+		if err != nil {
+			t.Errorf("Got unexpected error [%v]", err)
+		}
+		if !stringInSlice(reg.Value, values) {
+			t.Errorf("Expected cached values to contain the updated value, got %v", values)
+		}
+	}
+	if backend.count() != 1 {
+		t.Errorf("Expected exactly one database lookup, got %d", backend.count())
+	}
+}
+
+func TestTXTCacheInvalidatedByUpdate(t *testing.T) {
+	backend := &countingDB{database: DB}
+	cache := newTXTCache(backend, time.Minute, 0)
+	reg, _ := cache.Register(cidrslice{}, "")
+	_, _ = cache.GetTXTForDomain(reg.Subdomain, "")
+	reg.Value = "__________________updated_value____________"
+	if _, err := cache.Update(reg.ACMETxtPost); err != nil {
+		t.Fatalf("Update failed, got error [%v]", err)
+	}
+	values, _ := cache.GetTXTForDomain(reg.Subdomain, "")
+	if !stringInSlice(reg.Value, values) {
+		t.Errorf("Expected the updated value to be visible immediately, got %v", values)
+	}
+	if backend.count() != 2 {
+		t.Errorf("Expected two database lookups, got %d", backend.count())
+	}
+}
+
+func TestTXTCacheNegative(t *testing.T) {
+	backend := &countingDB{database: DB}
+	cache := newTXTCache(backend, time.Minute, 0)
+	for i := 0; i < 3; i++ {
+		values, err := cache.GetTXTForDomain("does-not-exist", "")
+		if err != nil || len(values) != 0 {
+			t.Errorf("Expected no values and no error, got %v [%v]", values, err)
+		}
+	}
+	if backend.count() != 1 {
+		t.Errorf("Expected unknown subdomain to be cached, got %d database lookups", backend.count())
+	}
+}
+
+func TestTXTCacheExpiry(t *testing.T) {
+	backend := &countingDB{database: DB}
+	cache := newTXTCache(backend, 10*time.Millisecond, 0)
+	reg, _ := DB.Register(cidrslice{}, "")
+	_, _ = cache.GetTXTForDomain(reg.Subdomain, "")
+	// Update made by another instance sharing the database
+	reg.Value = "__________________other_node_value_________"
+	_, _ = DB.Update(reg.ACMETxtPost)
+	time.Sleep(20 * time.Millisecond)
+	values, _ := cache.GetTXTForDomain(reg.Subdomain, "")
+	if !stringInSlice(reg.Value, values) {
+		t.Errorf("Expected the expired entry to be refreshed, got %v", values)
+	}
+	if backend.count() != 2 {
+		t.Errorf("Expected two database lookups, got %d", backend.count())
+	}
+}
+
+func TestTXTCacheSizeLimit(t *testing.T) {
+	backend := &countingDB{database: DB}
+	cache := newTXTCache(backend, time.Minute, 2)
+	for _, d := range []string{"first", "second", "third", "third"} {
+		_, _ = cache.GetTXTForDomain(d, "")
+	}
+	if len(cache.entries) != 2 {
+		t.Errorf("Expected the cache to hold 2 entries, got %d", len(cache.entries))
+	}
+	if backend.count() != 3 {
+		t.Errorf("Expected an entry to be evicted for the new entry, got %d database lookups", backend.count())
+	}
+	cache.Flush()
+	if len(cache.entries) != 0 {
+		t.Errorf("Expected flush to empty the cache")
+	}
+}
+
+func TestTXTCacheEvictNegative(t *testing.T) {
+	backend := &countingDB{database: DB}
+	cache := newTXTCache(backend, time.Minute, 2)
+	reg, err := cache.Register(cidrslice{}, "")
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	reg.Value = "_________________evicted_last_value________"
+	if _, err := cache.Update(reg.ACMETxtPost); err != nil {
+		t.Fatalf("Update failed, got error [%v]", err)
+	}
+	// A cache full of negative entries still caches the TXT values
+	_, _ = cache.GetTXTForDomain("random-1", "")
+	_, _ = cache.GetTXTForDomain("random-2", "")
+	_, _ = cache.GetTXTForDomain(reg.Subdomain, "")
+	// and the negative entries are evicted before them
+	for _, d := range []string{"random-3", "random-4", "random-5"} {
+		_, _ = cache.GetTXTForDomain(d, "")
+	}
+	before := backend.count()
+	values, _ := cache.GetTXTForDomain(reg.Subdomain, "")
+	if !stringInSlice(reg.Value, values) || backend.count() != before {
+		t.Errorf("Expected the TXT values to stay cached, got %v with %d database lookups", values, backend.count()-before)
+	}
+}
+
+func TestTXTCacheErrorNotCached(t *testing.T) {
+	cache := newTXTCache(DB, time.Minute, 0)
+	reg, _ := cache.Register(cidrslice{}, "")
+	_, _ = cache.GetTXTForDomain(reg.Subdomain, "")
+	testdb.SetQueryWithArgsFunc(func(query string, args []driver.Value) (result driver.Rows, err error) {
+		return testdb.RowsFromSlice([]string{"Value"}, [][]driver.Value{}), errors.New("Prepared query error")
+	})
+	defer testdb.Reset()
+	tdb, err := sql.Open("testdb", "")
+	if err != nil {
+		t.Errorf("Got error: %v", err)
+	}
+	oldDb := DB.GetBackend()
+	cache.SetBackend(tdb)
+	if _, err := cache.GetTXTForDomain(reg.Subdomain, ""); err == nil {
+		t.Errorf("Expected the cache to be flushed when the backend changes")
+	}
+	cache.SetBackend(oldDb)
+	if _, ok := cache.entries[reg.Subdomain]; ok {
+		t.Errorf("Expected errors not to be cached")
+	}
+}
+
+func stringInSlice(s string, slice []string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
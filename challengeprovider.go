@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
+	"slices"
+	"strings"
+	"sync"
 
 	"github.com/mholt/acmez/v2/acme"
+	"github.com/miekg/dns"
 )
 
 // ChallengeProvider implements go-acme/lego Provider interface which is used for ACME DNS challenge handling
@@ -16,18 +20,19 @@ func NewChallengeProvider(servers []*DNSServer) ChallengeProvider {
 	return ChallengeProvider{servers: servers}
 }
 
-// Present is used for making the ACME DNS challenge token available for DNS
+// Present is used for making the ACME DNS challenge token available for DNS. The challenges of
+// the names of the certificate are answered side by side.
 func (c *ChallengeProvider) Present(ctx context.Context, challenge acme.Challenge) error {
 	for _, s := range c.servers {
-		s.PersonalKeyAuth = challenge.DNS01KeyAuthorization()
+		s.ownChallenges.Add(challenge.DNS01TXTRecordName(), challenge.DNS01KeyAuthorization())
 	}
 	return nil
 }
 
 // CleanUp is called after the run to remove the ACME DNS challenge tokens from DNS records
-func (c *ChallengeProvider) CleanUp(ctx context.Context, _ acme.Challenge) error {
+func (c *ChallengeProvider) CleanUp(ctx context.Context, challenge acme.Challenge) error {
 	for _, s := range c.servers {
-		s.PersonalKeyAuth = ""
+		s.ownChallenges.Remove(challenge.DNS01TXTRecordName(), challenge.DNS01KeyAuthorization())
 	}
 	return nil
 }
@@ -36,3 +41,61 @@ func (c *ChallengeProvider) CleanUp(ctx context.Context, _ acme.Challenge) error
 func (c *ChallengeProvider) Wait(_ context.Context, _ acme.Challenge) error {
 	return nil
 }
+
+// ownChallengeStore holds the key authorizations of the active ACME challenges of the API
+// certificate by the challenge name. A name can have several simultaneous values, like the
+// challenges of a name and of its wildcard, which share the challenge name.
+type ownChallengeStore struct {
+	mu     sync.RWMutex
+	values map[string][]string
+}
+
+func newOwnChallengeStore() *ownChallengeStore {
+	return &ownChallengeStore{values: make(map[string][]string)}
+}
+
+// ownChallengeName normalizes a challenge name to a lower case fully qualified name
+func ownChallengeName(name string) string {
+	return dns.Fqdn(strings.ToLower(name))
+}
+
+// Add adds a key authorization of a challenge name
+func (s *ownChallengeStore) Add(name string, keyAuth string) {
+	name = ownChallengeName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[name] = append(s.values[name], keyAuth)
+}
+
+// Remove removes a key authorization of a challenge name. A value added more than once is
+// removed once.
+func (s *ownChallengeStore) Remove(name string, keyAuth string) {
+	name = ownChallengeName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.Index(s.values[name], keyAuth)
+	if i < 0 {
+		return
+	}
+	if values := slices.Delete(s.values[name], i, i+1); len(values) > 0 {
+		s.values[name] = values
+	} else {
+		delete(s.values, name)
+	}
+}
+
+// Values returns the key authorizations of a challenge name
+func (s *ownChallengeStore) Values(name string) []string {
+	name = ownChallengeName(name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.values[name]...)
+}
+
+// Has checks if a challenge name has active challenges
+func (s *ownChallengeStore) Has(name string) bool {
+	name = ownChallengeName(name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.values[name]) > 0
+}
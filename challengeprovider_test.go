@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/mholt/acmez/v2/acme"
+	"github.com/miekg/dns"
+)
+
+func TestChallengeProviderNames(t *testing.T) {
+	config := multiZoneConfig()
+	config.Zones, _ = prepareZoneConfig(config.General, config.Zones)
+	server := NewDNSServer(DB, "", "udp", config.General.Domain)
+	server.ParseRecords(config)
+	provider := NewChallengeProvider([]*DNSServer{server})
+
+	query := func(name string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeTXT)
+		m.SetReply(m)
+		server.readQuery(m, "", false)
+		return m
+	}
+	challenge := func(name string, keyAuth string) acme.Challenge {
+		return acme.Challenge{Identifier: acme.Identifier{Type: "dns", Value: name}, KeyAuthorization: keyAuth}
+	}
+
+	// The challenges of the names of the certificate are answered side by side
+	challenges := []acme.Challenge{
+		challenge("auth.example.org", "first"),
+		challenge("acme.auth.example.org", "second"),
+		challenge("auth.brand.com", "third"),
+	}
+	for _, c := range challenges {
+		if err := provider.Present(context.Background(), c); err != nil {
+			t.Fatalf("Could not present the challenge: %v", err)
+		}
+	}
+	for i, c := range challenges {
+		m := query(dns.Fqdn(c.DNS01TXTRecordName()))
+		if len(m.Answer) != 1 || m.Answer[0].(*dns.TXT).Txt[0] != c.DNS01KeyAuthorization() || !m.Authoritative {
+			t.Errorf("Test %d: Expected the key authorization of %s, got %v", i, c.Identifier.Value, m.Answer)
+		}
+	}
+
+	// A cleaned up challenge is not answered, the others still are
+	if err := provider.CleanUp(context.Background(), challenges[1]); err != nil {
+		t.Fatalf("Could not clean up the challenge: %v", err)
+	}
+	if m := query("_acme-challenge.acme.auth.example.org."); len(m.Answer) != 0 {
+		t.Errorf("Expected no answer for the cleaned up challenge, got %v", m.Answer)
+	}
+	if m := query("_ACME-Challenge.Auth.Brand.com."); len(m.Answer) != 1 || m.Answer[0].(*dns.TXT).Txt[0] != challenges[2].DNS01KeyAuthorization() {
+		t.Errorf("Expected the key authorization of the remaining challenge, got %v", m.Answer)
+	}
+}
+
+func TestOwnChallengeStore(t *testing.T) {
+	store := newOwnChallengeStore()
+	store.Add("_acme-challenge.Auth.example.org", "first")
+	store.Add("_acme-challenge.auth.example.org.", "second")
+	store.Add("_acme-challenge.auth.example.org.", "second")
+	if values := store.Values("_ACME-challenge.auth.example.org."); !reflect.DeepEqual(values, []string{"first", "second", "second"}) {
+		t.Errorf("Expected all the values of the name, got %v", values)
+	}
+
+	// A value added twice is removed once
+	store.Remove("_acme-challenge.auth.example.org", "second")
+	store.Remove("_acme-challenge.auth.example.org", "nonexistent")
+	if values := store.Values("_acme-challenge.auth.example.org."); !reflect.DeepEqual(values, []string{"first", "second"}) {
+		t.Errorf("Expected the remaining values, got %v", values)
+	}
+	store.Remove("_acme-challenge.auth.example.org", "first")
+	store.Remove("_acme-challenge.auth.example.org", "second")
+	if store.Has("_acme-challenge.auth.example.org.") || len(store.Values("_acme-challenge.auth.example.org.")) != 0 {
+		t.Errorf("Expected no values after removing them all")
+	}
+}
+
+func TestChallengeProviderWildcard(t *testing.T) {
+	config := multiZoneConfig()
+	server := NewDNSServer(DB, "", "udp", config.General.Domain)
+	server.ParseRecords(config)
+	provider := NewChallengeProvider([]*DNSServer{server})
+
+	// The challenges of a name and of its wildcard share the challenge name, and are answered
+	// side by side
+	base := acme.Challenge{Identifier: acme.Identifier{Type: "dns", Value: "auth.example.org"}, KeyAuthorization: "base"}
+	wildcard := acme.Challenge{Identifier: acme.Identifier{Type: "dns", Value: "auth.example.org"}, KeyAuthorization: "wildcard"}
+	_ = provider.Present(context.Background(), base)
+	_ = provider.Present(context.Background(), wildcard)
+	txts := func() []string {
+		m := new(dns.Msg)
+		m.SetQuestion("_acme-challenge.auth.example.org.", dns.TypeTXT)
+		server.readQuery(m, "", false)
+		var values []string
+		for _, rr := range m.Answer {
+			values = append(values, rr.(*dns.TXT).Txt...)
+		}
+		return values
+	}
+	if values := txts(); !reflect.DeepEqual(values, []string{base.DNS01KeyAuthorization(), wildcard.DNS01KeyAuthorization()}) {
+		t.Errorf("Expected both key authorizations, got %v", values)
+	}
+	_ = provider.CleanUp(context.Background(), base)
+	if values := txts(); !reflect.DeepEqual(values, []string{wildcard.DNS01KeyAuthorization()}) {
+		t.Errorf("Expected the key authorization of the wildcard, got %v", values)
+	}
+	_ = provider.CleanUp(context.Background(), wildcard)
+	if values := txts(); len(values) != 0 {
+		t.Errorf("Expected no key authorizations, got %v", values)
+	}
+}
+
+// TestChallengeProviderConcurrent presents and cleans up challenges while they are queried, to be
+// run with the race detector
+func TestChallengeProviderConcurrent(t *testing.T) {
+	config := multiZoneConfig()
+	servers := []*DNSServer{
+		NewDNSServer(DB, "", "udp", config.General.Domain),
+		NewDNSServer(DB, "", "tcp", config.General.Domain),
+	}
+	for _, s := range servers {
+		s.ParseRecords(config)
+	}
+	provider := NewChallengeProvider(servers)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("name%d.auth.example.org", i%4)
+			for j := 0; j < 50; j++ {
+				c := acme.Challenge{Identifier: acme.Identifier{Type: "dns", Value: name}, KeyAuthorization: fmt.Sprintf("%d-%d", i, j)}
+				_ = provider.Present(context.Background(), c)
+				for _, s := range servers {
+					found := false
+					m := new(dns.Msg)
+					m.SetQuestion(dns.Fqdn(c.DNS01TXTRecordName()), dns.TypeTXT)
+					s.readQuery(m, "", false)
+					for _, rr := range m.Answer {
+						found = found || rr.(*dns.TXT).Txt[0] == c.DNS01KeyAuthorization()
+					}
+					if !found {
+						errs <- fmt.Errorf("key authorization %s of %s not answered", c.KeyAuthorization, name)
+						return
+					}
+				}
+				_ = provider.CleanUp(context.Background(), c)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	for _, s := range servers {
+		for i := 0; i < 4; i++ {
+			if name := fmt.Sprintf("_acme-challenge.name%d.auth.example.org.", i); s.ownChallenges.Has(name) {
+				t.Errorf("Expected the challenges of %s to be cleaned up", name)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// txtNotifyChannel is the PostgreSQL notification channel of the TXT changes
+const txtNotifyChannel = "acmedns_txt"
+
+// pollDefaultInterval is the default interval in seconds of polling the TXT changes
+const pollDefaultInterval = 1
+
+// changeFeed delivers the subdomains whose TXT values were changed in the database, also by the
+// other acme-dns instances sharing it. An empty subdomain means that changes may have been missed
+// and all the subdomains should be considered changed.
+type changeFeed interface {
+	Start(func(subdomain string)) error
+	Stop()
+}
+
+// ChangeFeed returns the change feed of the database: PostgreSQL notifications, or polling the
+// update times of the TXT values on the other engines. It returns nil if polling is disabled.
+func (d *acmedb) ChangeFeed(pollInterval int) changeFeed {
+	if d.dialect.NotifyTXT != "" {
+		return &pgChangeFeed{connection: d.connection, stop: make(chan struct{})}
+	}
+	if pollInterval <= 0 {
+		return nil
+	}
+	return &pollChangeFeed{db: d, interval: time.Duration(pollInterval) * time.Second, stop: make(chan struct{})}
+}
+
+// notifyTXT notifies the other instances of a TXT change of the subdomain
+func (d *acmedb) notifyTXT(subdomain string) {
+	if d.dialect.NotifyTXT == "" {
+		return
+	}
+	if _, err := d.DB.Exec(d.dialect.Rebind(d.dialect.NotifyTXT), subdomain); err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "subdomain": subdomain}).Warning("Could not send TXT change notification")
+	}
+}
+
+// pgChangeFeed listens to the notifications sent by notifyTXT
+type pgChangeFeed struct {
+	connection string
+	listener   *pq.Listener
+	stop       chan struct{}
+	wg         sync.WaitGroup
+}
+
+func (f *pgChangeFeed) Start(changed func(subdomain string)) error {
+	f.listener = pq.NewListener(f.connection, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warning("TXT change notification listener error")
+		}
+	})
+	if err := f.listener.Listen(txtNotifyChannel); err != nil {
+		f.listener.Close()
+		return err
+	}
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		for {
+			select {
+			case n := <-f.listener.Notify:
+				if n == nil {
+					// The connection was re-established, and notifications may have been lost
+					changed("")
+				} else {
+					changed(n.Extra)
+				}
+			case <-time.After(90 * time.Second):
+				go func() { _ = f.listener.Ping() }()
+			case <-f.stop:
+				return
+			}
+		}
+	}()
+	log.Info("Listening to TXT change notifications")
+	return nil
+}
+
+func (f *pgChangeFeed) Stop() {
+	close(f.stop)
+	f.wg.Wait()
+	f.listener.Close()
+}
+
+// pollChangeFeed polls the database for TXT values updated since the previous poll
+type pollChangeFeed struct {
+	db       *acmedb
+	interval time.Duration
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	// since is the latest update time seen, and seen holds the values updated during that second
+	// that were reported already
+	since int64
+	seen  map[string]bool
+}
+
+func (f *pollChangeFeed) Start(changed func(subdomain string)) error {
+	if err := f.db.DB.QueryRow("SELECT COALESCE(MAX(LastUpdate), 0) FROM txt").Scan(&f.since); err != nil {
+		return err
+	}
+	// Values updated during the current second before starting may be reported once
+	f.seen = make(map[string]bool)
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		ticker := time.NewTicker(f.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := f.poll(changed); err != nil {
+					log.WithFields(log.Fields{"error": err.Error()}).Warning("Could not poll the TXT changes")
+				}
+			case <-f.stop:
+				return
+			}
+		}
+	}()
+	log.WithFields(log.Fields{"interval": f.interval.String()}).Info("Polling TXT changes")
+	return nil
+}
+
+// poll reports the subdomains with values updated after the previous poll. The update times are
+// in seconds, so the values of the latest second are remembered to not report them again.
+func (f *pollChangeFeed) poll(changed func(subdomain string)) error {
+	rows, err := f.db.DB.Query(f.db.dialect.Rebind("SELECT Subdomain, Value, LastUpdate FROM txt WHERE LastUpdate >= $1 AND LastUpdate > 0"), f.since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	since, seen := f.since, make(map[string]bool)
+	for k := range f.seen {
+		seen[k] = true
+	}
+	for rows.Next() {
+		var subdomain, value string
+		var lastUpdate int64
+		if err = rows.Scan(&subdomain, &value, &lastUpdate); err != nil {
+			return err
+		}
+		key := subdomain + "\x00" + value
+		if lastUpdate == f.since && f.seen[key] {
+			continue
+		}
+		if lastUpdate > since {
+			since, seen = lastUpdate, make(map[string]bool)
+		}
+		if lastUpdate == since {
+			seen[key] = true
+		}
+		changed(subdomain)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	f.since, f.seen = since, seen
+	return nil
+}
+
+func (f *pollChangeFeed) Stop() {
+	close(f.stop)
+	f.wg.Wait()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newChangeFeedDBs opens two handles to the same SQLite database, as two acme-dns instances would
+func newChangeFeedDBs(t *testing.T) (*acmedb, *acmedb) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "acme-dns.db")
+	writer, reader := new(acmedb), new(acmedb)
+	if err := writer.Init("sqlite3", path); err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	t.Cleanup(writer.Close)
+	if err := reader.Init("sqlite3", path); err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	t.Cleanup(reader.Close)
+	return writer, reader
+}
+
+func TestPollChangeFeed(t *testing.T) {
+	writer, reader := newChangeFeedDBs(t)
+	reg, err := writer.Register(cidrslice{}, "")
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	var mu sync.Mutex
+	var changed []string
+	feed := &pollChangeFeed{db: reader, seen: make(map[string]bool)}
+	report := func(subdomain string) {
+		mu.Lock()
+		defer mu.Unlock()
+		changed = append(changed, subdomain)
+	}
+
+	// Registrations are not changes
+	if err = feed.poll(report); err != nil || len(changed) != 0 {
+		t.Errorf("Expected no changes, got %q (%v)", changed, err)
+	}
+	reg.Value = "___________________________changed_value"
+	_, _ = writer.Update(reg.ACMETxtPost)
+	if err = feed.poll(report); err != nil || len(changed) != 1 || changed[0] != reg.Subdomain {
+		t.Errorf("Expected the updated subdomain, got %q (%v)", changed, err)
+	}
+	// The change is reported once, although the next poll is during the same second
+	if err = feed.poll(report); err != nil || len(changed) != 1 {
+		t.Errorf("Expected no new changes, got %q (%v)", changed, err)
+	}
+	reg.Value = "____________________________second_value"
+	_, _ = writer.Update(reg.ACMETxtPost)
+	if err = feed.poll(report); err != nil || len(changed) != 2 {
+		t.Errorf("Expected the second update to be reported, got %q (%v)", changed, err)
+	}
+}
+
+func TestChangeFeedInvalidatesCache(t *testing.T) {
+	writer, reader := newChangeFeedDBs(t)
+	reg, err := writer.Register(cidrslice{}, "")
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	cache := newTXTCache(reader, time.Hour, 0)
+	if txts, _ := cache.GetTXTForDomain(reg.Subdomain, ""); len(txts) != 2 {
+		t.Fatalf("Expected two TXT values, got %q", txts)
+	}
+	feed := &pollChangeFeed{db: reader, interval: 20 * time.Millisecond, stop: make(chan struct{})}
+	if err = feed.Start(cache.Changed); err != nil {
+		t.Fatalf("Could not start the change feed: %v", err)
+	}
+	defer feed.Stop()
+
+	reg.Value = "_____________________value_from_elsewhere"
+	if _, err = writer.Update(reg.ACMETxtPost); err != nil {
+		t.Fatalf("Update failed, got error [%v]", err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		txts, _ := cache.GetTXTForDomain(reg.Subdomain, "")
+		if stringInSlice(reg.Value, txts) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The cache was not invalidated by the change feed, got %q", txts)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestPostgresChangeFeed(t *testing.T) {
+	if !*postgres {
+		t.Skip("PostgreSQL integration tests are run with -postgres")
+	}
+	sqlDB := DB.(*acmedb)
+	feed := sqlDB.ChangeFeed(0)
+	notified := make(chan string, 10)
+	if err := feed.Start(func(subdomain string) { notified <- subdomain }); err != nil {
+		t.Fatalf("Could not start the change feed: %v", err)
+	}
+	defer feed.Stop()
+	reg, err := DB.Register(cidrslice{}, "")
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	reg.Value = "____________________________notify_value"
+	_, _ = DB.Update(reg.ACMETxtPost)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case subdomain := <-notified:
+			if subdomain == reg.Subdomain {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("No notification received for the update")
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// clusterPath is the API endpoint the peers post the replicated changes to
+const clusterPath = "/cluster/replicate"
+
+// Cluster message types
+const (
+	clusterMessageRegister = "register"
+	clusterMessageUpdate   = "update"
+)
+
+const (
+	// clusterMaxSkew is the maximum difference of the message timestamp and the local clock
+	clusterMaxSkew     = 5 * time.Minute
+	clusterMaxBodySize = 1 << 20
+)
+
+// clusterSeen keeps the IDs of the applied messages for the time their signature is valid, so a
+// replayed message is not applied again
+var clusterSeen = &seenMessages{ids: make(map[string]time.Time)}
+
+// seenMessages is a set of message IDs, each expiring after twice the maximum clock skew
+type seenMessages struct {
+	mu     sync.Mutex
+	ids    map[string]time.Time
+	purged time.Time
+}
+
+// Seen checks if the message has been applied already
+func (s *seenMessages) Seen(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.ids[id]
+	return ok
+}
+
+// Add records an applied message, and removes the expired IDs once a minute
+func (s *seenMessages) Add(id string) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ids[id] = now
+	if now.Sub(s.purged) < time.Minute {
+		return
+	}
+	s.purged = now
+	for k, added := range s.ids {
+		if now.Sub(added) > 2*clusterMaxSkew {
+			delete(s.ids, k)
+		}
+	}
+}
+
+// ClusterMessage is a change replicated to the peers
+type ClusterMessage struct {
+	ID        string    `json:"id"`
+	Node      string    `json:"node"`
+	Type      string    `json:"type"`
+	Record    *dbRecord `json:"record,omitempty"`
+	Subdomain string    `json:"subdomain,omitempty"`
+	TXT       *dbTXT    `json:"txt,omitempty"`
+}
+
+// clusterNode replicates the registrations and TXT updates of this node to the peers, each with
+// a delivery queue of its own
+type clusterNode struct {
+	config clustersettings
+	peers  []*deliveryQueue
+}
+
+// newClusterNode creates the replication state for the cluster configuration, or returns nil
+// if no peers are configured. The replication workers are not running before Start is called.
+func newClusterNode(config clustersettings) *clusterNode {
+	if len(config.Peers) == 0 {
+		return nil
+	}
+	node := &clusterNode{config: config}
+	for _, p := range config.Peers {
+		url := strings.TrimSuffix(p, "/") + clusterPath
+		peer := newDeliveryQueue(url, config.Timeout, config.MaxRetries, config.QueueSize, log.Fields{"peer": url})
+		peer.sign = func(req *http.Request, payload []byte) {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			req.Header.Set("X-Acme-Dns-Node", config.NodeID)
+			req.Header.Set("X-Acme-Dns-Timestamp", timestamp)
+			req.Header.Set("X-Acme-Dns-Signature", "sha256="+signClusterMessage(config.Secret, timestamp, payload))
+		}
+		node.peers = append(node.peers, peer)
+	}
+	return node
+}
+
+// Start starts the replication worker for every peer
+func (c *clusterNode) Start() {
+	if c == nil {
+		return
+	}
+	for _, p := range c.peers {
+		p.Start()
+	}
+}
+
+// Stop closes the replication queues and waits for the workers to finish with the queued messages
+// until the context is done. The messages not delivered by then are dropped.
+func (c *clusterNode) Stop(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	stopQueues(ctx, c.peers)
+}
+
+// Replicate queues the message for all the peers. It returns a channel per peer receiving the
+// delivery result. It never blocks: if the queue of a peer is full or stopped, the message is
+// dropped and the failure is sent to the channel of the peer.
+func (c *clusterNode) Replicate(msg ClusterMessage) []chan error {
+	if c == nil {
+		return nil
+	}
+	msg.ID = uuid.New().String()
+	msg.Node = c.config.NodeID
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Could not marshal cluster message")
+		return nil
+	}
+	results := make([]chan error, len(c.peers))
+	for i, p := range c.peers {
+		results[i] = make(chan error, 1)
+		err := p.Enqueue(delivery{payload: payload, fields: log.Fields{"type": msg.Type}, done: results[i]})
+		if errors.Is(err, errDeliveryQueueFull) {
+			log.WithFields(log.Fields{"peer": p.url, "type": msg.Type}).Warning("Cluster replication queue full, dropping message")
+		}
+		if err != nil {
+			results[i] <- err
+		}
+	}
+	return results
+}
+
+// waitQuorum waits until quorum peers have received the message, all the deliveries have
+// finished, or the timeout is reached. It returns the number of peers that received the message.
+func waitQuorum(results []chan error, quorum int, timeout time.Duration) int {
+	acked := 0
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	agg := make(chan error, len(results))
+	for _, r := range results {
+		go func(r chan error) {
+			agg <- <-r
+		}(r)
+	}
+	for pending := len(results); pending > 0 && acked < quorum; pending-- {
+		select {
+		case err := <-agg:
+			if err == nil {
+				acked++
+			}
+		case <-timer.C:
+			return acked
+		}
+	}
+	return acked
+}
+
+// signClusterMessage returns the hex encoded HMAC-SHA256 of the timestamp and the payload
+func signClusterMessage(secret string, timestamp string, payload []byte) string {
+	return signPayload(secret, append([]byte(timestamp+"."), payload...))
+}
+
+// verifyClusterRequest checks the signature and the timestamp of a replication request
+func verifyClusterRequest(r *http.Request, payload []byte) bool {
+	timestamp := r.Header.Get("X-Acme-Dns-Timestamp")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > clusterMaxSkew || skew < -clusterMaxSkew {
+		return false
+	}
+	signature := strings.TrimPrefix(r.Header.Get("X-Acme-Dns-Signature"), "sha256=")
+	expected := signClusterMessage(Config.Cluster.Secret, timestamp, payload)
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
+
+// webClusterReplicate receives the changes replicated by the peers
+func webClusterReplicate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	status := http.StatusOK
+	resp := []byte("{\"status\": \"ok\"}")
+	payload, err := io.ReadAll(io.LimitReader(r.Body, clusterMaxBodySize))
+	var msg ClusterMessage
+	if err != nil || !verifyClusterRequest(r, payload) {
+		log.WithFields(log.Fields{"node": r.Header.Get("X-Acme-Dns-Node")}).Warning("Rejected cluster message with an invalid signature")
+		status = http.StatusUnauthorized
+		resp = jsonError("forbidden")
+	} else if err = json.Unmarshal(payload, &msg); err != nil {
+		status = http.StatusBadRequest
+		resp = jsonError("malformed_json_payload")
+	} else if msg.Node == Config.Cluster.NodeID {
+		status = http.StatusBadRequest
+		resp = jsonError("own_message")
+	} else if msg.ID == "" {
+		status = http.StatusBadRequest
+		resp = jsonError("bad_message")
+	} else if clusterSeen.Seen(msg.ID) {
+		// A retry of a delivery whose response got lost, or a replayed request
+		log.WithFields(log.Fields{"id": msg.ID, "node": msg.Node}).Debug("Ignored cluster message applied already")
+	} else if status, err = applyClusterMessage(msg); err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "node": msg.Node, "type": msg.Type}).Warning("Could not apply cluster message")
+		resp = jsonError(err.Error())
+	} else {
+		clusterSeen.Add(msg.ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(resp)
+}
+
+// applyClusterMessage applies a replicated change to the database. Registrations that exist
+// already are ignored, and TXT values are merged keeping the most recently updated values, so
+// the messages can be applied in any order and more than once.
+func applyClusterMessage(msg ClusterMessage) (int, error) {
+	switch msg.Type {
+	case clusterMessageRegister:
+		rec := msg.Record
+		if rec == nil || rec.Password == "" || !validSubdomain(rec.Subdomain) {
+			return http.StatusBadRequest, errors.New("bad_message")
+		}
+		if _, ok := zoneKey(Config, rec.Zone); !ok {
+			return http.StatusBadRequest, errors.New("unknown_zone")
+		}
+		username, err := uuid.Parse(rec.Username)
+		if err != nil {
+			return http.StatusBadRequest, errors.New("bad_message")
+		}
+		if existing, err := DB.GetByUsername(username); err == nil {
+			if existing.Subdomain != rec.Subdomain || existing.Zone != rec.Zone {
+				return http.StatusConflict, errors.New("conflict")
+			}
+			return http.StatusOK, nil
+		}
+		if err = DB.PutRecord(*rec); err != nil {
+			return http.StatusInternalServerError, errors.New("db_error")
+		}
+		log.WithFields(log.Fields{"user": rec.Username, "node": msg.Node}).Debug("Replicated registration")
+	case clusterMessageUpdate:
+		if msg.TXT == nil || !validSubdomain(msg.Subdomain) || !validTXT(msg.TXT.Value) {
+			return http.StatusBadRequest, errors.New("bad_message")
+		}
+		merged, err := DB.MergeTXT(msg.Subdomain, *msg.TXT)
+		if errors.Is(err, errUnknownSubdomain) {
+			// The registration may be on its way from another node, so the sender retries
+			return http.StatusServiceUnavailable, errors.New("unknown_subdomain")
+		} else if err != nil {
+			return http.StatusInternalServerError, errors.New("db_error")
+		}
+		log.WithFields(log.Fields{"subdomain": msg.Subdomain, "txt": msg.TXT.Value, "merged": merged, "node": msg.Node}).Debug("Replicated TXT update")
+	default:
+		return http.StatusBadRequest, errors.New("bad_message")
+	}
+	return http.StatusOK, nil
+}
+
+// prepareClusterConfig validates the cluster configuration and sets the default values
+func prepareClusterConfig(c clustersettings) (clustersettings, error) {
+	if len(c.Peers) == 0 {
+		return c, nil
+	}
+	if c.Secret == "" {
+		return c, errors.New("missing cluster configuration option \"secret\"")
+	}
+	if c.Quorum > len(c.Peers) {
+		return c, fmt.Errorf("cluster quorum %d is larger than the number of peers", c.Quorum)
+	}
+	if c.NodeID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return c, fmt.Errorf("missing cluster configuration option \"node_id\": %v", err)
+		}
+		c.NodeID = hostname
+	}
+	prepareDeliveryConfig(&c.Timeout, &c.MaxRetries, &c.QueueSize)
+	return c, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// setupClusterPeer starts a peer receiving the replicated messages to the global DB
+func setupClusterPeer(t *testing.T) *httptest.Server {
+	t.Helper()
+	oldCluster := Config.Cluster
+	t.Cleanup(func() { Config.Cluster = oldCluster })
+	Config.Cluster = clustersettings{NodeID: "peer", Secret: "clustersecret"}
+	api := httprouter.New()
+	api.POST(clusterPath, webClusterReplicate)
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestClusterNode(peers ...string) *clusterNode {
+	node := newClusterNode(clustersettings{NodeID: "origin", Secret: "clustersecret", Peers: peers, Timeout: 1, QueueSize: 8})
+	node.Start()
+	return node
+}
+
+func TestClusterReplication(t *testing.T) {
+	peer := setupClusterPeer(t)
+	node := newTestClusterNode(peer.URL)
+	defer node.Stop(context.Background())
+
+	rec := dbRecord{Username: uuid.New().String(), Password: "hash", Subdomain: uuid.New().String(), AllowFrom: []string{"10.0.0.0/8"}}
+	results := node.Replicate(ClusterMessage{Type: clusterMessageRegister, Record: &rec})
+	if n := waitQuorum(results, 1, 5*time.Second); n != 1 {
+		t.Fatalf("Expected the registration to be replicated to 1 peer, got %d", n)
+	}
+	user, err := DB.GetByUsername(uuid.MustParse(rec.Username))
+	if err != nil {
+		t.Fatalf("Replicated user not found, got error [%v]", err)
+	}
+	if user.Subdomain != rec.Subdomain || user.Password != "hash" || len(user.AllowFrom) != 1 {
+		t.Errorf("Unexpected replicated user %+v", user)
+	}
+	// Replicating the same registration again is fine
+	results = node.Replicate(ClusterMessage{Type: clusterMessageRegister, Record: &rec})
+	if n := waitQuorum(results, 1, 5*time.Second); n != 1 {
+		t.Errorf("Expected the repeated registration to be accepted, got %d", n)
+	}
+
+	now := time.Now().Unix()
+	newest := "_______________________________newest_value"
+	older := "________________________________older_value"
+	oldest := "_______________________________oldest_value"
+	for _, txt := range []dbTXT{{newest, now}, {older, now - 10}, {oldest, now - 20}} {
+		results = node.Replicate(ClusterMessage{Type: clusterMessageUpdate, Subdomain: rec.Subdomain, TXT: &txt})
+		if n := waitQuorum(results, 1, 5*time.Second); n != 1 {
+			t.Errorf("Expected the update to be replicated to 1 peer, got %d", n)
+		}
+	}
+	// The oldest value arrived last, but is older than both of the stored values
+	txts, _ := DB.GetTXTForDomain(rec.Subdomain, "")
+	if !stringInSlice(newest, txts) || !stringInSlice(older, txts) || stringInSlice(oldest, txts) {
+		t.Errorf("Expected the two most recent values, got %q", txts)
+	}
+	// An update for a subdomain the peer does not know is not acknowledged
+	results = node.Replicate(ClusterMessage{Type: clusterMessageUpdate, Subdomain: uuid.New().String(), TXT: &dbTXT{newest, now}})
+	if n := waitQuorum(results, 1, 5*time.Second); n != 0 {
+		t.Errorf("Expected the update of an unknown subdomain to fail, got %d", n)
+	}
+}
+
+func TestClusterAuthentication(t *testing.T) {
+	peer := setupClusterPeer(t)
+	payload := []byte(`{"id": "auth-test", "node": "origin", "type": "update", "subdomain": "x", "txt": {"value": "______________________________________value", "lastupdate": 1}}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	for i, test := range []struct {
+		timestamp string
+		signature string
+		payload   []byte
+		status    int
+	}{
+		{now, signClusterMessage("wrongsecret", now, payload), payload, http.StatusUnauthorized},
+		{stale, signClusterMessage("clustersecret", stale, payload), payload, http.StatusUnauthorized},
+		{"", signClusterMessage("clustersecret", "", payload), payload, http.StatusUnauthorized},
+		{now, signClusterMessage("clustersecret", now, []byte("not json")), []byte("not json"), http.StatusBadRequest},
+		{now, signClusterMessage("clustersecret", now, []byte(`{"node": "peer"}`)), []byte(`{"node": "peer"}`), http.StatusBadRequest},
+		{now, signClusterMessage("clustersecret", now, []byte(`{"node": "origin", "type": "delete"}`)), []byte(`{"node": "origin", "type": "delete"}`), http.StatusBadRequest},
+		// Authenticated, but the subdomain is not known here
+		{now, signClusterMessage("clustersecret", now, payload), payload, http.StatusServiceUnavailable},
+	} {
+		req, _ := http.NewRequest("POST", peer.URL+clusterPath, bytes.NewReader(test.payload))
+		req.Header.Set("X-Acme-Dns-Timestamp", test.timestamp)
+		req.Header.Set("X-Acme-Dns-Signature", "sha256="+test.signature)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Test %d: request failed: %v", i, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("Test %d: expected status %d, got %d", i, test.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestClusterReplay(t *testing.T) {
+	peer := setupClusterPeer(t)
+	reg, err := DB.Register(cidrslice{}, "")
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	payload := []byte(`{"id": "` + uuid.New().String() + `", "node": "origin", "type": "update", "subdomain": "` + reg.Subdomain + `", "txt": {"value": "_____________________________replayed_value", "lastupdate": 1}}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := signClusterMessage("clustersecret", now, payload)
+	level := log.GetLevel()
+	defer log.SetLevel(level)
+	log.SetLevel(log.DebugLevel)
+	loghook.Reset()
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", peer.URL+clusterPath, bytes.NewReader(payload))
+		req.Header.Set("X-Acme-Dns-Timestamp", now)
+		req.Header.Set("X-Acme-Dns-Signature", "sha256="+signature)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		resp.Body.Close()
+		// The replayed request is acknowledged, so a retried delivery is not retried again
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Request %d: expected status %d, got %d", i, http.StatusOK, resp.StatusCode)
+		}
+	}
+	if !loggerHasEntryWithMessage("Ignored cluster message applied already") {
+		t.Errorf("Expected the replayed message not to be applied again")
+	}
+}
+
+func TestClusterQuorum(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer failing.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer slow.Close()
+	node := newTestClusterNode(failing.URL, slow.URL)
+	defer node.Stop(context.Background())
+
+	txt := dbTXT{Value: "value", LastUpdate: 1}
+	msg := ClusterMessage{Type: clusterMessageUpdate, Subdomain: "x", TXT: &txt}
+	if n := waitQuorum(node.Replicate(msg), 1, 5*time.Second); n != 1 {
+		t.Errorf("Expected 1 peer to receive the message, got %d", n)
+	}
+	if n := waitQuorum(node.Replicate(msg), 2, 5*time.Second); n != 1 {
+		t.Errorf("Expected 1 peer to receive the message, got %d", n)
+	}
+	if n := waitQuorum(node.Replicate(msg), 1, 100*time.Millisecond); n != 0 {
+		t.Errorf("Expected the wait to time out, got %d", n)
+	}
+}
+
+func TestApiUpdateQuorum(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	peer := setupClusterPeer(t)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer failing.Close()
+	defer func() { Cluster = nil }()
+
+	newUser, err := DB.Register(cidrslice{}, "")
+	if err != nil {
+		t.Errorf("Could not create new user, got error [%v]", err)
+	}
+	updateJSON := map[string]interface{}{
+		"subdomain": newUser.Subdomain,
+		"txt":       "______________replicate_this_value_________"}
+
+	for i, test := range []struct {
+		peer       string
+		replicated int
+		reached    bool
+	}{
+		{peer.URL, 1, true},
+		{failing.URL, 0, false},
+	} {
+		Cluster = newTestClusterNode(test.peer)
+		Config.Cluster.Quorum = 1
+		Config.Cluster.Timeout = 5
+		e.POST("/update").
+			WithJSON(updateJSON).
+			WithHeader("X-Api-User", newUser.Username.String()).
+			WithHeader("X-Api-Key", newUser.Password).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("replicated", test.replicated).
+			ValueEqual("quorum_reached", test.reached)
+		Cluster.Stop(context.Background())
+		if t.Failed() {
+			t.Errorf("Test %d failed", i)
+		}
+	}
+}
+
+func TestMergeTXT(t *testing.T) {
+	sqlite := new(acmedb)
+	if err := sqlite.Init("sqlite3", filepath.Join(t.TempDir(), "acme-dns.db")); err != nil {
+		t.Fatalf("Could not open sqlite database: %v", err)
+	}
+	defer sqlite.Close()
+	for _, d := range []database{sqlite, newTestMemoryDB(t), newTestBoltDB(t)} {
+		reg, err := d.Register(cidrslice{}, "")
+		if err != nil {
+			t.Fatalf("Registration failed, got error [%v]", err)
+		}
+		for i, test := range []struct {
+			txt    dbTXT
+			merged bool
+		}{
+			{dbTXT{"first", 100}, true},
+			{dbTXT{"second", 200}, true},
+			{dbTXT{"second", 200}, false},
+			{dbTXT{"old", 50}, false},
+			{dbTXT{"third", 300}, true},
+		} {
+			merged, err := d.MergeTXT(reg.Subdomain, test.txt)
+			if err != nil || merged != test.merged {
+				t.Errorf("%T test %d: expected merged %t, got %t (%v)", d, i, test.merged, merged, err)
+			}
+		}
+		txts, _ := d.GetTXTForDomain(reg.Subdomain, "")
+		if len(txts) != 2 || !stringInSlice("second", txts) || !stringInSlice("third", txts) {
+			t.Errorf("%T: expected the two most recent values, got %q", d, txts)
+		}
+		if merged, err := d.MergeTXT("does-not-exist", dbTXT{"x", 1}); merged || !errors.Is(err, errUnknownSubdomain) {
+			t.Errorf("%T: expected an unknown subdomain error for a nonexistent subdomain, got %t (%v)", d, merged, err)
+		}
+	}
+}
+
+func TestPrepareClusterConfig(t *testing.T) {
+	for i, test := range []struct {
+		input       clustersettings
+		shoulderror bool
+	}{
+		{clustersettings{}, false},
+		{clustersettings{Peers: []string{"https://peer"}, Secret: "secret"}, false},
+		{clustersettings{Peers: []string{"https://peer"}}, true},
+		{clustersettings{Peers: []string{"https://peer"}, Secret: "secret", Quorum: 2}, true},
+	} {
+		c, err := prepareClusterConfig(test.input)
+		if test.shoulderror != (err != nil) {
+			t.Errorf("Test %d: expected error %t, got [%v]", i, test.shoulderror, err)
+		}
+		if err == nil && len(c.Peers) > 0 && (c.NodeID == "" || c.Timeout == 0 || c.QueueSize == 0) {
+			t.Errorf("Test %d: expected default values to be set, got %+v", i, c)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runCommand runs the acme-dns subcommand given on the command line after the flags
+func runCommand(args []string) error {
+	switch args[0] {
+	case "convert":
+		return runConvert(args[1:])
+	case "migrate":
+		return runMigrate(args[1:])
+	case "export":
+		return runExport(args[1:])
+	case "import":
+		return runImport(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// runMigrate shows the schema version of the configured database or applies the pending migrations
+func runMigrate(args []string) error {
+	if len(args) != 1 || (args[0] != "status" && args[0] != "up") {
+		return errors.New("usage: migrate status|up")
+	}
+	if _, ok := dialects[Config.Database.Engine]; !ok {
+		return fmt.Errorf("database engine %s does not use migrations", Config.Database.Engine)
+	}
+	d := new(acmedb)
+	if err := d.open(Config.Database.Engine, Config.Database.Connection); err != nil {
+		return err
+	}
+	defer d.Close()
+	if args[0] == "up" {
+		n, err := d.Migrate()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied %d migrations\n", n)
+	}
+	version, err := d.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Database version: %d\nLatest version: %d\n", version, latestVersion(d.dialect.Migrations))
+	for _, m := range d.dialect.Migrations {
+		state := "pending"
+		if m.Version <= version {
+			state = "applied"
+		}
+		fmt.Printf("%4d  %-8s %s\n", m.Version, state, m.Description)
+	}
+	return checkSchemaVersion(version, latestVersion(d.dialect.Migrations))
+}
+
+// runConvert copies all the accounts and TXT values from another database to the configured one.
+// Accounts that already exist in the configured database are replaced, so the conversion can be
+// run again if it was interrupted.
+func runConvert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	fromEngine := fs.String("from-engine", "", "database engine to convert from: sqlite3, postgres, mysql or bolt")
+	fromConnection := fs.String("from-connection", "", "connection string of the database to convert from")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *fromEngine == "" || *fromConnection == "" {
+		return errors.New("convert requires -from-engine and -from-connection")
+	}
+	if *fromEngine == Config.Database.Engine && *fromConnection == Config.Database.Connection {
+		return errors.New("the source database is the configured database")
+	}
+
+	src, err := openSourceDatabase(*fromEngine, *fromConnection)
+	if err != nil {
+		return fmt.Errorf("could not open the source database: %v", err)
+	}
+	defer src.Close()
+	dst, err := openConfiguredDatabase()
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	n, err := convertDatabase(src, dst)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"records": n, "engine": Config.Database.Engine}).Info("Converted database")
+	return nil
+}
+
+// runExport writes all the accounts and TXT values of the configured database as JSON to a file,
+// or to the standard output
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := fs.String("o", "", "file to write the export to, standard output by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	db, err := openConfiguredDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	w := os.Stdout
+	if *output != "" {
+		w, err = os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	n, err := exportRecords(db, w)
+	if *output != "" {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"records": n}).Info("Exported database")
+	return nil
+}
+
+// runImport reads an export from a file, or from the standard input, to the configured database
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	conflict := fs.String("conflict", importSkip, "handling of accounts that differ from the existing ones: skip, overwrite or fail")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *conflict != importSkip && *conflict != importOverwrite && *conflict != importFail {
+		return fmt.Errorf("invalid conflict mode %q", *conflict)
+	}
+	r := os.Stdin
+	if fs.NArg() > 0 && fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	db, err := openConfiguredDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	res, err := importRecords(db, r, *conflict)
+	log.WithFields(log.Fields{
+		"added":     res.Added,
+		"updated":   res.Updated,
+		"unchanged": res.Unchanged,
+		"skipped":   res.Skipped,
+	}).Info("Imported records")
+	return err
+}
+
+// openConfiguredDatabase opens the database of the configuration file
+func openConfiguredDatabase() (database, error) {
+	db := newDatabase(Config.Database.Engine)
+	if err := db.Init(Config.Database.Engine, Config.Database.Connection); err != nil {
+		return nil, fmt.Errorf("could not open the configured database: %v", err)
+	}
+	return db, nil
+}
+
+// readOnlyDatabase is a database backend that can be opened for reading without modifying it
+type readOnlyDatabase interface {
+	database
+	InitReadOnly(string, string) error
+}
+
+// openSourceDatabase opens the database to convert from. The source is only read: its schema is
+// not created or migrated, and it must be of the current version.
+func openSourceDatabase(engine string, connection string) (database, error) {
+	db, ok := newDatabase(engine).(readOnlyDatabase)
+	if !ok {
+		return nil, fmt.Errorf("can not convert from database engine %s", engine)
+	}
+	if err := db.InitReadOnly(engine, connection); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// convertDatabase copies all the records from src to dst and returns the number of records copied
+func convertDatabase(src database, dst database) (int, error) {
+	records, err := src.GetRecords()
+	if err != nil {
+		return 0, fmt.Errorf("could not read the source database: %v", err)
+	}
+	for i, rec := range records {
+		if err := dst.PutRecord(rec); err != nil {
+			return i, fmt.Errorf("could not write the record %s: %v", rec.Username, err)
+		}
+	}
+	return len(records), nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunCommandUnknown(t *testing.T) {
+	if err := runCommand([]string{"nonexistent"}); err == nil {
+		t.Errorf("Expected error for an unknown command, got none")
+	}
+	if err := runCommand([]string{"convert"}); err == nil {
+		t.Errorf("Expected error for convert without a source database, got none")
+	}
+}
+
+func TestConvertDatabase(t *testing.T) {
+	src := new(acmedb)
+	if err := src.Init("sqlite3", filepath.Join(t.TempDir(), "acme-dns.sqlite")); err != nil {
+		t.Fatalf("Could not open sqlite database: %v", err)
+	}
+	defer src.Close()
+	reg, err := src.Register(cidrslice{"10.0.0.0/8"}, "")
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	reg.Value = "converted"
+	if _, err = src.Update(reg.ACMETxtPost); err != nil {
+		t.Fatalf("Update failed, got error [%v]", err)
+	}
+	if _, err = src.Register(cidrslice{}, ""); err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+
+	dst := newTestBoltDB(t)
+	// Converting again replaces the records converted earlier
+	for i := 0; i < 2; i++ {
+		n, err := convertDatabase(src, dst)
+		if err != nil {
+			t.Fatalf("Conversion %d failed, got error [%v]", i, err)
+		}
+		if n != 2 {
+			t.Errorf("Conversion %d: expected 2 records, got %d", i, n)
+		}
+	}
+	records, _ := dst.GetRecords()
+	if len(records) != 2 {
+		t.Errorf("Expected 2 records in the converted database, got %d", len(records))
+	}
+	user, err := dst.GetByUsername(reg.Username)
+	if err != nil {
+		t.Fatalf("Could not get the converted user, got error [%v]", err)
+	}
+	if !correctPassword(reg.Password, user.Password) {
+		t.Errorf("The password does not match the converted hash")
+	}
+	if len(user.AllowFrom) != 1 || user.AllowFrom[0] != "10.0.0.0/8" {
+		t.Errorf("Expected AllowFrom [10.0.0.0/8], got %v", user.AllowFrom)
+	}
+	txts, _ := dst.GetTXTForDomain(reg.Subdomain, "")
+	if !stringInSlice("converted", txts) {
+		t.Errorf("Expected the converted TXT value, got %q", txts)
+	}
+
+	// And back to SQL
+	back := new(acmedb)
+	if err := back.Init("sqlite3", filepath.Join(t.TempDir(), "acme-dns.sqlite")); err != nil {
+		t.Fatalf("Could not open sqlite database: %v", err)
+	}
+	defer back.Close()
+	if _, err = convertDatabase(dst, back); err != nil {
+		t.Fatalf("Conversion to SQL failed, got error [%v]", err)
+	}
+	txts, _ = back.GetTXTForDomain(reg.Subdomain, "")
+	if len(txts) != 2 || !stringInSlice("converted", txts) {
+		t.Errorf("Expected the converted TXT values, got %q", txts)
+	}
+}
+
+func TestOpenSourceDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acme-dns.sqlite")
+	d := new(acmedb)
+	if err := d.Init("sqlite3", path); err != nil {
+		t.Fatalf("Could not open sqlite database: %v", err)
+	}
+	if _, err := d.Register(cidrslice{}, ""); err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	src, err := openSourceDatabase("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Could not open the source database: %v", err)
+	}
+	if records, _ := src.GetRecords(); len(records) != 1 {
+		t.Errorf("Expected 1 record in the source database, got %d", len(records))
+	}
+	src.Close()
+
+	// An older source database is not migrated
+	if _, err = d.DB.Exec("UPDATE acmedns SET Value='1' WHERE Name='db_version'"); err != nil {
+		t.Fatalf("Could not set the database version: %v", err)
+	}
+	if _, err = openSourceDatabase("sqlite3", path); err == nil {
+		t.Errorf("Expected error for an older source database, got none")
+	}
+	if version, _ := d.SchemaVersion(); version != 1 {
+		t.Errorf("Expected the source database to be left at version 1, got %d", version)
+	}
+	d.Close()
+
+	missing := filepath.Join(t.TempDir(), "missing.db")
+	if _, err = openSourceDatabase("bolt", missing); err == nil {
+		t.Errorf("Expected error for a missing bolt database, got none")
+	}
+	if _, err = os.Stat(missing); err == nil {
+		t.Errorf("Expected the missing bolt database not to be created")
+	}
+	if _, err = openSourceDatabase("memory", ""); err == nil {
+		t.Errorf("Expected error for the memory engine, got none")
+	}
+}
@@ -1,14 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"regexp"
-	"strconv"
+	"sort"
 	"time"
 
+	_ "github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
@@ -16,218 +17,217 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-// DBVersion shows the database version this code uses. This is used for update checks.
-var DBVersion = 1
+// DBVersion shows the database version this code uses. This is the version the migrations of
+// every engine lead to.
+var DBVersion = 2
 
-var acmeTable = `
-	CREATE TABLE IF NOT EXISTS acmedns(
-		Name TEXT,
-		Value TEXT
-	);`
-
-var userTable = `
-	CREATE TABLE IF NOT EXISTS records(
-        Username TEXT UNIQUE NOT NULL PRIMARY KEY,
-        Password TEXT UNIQUE NOT NULL,
-        Subdomain TEXT UNIQUE NOT NULL,
-		AllowFrom TEXT
-    );`
-
-var txtTable = `
-    CREATE TABLE IF NOT EXISTS txt(
-		Subdomain TEXT NOT NULL,
-		Value   TEXT NOT NULL DEFAULT '',
-		LastUpdate INT
-	);`
-
-var txtTablePG = `
-    CREATE TABLE IF NOT EXISTS txt(
-		rowid SERIAL,
-		Subdomain TEXT NOT NULL,
-		Value   TEXT NOT NULL DEFAULT '',
-		LastUpdate INT
-	);`
+// Statements that are prepared once in Init and shared by all the database connections
+var (
+	regSQL = `
+    INSERT INTO records(
+        Username,
+        Password,
+        Subdomain,
+		AllowFrom,
+		Zone) 
+        values($1, $2, $3, $4, $5)`
+	txtSQL = `
+	INSERT INTO txt (Subdomain, LastUpdate) values($1, 0)`
+	getByUsernameSQL = `
+	SELECT Username, Password, Subdomain, AllowFrom, Zone
+	FROM records
+	WHERE Username=$1 LIMIT 1
+	`
+	getTXTSQL = `
+	SELECT txt.Value FROM txt JOIN records ON records.Subdomain=txt.Subdomain
+	WHERE txt.Subdomain=$1 AND records.Zone=$2 LIMIT 2
+	`
+	getRecordsSQL = `
+	SELECT Username, Password, Subdomain, AllowFrom, Zone FROM records`
+	getAllTXTSQL = `
+	SELECT Subdomain, Value, LastUpdate FROM txt`
+	putTXTSQL = `
+	INSERT INTO txt (Subdomain, Value, LastUpdate) values($1, $2, $3)`
+	delTXTSQL = `
+	DELETE FROM txt WHERE Subdomain IN (SELECT Subdomain FROM records WHERE Username=$1)`
+	delRecordSQL = `
+	DELETE FROM records WHERE Username=$1`
+	getTXTRowsSQL = `
+	SELECT Value, LastUpdate FROM txt WHERE Subdomain=$1`
+)
 
-// getSQLiteStmt replaces all PostgreSQL prepared statement placeholders (eg. $1, $2) with SQLite variant "?"
-func getSQLiteStmt(s string) string {
-	re, _ := regexp.Compile(`\$[0-9]`)
-	return re.ReplaceAllString(s, "?")
+// newDatabase returns an uninitialized database backend for the engine
+func newDatabase(engine string) database {
+	switch engine {
+	case "bolt":
+		return new(boltdb)
+	case "memory":
+		return new(memorydb)
+	}
+	return new(acmedb)
 }
 
-func (d *acmedb) Init(engine string, connection string) error {
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
-	db, err := sql.Open(engine, connection)
-	if err != nil {
-		return err
+// configurePool applies the connection pool settings from the configuration
+func (d *acmedb) configurePool(connection string) {
+	if d.dialect == dialectSQLite && isSQLiteMemory(connection) {
+		// Every connection to an in-memory SQLite database would see a database of its own
+		d.DB.SetMaxOpenConns(1)
+		return
 	}
-	d.DB = db
-	// Check version first to try to catch old versions without version string
-	var versionString string
-	_ = d.DB.QueryRow("SELECT Value FROM acmedns WHERE Name='db_version'").Scan(&versionString)
-	if versionString == "" {
-		versionString = "0"
-	}
-	_, _ = d.DB.Exec(acmeTable)
-	_, _ = d.DB.Exec(userTable)
-	if Config.Database.Engine == "sqlite3" {
-		_, _ = d.DB.Exec(txtTable)
-	} else {
-		_, _ = d.DB.Exec(txtTablePG)
-	}
-	// If everything is fine, handle db upgrade tasks
-	if err == nil {
-		err = d.checkDBUpgrades(versionString)
+	if Config.Database.MaxOpenConns > 0 {
+		d.DB.SetMaxOpenConns(Config.Database.MaxOpenConns)
 	}
-	if err == nil {
-		if versionString == "0" {
-			// No errors so we should now be in version 1
-			insversion := fmt.Sprintf("INSERT INTO acmedns (Name, Value) values('db_version', '%d')", DBVersion)
-			_, err = db.Exec(insversion)
-		}
+	if Config.Database.MaxIdleConns > 0 {
+		d.DB.SetMaxIdleConns(Config.Database.MaxIdleConns)
+	}
+	if Config.Database.ConnMaxLifetime > 0 {
+		d.DB.SetConnMaxLifetime(time.Duration(Config.Database.ConnMaxLifetime) * time.Second)
 	}
-	return err
 }
 
-func (d *acmedb) checkDBUpgrades(versionString string) error {
-	var err error
-	version, err := strconv.Atoi(versionString)
-	if err != nil {
-		return err
-	}
-	if version != DBVersion {
-		return d.handleDBUpgrades(version)
+// prepareStatements prepares the statements used by the database methods. On failure the error
+// is stored and returned by the methods until the statements are prepared successfully.
+func (d *acmedb) prepareStatements() error {
+	d.closeStatements()
+	prepare := func(query string) *sql.Stmt {
+		if d.stmtErr != nil {
+			return nil
+		}
+		sm, err := d.DB.Prepare(d.dialect.Rebind(query))
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Database error in prepare")
+			d.stmtErr = err
+		}
+		return sm
 	}
-	return nil
+	d.stmtErr = nil
+	d.regStmt = prepare(regSQL)
+	d.txtStmt = prepare(txtSQL)
+	d.getByUsernameStmt = prepare(getByUsernameSQL)
+	d.getTXTStmt = prepare(getTXTSQL)
+	d.updStmt = prepare(d.dialect.UpdateTXT)
+	return d.stmtErr
+}
 
+func (d *acmedb) closeStatements() {
+	for _, sm := range []*sql.Stmt{d.regStmt, d.txtStmt, d.getByUsernameStmt, d.getTXTStmt, d.updStmt} {
+		if sm != nil {
+			sm.Close()
+		}
+	}
+	d.regStmt, d.txtStmt, d.getByUsernameStmt, d.getTXTStmt, d.updStmt = nil, nil, nil, nil, nil
 }
 
-func (d *acmedb) handleDBUpgrades(version int) error {
-	if version == 0 {
-		return d.handleDBUpgradeTo1()
+// lockWrite serializes the writes for SQLite, which allows only a single writer at a time
+func (d *acmedb) lockWrite() func() {
+	if !d.dialect.SingleWriter {
+		return func() {}
 	}
-	return nil
+	d.writeMu.Lock()
+	return d.writeMu.Unlock
 }
 
-func (d *acmedb) handleDBUpgradeTo1() error {
-	var err error
-	var subdomains []string
-	rows, err := d.DB.Query("SELECT Subdomain FROM records")
-	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("Error in DB upgrade")
+func (d *acmedb) Init(engine string, connection string) error {
+	if err := d.open(engine, connection); err != nil {
 		return err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var subdomain string
-		err = rows.Scan(&subdomain)
+	if Config.Database.ManualMigrate {
+		version, err := d.SchemaVersion()
 		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error()}).Error("Error in DB upgrade while reading values")
 			return err
 		}
-		subdomains = append(subdomains, subdomain)
+		if err = checkSchemaVersion(version, DBVersion); err != nil {
+			return err
+		}
+		if version < DBVersion {
+			return fmt.Errorf("database version %d is older than %d, run \"acme-dns migrate up\" to upgrade it", version, DBVersion)
+		}
+	} else if _, err := d.Migrate(); err != nil {
+		return err
 	}
-	err = rows.Err()
-	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("Error in DB upgrade while inserting values")
+	return d.prepareStatements()
+}
+
+// InitReadOnly opens the database for reading, without creating the tables or migrating the
+// schema. The schema must be of the current version.
+func (d *acmedb) InitReadOnly(engine string, connection string) error {
+	if err := d.open(engine, connection); err != nil {
 		return err
 	}
-	tx, err := d.DB.Begin()
-	// Rollback if errored, commit if not
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-			return
-		}
-		_ = tx.Commit()
-	}()
-	_, _ = tx.Exec("DELETE FROM txt")
-	for _, subdomain := range subdomains {
-		if subdomain != "" {
-			// Insert two rows for each subdomain to txt table
-			err = d.NewTXTValuesInTransaction(tx, subdomain)
-			if err != nil {
-				log.WithFields(log.Fields{"error": err.Error()}).Error("Error in DB upgrade while inserting values")
-				return err
-			}
-		}
+	version, err := readSchemaVersion(context.Background(), d.DB)
+	if err == nil {
+		err = checkSchemaVersion(version, DBVersion)
+	}
+	if err == nil && version < DBVersion {
+		err = fmt.Errorf("database version %d is older than %d, upgrade it with \"acme-dns migrate up\" first", version, DBVersion)
 	}
-	// SQLite doesn't support dropping columns
-	if Config.Database.Engine != "sqlite3" {
-		_, _ = tx.Exec("ALTER TABLE records DROP COLUMN IF EXISTS Value")
-		_, _ = tx.Exec("ALTER TABLE records DROP COLUMN IF EXISTS LastActive")
+	if err == nil {
+		err = d.prepareStatements()
 	}
-	_, err = tx.Exec("UPDATE acmedns SET Value='1' WHERE Name='db_version'")
-	return err
+	if err != nil {
+		d.Close()
+		return err
+	}
+	return nil
 }
 
-// Create two rows for subdomain to the txt table
-func (d *acmedb) NewTXTValuesInTransaction(tx *sql.Tx, subdomain string) error {
-	var err error
-	instr := fmt.Sprintf("INSERT INTO txt (Subdomain, LastUpdate) values('%s', 0)", subdomain)
-	_, _ = tx.Exec(instr)
-	_, _ = tx.Exec(instr)
-	return err
+// open opens the database without checking or migrating the schema
+func (d *acmedb) open(engine string, connection string) error {
+	d.dialect = getDialect(engine)
+	connection = d.dialect.Connection(connection)
+	db, err := sql.Open(engine, connection)
+	if err != nil {
+		return err
+	}
+	d.DB = db
+	d.connection = connection
+	d.configurePool(connection)
+	return nil
 }
 
-func (d *acmedb) Register(afrom cidrslice) (ACMETxt, error) {
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
+func (d *acmedb) Register(afrom cidrslice, zone string) (ACMETxt, error) {
 	var err error
-	tx, err := d.DB.Begin()
-	// Rollback if errored, commit if not
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-			return
-		}
-		_ = tx.Commit()
-	}()
 	a := newACMETxt()
 	a.AllowFrom = cidrslice(afrom.ValidEntries())
+	a.Zone = zone
 	passwordHash, err := bcrypt.GenerateFromPassword([]byte(a.Password), 10)
-	regSQL := `
-    INSERT INTO records(
-        Username,
-        Password,
-        Subdomain,
-		AllowFrom) 
-        values($1, $2, $3, $4)`
-	if Config.Database.Engine == "sqlite3" {
-		regSQL = getSQLiteStmt(regSQL)
+	if err != nil {
+		return a, err
+	}
+	if d.stmtErr != nil {
+		return a, errors.New("SQL error")
 	}
-	sm, err := tx.Prepare(regSQL)
+	unlock := d.lockWrite()
+	defer unlock()
+	tx, err := d.DB.Begin()
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("Database error in prepare")
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Database error in begin")
 		return a, errors.New("SQL error")
 	}
-	defer sm.Close()
-	_, err = sm.Exec(a.Username.String(), passwordHash, a.Subdomain, a.AllowFrom.JSON())
-	if err == nil {
-		err = d.NewTXTValuesInTransaction(tx, a.Subdomain)
+	_, err = tx.Stmt(d.regStmt).Exec(a.Username.String(), passwordHash, a.Subdomain, a.AllowFrom.JSON(), a.Zone)
+	if err != nil {
+		_ = tx.Rollback()
+		return a, err
+	}
+	txtStmt := tx.Stmt(d.txtStmt)
+	for i := 0; i < 2; i++ {
+		if _, err = txtStmt.Exec(a.Subdomain); err != nil {
+			_ = tx.Rollback()
+			return a, err
+		}
+	}
+	if err = tx.Commit(); err == nil {
+		d.notifyTXT(a.Subdomain)
 	}
 	return a, err
 }
 
 func (d *acmedb) GetByUsername(u uuid.UUID) (ACMETxt, error) {
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
 	var results []ACMETxt
-	getSQL := `
-	SELECT Username, Password, Subdomain, AllowFrom
-	FROM records
-	WHERE Username=$1 LIMIT 1
-	`
-	if Config.Database.Engine == "sqlite3" {
-		getSQL = getSQLiteStmt(getSQL)
-	}
-
-	sm, err := d.DB.Prepare(getSQL)
-	if err != nil {
-		return ACMETxt{}, err
+	if d.stmtErr != nil {
+		return ACMETxt{}, d.stmtErr
 	}
-	defer sm.Close()
-	rows, err := sm.Query(u.String())
+	rows, err := d.getByUsernameStmt.Query(u.String())
 	if err != nil {
 		return ACMETxt{}, err
 	}
@@ -247,24 +247,13 @@ func (d *acmedb) GetByUsername(u uuid.UUID) (ACMETxt, error) {
 	return ACMETxt{}, errors.New("no user")
 }
 
-func (d *acmedb) GetTXTForDomain(domain string) ([]string, error) {
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
+func (d *acmedb) GetTXTForDomain(domain string, zone string) ([]string, error) {
 	domain = sanitizeString(domain)
 	var txts []string
-	getSQL := `
-	SELECT Value FROM txt WHERE Subdomain=$1 LIMIT 2
-	`
-	if Config.Database.Engine == "sqlite3" {
-		getSQL = getSQLiteStmt(getSQL)
-	}
-
-	sm, err := d.DB.Prepare(getSQL)
-	if err != nil {
-		return txts, err
+	if d.stmtErr != nil {
+		return txts, d.stmtErr
 	}
-	defer sm.Close()
-	rows, err := sm.Query(domain)
+	rows, err := d.getTXTStmt.Query(domain, zone)
 	if err != nil {
 		return txts, err
 	}
@@ -278,37 +267,198 @@ func (d *acmedb) GetTXTForDomain(domain string) ([]string, error) {
 		}
 		txts = append(txts, rtxt)
 	}
-	return txts, nil
+	return txts, rows.Err()
 }
 
-func (d *acmedb) Update(a ACMETxtPost) error {
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
+func (d *acmedb) Update(a ACMETxtPost) (int64, error) {
 	var err error
 	// Data in a is already sanitized
 	timenow := time.Now().Unix()
+	if d.stmtErr != nil {
+		return timenow, d.stmtErr
+	}
+	unlock := d.lockWrite()
+	defer unlock()
+	_, err = d.updStmt.Exec(a.Value, timenow, a.Subdomain)
+	if err != nil {
+		return timenow, err
+	}
+	d.notifyTXT(a.Subdomain)
+	return timenow, nil
+}
 
-	updSQL := `
-	UPDATE txt SET Value=$1, LastUpdate=$2
-	WHERE rowid=(
-		SELECT rowid FROM txt WHERE Subdomain=$3 ORDER BY LastUpdate LIMIT 1)
-	`
-	if Config.Database.Engine == "sqlite3" {
-		updSQL = getSQLiteStmt(updSQL)
+// GetRecords returns all the accounts with their TXT values
+func (d *acmedb) GetRecords() ([]dbRecord, error) {
+	var records []dbRecord
+	rows, err := d.DB.Query(d.dialect.Rebind(getRecordsSQL))
+	if err != nil {
+		return records, err
+	}
+	defer rows.Close()
+	index := make(map[string]int)
+	for rows.Next() {
+		var rec dbRecord
+		var afrom sql.NullString
+		if err = rows.Scan(&rec.Username, &rec.Password, &rec.Subdomain, &afrom, &rec.Zone); err != nil {
+			return records, err
+		}
+		rec.AllowFrom = []string{}
+		if afrom.String != "" {
+			if err = json.Unmarshal([]byte(afrom.String), &rec.AllowFrom); err != nil {
+				return records, err
+			}
+		}
+		rec.TXT = []dbTXT{}
+		index[rec.Subdomain] = len(records)
+		records = append(records, rec)
+	}
+	if err = rows.Err(); err != nil {
+		return records, err
 	}
 
-	sm, err := d.DB.Prepare(updSQL)
+	txtRows, err := d.DB.Query(d.dialect.Rebind(getAllTXTSQL))
 	if err != nil {
-		return err
+		return records, err
 	}
-	defer sm.Close()
-	_, err = sm.Exec(a.Value, timenow, a.Subdomain)
+	defer txtRows.Close()
+	for txtRows.Next() {
+		var subdomain string
+		var txt dbTXT
+		var lastUpdate sql.NullInt64
+		if err = txtRows.Scan(&subdomain, &txt.Value, &lastUpdate); err != nil {
+			return records, err
+		}
+		txt.LastUpdate = lastUpdate.Int64
+		if i, ok := index[subdomain]; ok {
+			records[i].TXT = append(records[i].TXT, txt)
+		}
+	}
+	return records, txtRows.Err()
+}
+
+// PutRecord stores the account with its TXT values, replacing an existing account with the same username
+func (d *acmedb) PutRecord(rec dbRecord) error {
+	unlock := d.lockWrite()
+	defer unlock()
+	tx, err := d.DB.Begin()
 	if err != nil {
 		return err
 	}
+	afrom := cidrslice(rec.AllowFrom)
+	for _, stmt := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{delTXTSQL, []interface{}{rec.Username}},
+		{delRecordSQL, []interface{}{rec.Username}},
+		{regSQL, []interface{}{rec.Username, rec.Password, rec.Subdomain, afrom.JSON(), rec.Zone}},
+	} {
+		if _, err = tx.Exec(d.dialect.Rebind(stmt.query), stmt.args...); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	for _, txt := range recordTXTSlots(rec.TXT) {
+		if _, err = tx.Exec(d.dialect.Rebind(putTXTSQL), rec.Subdomain, txt.Value, txt.LastUpdate); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	d.notifyTXT(rec.Subdomain)
 	return nil
 }
 
+// MergeTXT stores a TXT value with its update time, replacing the least recently updated value
+// of the subdomain, unless the value is older than both of the current values
+func (d *acmedb) MergeTXT(subdomain string, txt dbTXT) (bool, error) {
+	unlock := d.lockWrite()
+	defer unlock()
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	rows, err := tx.Query(d.dialect.Rebind(getTXTRowsSQL+d.dialect.ForUpdate), subdomain)
+	if err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+	var values []dbTXT
+	for rows.Next() {
+		var v dbTXT
+		var lastUpdate sql.NullInt64
+		if err = rows.Scan(&v.Value, &lastUpdate); err != nil {
+			break
+		}
+		v.LastUpdate = lastUpdate.Int64
+		values = append(values, v)
+	}
+	rows.Close()
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+	if len(values) == 0 {
+		_ = tx.Rollback()
+		return false, errUnknownSubdomain
+	}
+	if _, ok := txtMergeSlot(values, txt); !ok {
+		return false, tx.Rollback()
+	}
+	if _, err = tx.Exec(d.dialect.Rebind(d.dialect.UpdateTXT), txt.Value, txt.LastUpdate, subdomain); err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	d.notifyTXT(subdomain)
+	return true, nil
+}
+
+// errUnknownSubdomain is returned by MergeTXT for a subdomain without an account
+var errUnknownSubdomain = errors.New("unknown subdomain")
+
+// txtMergeSlot returns the index of the least recently updated value, which a merged value
+// replaces. The value is not merged if it is already stored, or if it is older than all the
+// current values.
+func txtMergeSlot(values []dbTXT, txt dbTXT) (int, bool) {
+	if len(values) == 0 {
+		return 0, false
+	}
+	oldest := 0
+	for i, v := range values {
+		if v == txt {
+			return i, false
+		}
+		if v.LastUpdate < values[oldest].LastUpdate {
+			oldest = i
+		}
+	}
+	return oldest, txt.LastUpdate >= values[oldest].LastUpdate
+}
+
+// recordTXTSlots returns the two most recently updated TXT values, padded with empty values.
+// Every subdomain has exactly two TXT rows in the database.
+func recordTXTSlots(txts []dbTXT) []dbTXT {
+	slots := append([]dbTXT(nil), txts...)
+	sort.SliceStable(slots, func(i, j int) bool {
+		return slots[i].LastUpdate > slots[j].LastUpdate
+	})
+	if len(slots) > 2 {
+		slots = slots[:2]
+	}
+	for len(slots) < 2 {
+		slots = append(slots, dbTXT{})
+	}
+	return slots
+}
+
 func getModelFromRow(r *sql.Rows) (ACMETxt, error) {
 	txt := ACMETxt{}
 	afrom := ""
@@ -316,7 +466,8 @@ func getModelFromRow(r *sql.Rows) (ACMETxt, error) {
 		&txt.Username,
 		&txt.Password,
 		&txt.Subdomain,
-		&afrom)
+		&afrom,
+		&txt.Zone)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err.Error()}).Error("Row scan error")
 	}
@@ -331,6 +482,7 @@ func getModelFromRow(r *sql.Rows) (ACMETxt, error) {
 }
 
 func (d *acmedb) Close() {
+	d.closeStatements()
 	d.DB.Close()
 }
 
@@ -338,6 +490,8 @@ func (d *acmedb) GetBackend() *sql.DB {
 	return d.DB
 }
 
+// SetBackend replaces the database handle and prepares the statements for it
 func (d *acmedb) SetBackend(backend *sql.DB) {
 	d.DB = backend
+	_ = d.prepareStatements()
 }
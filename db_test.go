@@ -4,8 +4,12 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"errors"
-	"github.com/erikstmartin/go-testdb"
+	"fmt"
+	"path/filepath"
+	"sync"
 	"testing"
+
+	"github.com/erikstmartin/go-testdb"
 )
 
 type testResult struct {
@@ -43,7 +47,7 @@ func TestDBInit(t *testing.T) {
 
 func TestRegisterNoCIDR(t *testing.T) {
 	// Register tests
-	_, err := DB.Register(cidrslice{})
+	_, err := DB.Register(cidrslice{}, "")
 	if err != nil {
 		t.Errorf("Registration failed, got error [%v]", err)
 	}
@@ -58,7 +62,7 @@ func TestRegisterMany(t *testing.T) {
 		{cidrslice{"1.1.1./32", "1922.168.42.42/8", "1.1.1.1/33", "1.2.3.4/"}, cidrslice{}},
 		{cidrslice{"7.6.5.4/32", "invalid", "1.0.0.1/2"}, cidrslice{"7.6.5.4/32", "1.0.0.1/2"}},
 	} {
-		user, err := DB.Register(test.input)
+		user, err := DB.Register(test.input, "")
 		if err != nil {
 			t.Errorf("Test %d: Got error from register method: [%v]", i, err)
 		}
@@ -78,7 +82,7 @@ func TestRegisterMany(t *testing.T) {
 
 func TestGetByUsername(t *testing.T) {
 	// Create  reg to refer to
-	reg, err := DB.Register(cidrslice{})
+	reg, err := DB.Register(cidrslice{}, "")
 	if err != nil {
 		t.Errorf("Registration failed, got error [%v]", err)
 	}
@@ -103,7 +107,7 @@ func TestGetByUsername(t *testing.T) {
 }
 
 func TestPrepareErrors(t *testing.T) {
-	reg, _ := DB.Register(cidrslice{})
+	reg, _ := DB.Register(cidrslice{}, "")
 	tdb, err := sql.Open("testdb", "")
 	if err != nil {
 		t.Errorf("Got error: %v", err)
@@ -118,14 +122,14 @@ func TestPrepareErrors(t *testing.T) {
 		t.Errorf("Expected error, but didn't get one")
 	}
 
-	_, err = DB.GetTXTForDomain(reg.Subdomain)
+	_, err = DB.GetTXTForDomain(reg.Subdomain, "")
 	if err == nil {
 		t.Errorf("Expected error, but didn't get one")
 	}
 }
 
 func TestQueryExecErrors(t *testing.T) {
-	reg, _ := DB.Register(cidrslice{})
+	reg, _ := DB.Register(cidrslice{}, "")
 	testdb.SetExecWithArgsFunc(func(query string, args []driver.Value) (result driver.Result, err error) {
 		return testResult{1, 0}, errors.New("Prepared query error")
 	})
@@ -151,17 +155,17 @@ func TestQueryExecErrors(t *testing.T) {
 		t.Errorf("Expected error from exec, but got none")
 	}
 
-	_, err = DB.GetTXTForDomain(reg.Subdomain)
+	_, err = DB.GetTXTForDomain(reg.Subdomain, "")
 	if err == nil {
 		t.Errorf("Expected error from exec in GetByDomain, but got none")
 	}
 
-	_, err = DB.Register(cidrslice{})
+	_, err = DB.Register(cidrslice{}, "")
 	if err == nil {
 		t.Errorf("Expected error from exec in Register, but got none")
 	}
 	reg.Value = "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"
-	err = DB.Update(reg.ACMETxtPost)
+	_, err = DB.Update(reg.ACMETxtPost)
 	if err == nil {
 		t.Errorf("Expected error from exec in Update, but got none")
 	}
@@ -169,7 +173,7 @@ func TestQueryExecErrors(t *testing.T) {
 }
 
 func TestQueryScanErrors(t *testing.T) {
-	reg, _ := DB.Register(cidrslice{})
+	reg, _ := DB.Register(cidrslice{}, "")
 
 	testdb.SetExecWithArgsFunc(func(query string, args []driver.Value) (result driver.Result, err error) {
 		return testResult{1, 0}, errors.New("Prepared query error")
@@ -198,7 +202,7 @@ func TestQueryScanErrors(t *testing.T) {
 }
 
 func TestBadDBValues(t *testing.T) {
-	reg, _ := DB.Register(cidrslice{})
+	reg, _ := DB.Register(cidrslice{}, "")
 
 	testdb.SetQueryWithArgsFunc(func(query string, args []driver.Value) (result driver.Rows, err error) {
 		columns := []string{"Username", "Password", "Subdomain", "Value", "LastActive"}
@@ -221,7 +225,7 @@ func TestBadDBValues(t *testing.T) {
 		t.Errorf("Expected error from scan in, but got none")
 	}
 
-	_, err = DB.GetTXTForDomain(reg.Subdomain)
+	_, err = DB.GetTXTForDomain(reg.Subdomain, "")
 	if err == nil {
 		t.Errorf("Expected error from scan in GetByDomain, but got none")
 	}
@@ -229,7 +233,7 @@ func TestBadDBValues(t *testing.T) {
 
 func TestGetTXTForDomain(t *testing.T) {
 	// Create  reg to refer to
-	reg, err := DB.Register(cidrslice{})
+	reg, err := DB.Register(cidrslice{}, "")
 	if err != nil {
 		t.Errorf("Registration failed, got error [%v]", err)
 	}
@@ -238,12 +242,12 @@ func TestGetTXTForDomain(t *testing.T) {
 	txtval2 := "___validation_token_received_YEAH_the_ca___"
 
 	reg.Value = txtval1
-	_ = DB.Update(reg.ACMETxtPost)
+	_, _ = DB.Update(reg.ACMETxtPost)
 
 	reg.Value = txtval2
-	_ = DB.Update(reg.ACMETxtPost)
+	_, _ = DB.Update(reg.ACMETxtPost)
 
-	regDomainSlice, err := DB.GetTXTForDomain(reg.Subdomain)
+	regDomainSlice, err := DB.GetTXTForDomain(reg.Subdomain, "")
 	if err != nil {
 		t.Errorf("Could not get test user, got error [%v]", err)
 	}
@@ -269,7 +273,7 @@ func TestGetTXTForDomain(t *testing.T) {
 	}
 
 	// Not found
-	regNotfound, _ := DB.GetTXTForDomain("does-not-exist")
+	regNotfound, _ := DB.GetTXTForDomain("does-not-exist", "")
 	if len(regNotfound) > 0 {
 		t.Errorf("No records should be returned.")
 	}
@@ -277,7 +281,7 @@ func TestGetTXTForDomain(t *testing.T) {
 
 func TestUpdate(t *testing.T) {
 	// Create  reg to refer to
-	reg, err := DB.Register(cidrslice{})
+	reg, err := DB.Register(cidrslice{}, "")
 	if err != nil {
 		t.Errorf("Registration failed, got error [%v]", err)
 	}
@@ -294,8 +298,174 @@ func TestUpdate(t *testing.T) {
 	regUser.Password = "nevergonnagiveyouup"
 	regUser.Value = validTXT
 
-	err = DB.Update(regUser.ACMETxtPost)
+	_, err = DB.Update(regUser.ACMETxtPost)
 	if err != nil {
 		t.Errorf("DB Update failed, got error: [%v]", err)
 	}
 }
+
+func TestSQLiteConnection(t *testing.T) {
+	for i, test := range []struct {
+		input    string
+		expected string
+	}{
+		{":memory:", ":memory:"},
+		{"file::memory:?cache=shared", "file::memory:?cache=shared"},
+		{"/var/lib/acme-dns/acme-dns.db", "/var/lib/acme-dns/acme-dns.db?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"},
+		{"acme-dns.db?_busy_timeout=100", "acme-dns.db?_busy_timeout=100&_journal_mode=WAL&_txlock=immediate"},
+		{"acme-dns.db?_journal_mode=DELETE&_busy_timeout=1&_txlock=deferred", "acme-dns.db?_journal_mode=DELETE&_busy_timeout=1&_txlock=deferred"},
+	} {
+		if ret := sqliteConnection(test.input); ret != test.expected {
+			t.Errorf("Test %d: Expected [%s] but got [%s]", i, test.expected, ret)
+		}
+	}
+}
+
+func TestSetBackendPreparesStatements(t *testing.T) {
+	oldDb := DB.GetBackend()
+	tdb, _ := sql.Open("testdb", "")
+	DB.SetBackend(tdb)
+	_, err := DB.GetTXTForDomain("whatever", "")
+	if err == nil {
+		t.Errorf("Expected error from unprepared statements, but got none")
+	}
+	DB.SetBackend(oldDb)
+	_, err = DB.GetTXTForDomain("whatever", "")
+	if err != nil {
+		t.Errorf("Expected statements to be prepared again, but got error [%v]", err)
+	}
+}
+
+// newConcurrencyDB returns a database for the concurrency tests and benchmarks. The in-memory SQLite
+// database of the tests is limited to a single connection, so a file backed one is used instead.
+func newConcurrencyDB(tb testing.TB) database {
+	if *postgres || *mysql {
+		return DB
+	}
+	newDb := new(acmedb)
+	err := newDb.Init("sqlite3", filepath.Join(tb.TempDir(), "acme-dns.db"))
+	if err != nil {
+		tb.Fatalf("Could not initialize database [%v]", err)
+	}
+	tb.Cleanup(newDb.Close)
+	return newDb
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	db := newConcurrencyDB(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reg, err := db.Register(cidrslice{}, "")
+			if err != nil {
+				errs <- err
+				return
+			}
+			for j := 0; j < 5; j++ {
+				reg.Value = fmt.Sprintf("%043d", i*100+j)
+				if _, err := db.Update(reg.ACMETxtPost); err != nil {
+					errs <- err
+					return
+				}
+				txts, err := db.GetTXTForDomain(reg.Subdomain, "")
+				if err != nil {
+					errs <- err
+					return
+				}
+				if len(txts) != 2 {
+					errs <- fmt.Errorf("expected 2 TXT values, got %d", len(txts))
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Got error from concurrent database access [%v]", err)
+	}
+}
+
+func benchmarkRegistrations(b *testing.B, db database, n int) []ACMETxt {
+	regs := make([]ACMETxt, n)
+	for i := range regs {
+		reg, err := db.Register(cidrslice{}, "")
+		if err != nil {
+			b.Fatalf("Registration failed, got error [%v]", err)
+		}
+		reg.Value = "___validation_token_received_from_the_ca___"
+		_, _ = db.Update(reg.ACMETxtPost)
+		regs[i] = reg
+	}
+	return regs
+}
+
+func BenchmarkGetTXTForDomain(b *testing.B) {
+	db := newConcurrencyDB(b)
+	regs := benchmarkRegistrations(b, db, 10)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = db.GetTXTForDomain(regs[i%len(regs)].Subdomain, "")
+	}
+}
+
+func BenchmarkGetTXTForDomainParallel(b *testing.B) {
+	db := newConcurrencyDB(b)
+	regs := benchmarkRegistrations(b, db, 10)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			_, _ = db.GetTXTForDomain(regs[i%len(regs)].Subdomain, "")
+			i++
+		}
+	})
+}
+
+func BenchmarkGetByUsernameParallel(b *testing.B) {
+	db := newConcurrencyDB(b)
+	regs := benchmarkRegistrations(b, db, 10)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			_, _ = db.GetByUsername(regs[i%len(regs)].Username)
+			i++
+		}
+	})
+}
+
+func BenchmarkUpdateParallel(b *testing.B) {
+	db := newConcurrencyDB(b)
+	regs := benchmarkRegistrations(b, db, 10)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			_, _ = db.Update(regs[i%len(regs)].ACMETxtPost)
+			i++
+		}
+	})
+}
+
+// BenchmarkMixedParallel simulates DNS answering under a query flood while TXT values are being updated
+func BenchmarkMixedParallel(b *testing.B) {
+	db := newConcurrencyDB(b)
+	regs := benchmarkRegistrations(b, db, 10)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			reg := regs[i%len(regs)]
+			if i%20 == 0 {
+				_, _ = db.Update(reg.ACMETxtPost)
+			} else {
+				_, _ = db.GetTXTForDomain(reg.Subdomain, "")
+			}
+			i++
+		}
+	})
+}
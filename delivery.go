@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Default values for the delivery options of the webhooks and the cluster peers
+const (
+	deliveryDefaultTimeout    = 10
+	deliveryDefaultMaxRetries = 5
+	deliveryDefaultQueueSize  = 1024
+	deliveryMaxBackoff        = time.Minute
+)
+
+var (
+	errDeliveryQueueFull = errors.New("delivery queue full")
+	errDeliveryStopped   = errors.New("delivery queue stopped")
+)
+
+// deliveryQueue delivers the queued payloads to an URL with POST requests, one at a time, and
+// retries the failed deliveries with exponential backoff. It is used for the webhook endpoints
+// and the cluster peers.
+type deliveryQueue struct {
+	url        string
+	client     *http.Client
+	maxRetries int
+	backoff    time.Duration
+	// sign sets the headers authenticating the payload to the request of each attempt
+	sign func(req *http.Request, payload []byte)
+	// fields identify the queue in the logs
+	fields log.Fields
+	queue  chan delivery
+	wg     sync.WaitGroup
+	// ctx is cancelled when the queued payloads are dropped on Stop
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	stopped bool
+}
+
+// delivery is a payload queued for delivery with its own headers. The result of the delivery
+// is sent to done, if set.
+type delivery struct {
+	payload []byte
+	header  http.Header
+	fields  log.Fields
+	done    chan error
+}
+
+func newDeliveryQueue(url string, timeout int, maxRetries int, queueSize int, fields log.Fields) *deliveryQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &deliveryQueue{
+		url:        url,
+		client:     &http.Client{Timeout: time.Duration(timeout) * time.Second},
+		maxRetries: maxRetries,
+		backoff:    time.Second,
+		fields:     fields,
+		queue:      make(chan delivery, queueSize),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// prepareDeliveryConfig sets the default values of the request timeout in seconds, the number of
+// retries and the queue size. A negative number of retries disables retrying.
+func prepareDeliveryConfig(timeout *int, maxRetries *int, queueSize *int) {
+	if *timeout <= 0 {
+		*timeout = deliveryDefaultTimeout
+	}
+	if *maxRetries < 0 {
+		*maxRetries = 0
+	} else if *maxRetries == 0 {
+		*maxRetries = deliveryDefaultMaxRetries
+	}
+	if *queueSize <= 0 {
+		*queueSize = deliveryDefaultQueueSize
+	}
+}
+
+// Start starts the delivery worker
+func (q *deliveryQueue) Start() {
+	q.wg.Add(1)
+	go q.run()
+}
+
+// Stop closes the queue and waits for the worker to finish with the queued payloads until the
+// context is done. The payloads not delivered by then are dropped, and the request in flight is
+// cancelled.
+func (q *deliveryQueue) Stop(ctx context.Context) {
+	q.mu.Lock()
+	if !q.stopped {
+		q.stopped = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+	finished := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		q.cancel()
+		<-finished
+	}
+	q.cancel()
+}
+
+// stopQueues stops the queues in parallel, so they share the time until the context is done
+func stopQueues(ctx context.Context, queues []*deliveryQueue) {
+	var wg sync.WaitGroup
+	for _, q := range queues {
+		wg.Add(1)
+		go func(q *deliveryQueue) {
+			defer wg.Done()
+			q.Stop(ctx)
+		}(q)
+	}
+	wg.Wait()
+}
+
+// Enqueue queues the payload for delivery. It never blocks: if the queue is full or stopped, the
+// payload is dropped and an error is returned.
+func (q *deliveryQueue) Enqueue(d delivery) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped {
+		return errDeliveryStopped
+	}
+	select {
+	case q.queue <- d:
+		return nil
+	default:
+		return errDeliveryQueueFull
+	}
+}
+
+func (q *deliveryQueue) run() {
+	defer q.wg.Done()
+	dropped := 0
+	for d := range q.queue {
+		err := errDeliveryStopped
+		if q.ctx.Err() == nil {
+			err = q.deliver(d)
+		} else {
+			dropped++
+		}
+		if d.done != nil {
+			d.done <- err
+		}
+	}
+	if dropped > 0 {
+		log.WithFields(q.fields).WithFields(log.Fields{"dropped": dropped}).Warning("Dropped the queued deliveries on shutdown")
+	}
+}
+
+// deliver tries to deliver the payload, retrying with exponential backoff on failure
+func (q *deliveryQueue) deliver(d delivery) error {
+	var err error
+	backoff := q.backoff
+	for attempt := 0; attempt <= q.maxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-q.ctx.Done():
+				return errDeliveryStopped
+			}
+			backoff *= 2
+			if backoff > deliveryMaxBackoff {
+				backoff = deliveryMaxBackoff
+			}
+		}
+		var retry bool
+		retry, err = q.send(d)
+		if err == nil {
+			log.WithFields(q.fields).WithFields(d.fields).Debug("Delivered")
+			return nil
+		}
+		log.WithFields(q.fields).WithFields(d.fields).WithFields(log.Fields{"error": err.Error(), "attempt": attempt + 1}).Warning("Delivery failed")
+		if !retry {
+			break
+		}
+	}
+	log.WithFields(q.fields).WithFields(d.fields).Error("Giving up delivery")
+	return err
+}
+
+// send makes a single delivery attempt. The returned bool tells if the attempt is worth retrying.
+func (q *deliveryQueue) send(d delivery) (bool, error) {
+	req, err := http.NewRequestWithContext(q.ctx, "POST", q.url, bytes.NewReader(d.payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "acme-dns")
+	for k, v := range d.header {
+		req.Header[k] = v
+	}
+	if q.sign != nil {
+		q.sign(req, d.payload)
+	}
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	// Client errors other than rate limiting will not go away by retrying
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeliveryQueueStopDeadline(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	q := newDeliveryQueue(server.URL, 10, 5, 8, nil)
+	q.Start()
+	results := make([]chan error, 3)
+	for i := range results {
+		results[i] = make(chan error, 1)
+		if err := q.Enqueue(delivery{payload: []byte("{}"), done: results[i]}); err != nil {
+			t.Fatalf("Could not queue delivery %d: %v", i, err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	q.Stop(ctx)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected Stop to return after the deadline, took %s", elapsed)
+	}
+	for i, r := range results {
+		if err := <-r; err == nil {
+			t.Errorf("Delivery %d: expected an error for a delivery dropped on stop", i)
+		}
+	}
+}
+
+func TestDeliveryQueueEnqueueAfterStop(t *testing.T) {
+	q := newDeliveryQueue("http://127.0.0.1:1", 1, 0, 8, nil)
+	q.Start()
+	q.Stop(context.Background())
+	if err := q.Enqueue(delivery{payload: []byte("{}")}); err != errDeliveryStopped {
+		t.Errorf("Expected the delivery to be dropped after stop, got %v", err)
+	}
+	// Stopping again is harmless
+	q.Stop(context.Background())
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// sqlDialect holds the engine specific SQL of a database backend. The statements shared by all the
+// engines are written with PostgreSQL style placeholders ($1, $2, ...) and rewritten with Rebind.
+type sqlDialect struct {
+	Name string
+	// Schema DDL
+	AcmeTable string
+	UserTable string
+	TxtTable  string
+	// UpdateTXT replaces the value of the least recently updated TXT row of a subdomain
+	UpdateTXT string
+	// UpgradeDropColumns drops the columns removed in database version 1, if the engine supports it
+	UpgradeDropColumns []string
+	// Migrations are the schema migration steps in version order
+	Migrations []migration
+	// LockMigrations and UnlockMigrations take and release a session lock preventing concurrent
+	// migrations. Engines without them rely on the migration transactions for serializing. The
+	// lock query returns 1 when the lock is taken, 0 on a timeout and NULL on an error.
+	LockMigrations   string
+	UnlockMigrations string
+	// Rebind rewrites the placeholders of a statement for the engine
+	Rebind func(string) string
+	// Connection adds the engine defaults to the connection string
+	Connection func(string) string
+	// NotifyTXT notifies the other instances of a TXT change, if the engine supports it
+	NotifyTXT string
+	// ForUpdate locks the selected rows for the transaction, if the engine supports it
+	ForUpdate string
+	// SingleWriter is set for engines that allow only a single writer at a time
+	SingleWriter bool
+	// ColumnExists counts the columns of a table ($1) by name ($2), for engines committing DDL
+	// statements implicitly, so the migrations can skip the columns added already
+	ColumnExists string
+}
+
+var placeholderRegexp = regexp.MustCompile(`\$[0-9]+`)
+
+// rebindQuestion replaces all PostgreSQL prepared statement placeholders (eg. $1, $2) with the "?" variant
+func rebindQuestion(s string) string {
+	return placeholderRegexp.ReplaceAllString(s, "?")
+}
+
+func rebindNone(s string) string {
+	return s
+}
+
+func connectionNone(s string) string {
+	return s
+}
+
+var acmeTable = `
+	CREATE TABLE IF NOT EXISTS acmedns(
+		Name TEXT,
+		Value TEXT
+	);`
+
+var userTable = `
+	CREATE TABLE IF NOT EXISTS records(
+        Username TEXT UNIQUE NOT NULL PRIMARY KEY,
+        Password TEXT UNIQUE NOT NULL,
+        Subdomain TEXT UNIQUE NOT NULL,
+		AllowFrom TEXT
+    );`
+
+var txtTable = `
+    CREATE TABLE IF NOT EXISTS txt(
+		Subdomain TEXT NOT NULL,
+		Value   TEXT NOT NULL DEFAULT '',
+		LastUpdate INT
+	);`
+
+var txtTablePG = `
+    CREATE TABLE IF NOT EXISTS txt(
+		rowid SERIAL,
+		Subdomain TEXT NOT NULL,
+		Value   TEXT NOT NULL DEFAULT '',
+		LastUpdate INT
+	);`
+
+// MySQL can not index TEXT columns without a prefix length, or have defaults for them
+var acmeTableMySQL = `
+	CREATE TABLE IF NOT EXISTS acmedns(
+		Name VARCHAR(255),
+		Value TEXT
+	)`
+
+var userTableMySQL = `
+	CREATE TABLE IF NOT EXISTS records(
+		Username VARCHAR(36) NOT NULL PRIMARY KEY,
+		Password VARCHAR(255) UNIQUE NOT NULL,
+		Subdomain VARCHAR(255) UNIQUE NOT NULL,
+		AllowFrom TEXT
+	)`
+
+var txtTableMySQL = `
+	CREATE TABLE IF NOT EXISTS txt(
+		rowid INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		Subdomain VARCHAR(255) NOT NULL,
+		Value VARCHAR(255) NOT NULL DEFAULT '',
+		LastUpdate BIGINT,
+		INDEX txt_subdomain (Subdomain)
+	)`
+
+var updateTXT = `
+	UPDATE txt SET Value=$1, LastUpdate=$2
+	WHERE rowid=(
+		SELECT rowid FROM txt WHERE Subdomain=$3 ORDER BY LastUpdate LIMIT 1)
+	`
+
+// MySQL does not allow a subquery on the table being updated
+var updateTXTMySQL = `
+	UPDATE txt SET Value=$1, LastUpdate=$2
+	WHERE Subdomain=$3 ORDER BY LastUpdate LIMIT 1
+	`
+
+var dialectSQLite = &sqlDialect{
+	Name:       "sqlite3",
+	AcmeTable:  acmeTable,
+	UserTable:  userTable,
+	TxtTable:   txtTable,
+	UpdateTXT:  updateTXT,
+	Rebind:     rebindQuestion,
+	Connection: sqliteConnection,
+	// SQLite doesn't support dropping columns
+	UpgradeDropColumns: nil,
+	Migrations:         migrationsSQLite,
+	SingleWriter:       true,
+}
+
+var dialectPostgres = &sqlDialect{
+	Name:       "postgres",
+	AcmeTable:  acmeTable,
+	UserTable:  userTable,
+	TxtTable:   txtTablePG,
+	UpdateTXT:  updateTXT,
+	Rebind:     rebindNone,
+	Connection: connectionNone,
+	UpgradeDropColumns: []string{
+		"ALTER TABLE records DROP COLUMN IF EXISTS Value",
+		"ALTER TABLE records DROP COLUMN IF EXISTS LastActive",
+	},
+	NotifyTXT:        "SELECT pg_notify('" + txtNotifyChannel + "', $1)",
+	ForUpdate:        " FOR UPDATE",
+	Migrations:       migrationsPostgres,
+	LockMigrations:   "SELECT 1 FROM pg_advisory_lock(" + migrationLockID + ")",
+	UnlockMigrations: "SELECT pg_advisory_unlock(" + migrationLockID + ")",
+}
+
+var dialectMySQL = &sqlDialect{
+	Name:       "mysql",
+	AcmeTable:  acmeTableMySQL,
+	UserTable:  userTableMySQL,
+	TxtTable:   txtTableMySQL,
+	UpdateTXT:  updateTXTMySQL,
+	Rebind:     rebindQuestion,
+	Connection: connectionNone,
+	// Databases created by acme-dns for MySQL never had the columns removed in version 1
+	UpgradeDropColumns: nil,
+	ForUpdate:          " FOR UPDATE",
+	Migrations:         migrationsMySQL,
+	LockMigrations:     "SELECT GET_LOCK('acme-dns-migrations', 60)",
+	UnlockMigrations:   "SELECT RELEASE_LOCK('acme-dns-migrations')",
+	ColumnExists:       "SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA=DATABASE() AND TABLE_NAME=$1 AND COLUMN_NAME=$2",
+}
+
+// migrationLockID is the PostgreSQL advisory lock key of the migrations
+const migrationLockID = "7366782450273918263"
+
+var dialects = map[string]*sqlDialect{
+	"sqlite3":  dialectSQLite,
+	"postgres": dialectPostgres,
+	"mysql":    dialectMySQL,
+}
+
+// getDialect returns the SQL dialect of the database engine. For backwards compatibility, unknown
+// engines are handled as PostgreSQL.
+func getDialect(engine string) *sqlDialect {
+	if d, ok := dialects[engine]; ok {
+		return d
+	}
+	return dialectPostgres
+}
+
+// SQLite connection parameters: write-ahead logging lets readers work concurrently with the writer,
+// and the busy timeout makes concurrent writers wait for the lock instead of failing
+var sqliteParams = [][2]string{
+	{"_journal_mode", "WAL"},
+	{"_busy_timeout", "5000"},
+	{"_txlock", "immediate"},
+}
+
+// sqliteConnection adds the default connection parameters to the SQLite connection string
+func sqliteConnection(connection string) string {
+	if isSQLiteMemory(connection) {
+		return connection
+	}
+	var params []string
+	for _, p := range sqliteParams {
+		if !strings.Contains(connection, p[0]+"=") {
+			params = append(params, p[0]+"="+p[1])
+		}
+	}
+	if len(params) == 0 {
+		return connection
+	}
+	sep := "?"
+	if strings.Contains(connection, "?") {
+		sep = "&"
+	}
+	return connection + sep + strings.Join(params, "&")
+}
+
+// isSQLiteMemory checks if the SQLite connection string points to an in-memory database
+func isSQLiteMemory(connection string) bool {
+	return strings.Contains(connection, ":memory:") || strings.Contains(connection, "mode=memory")
+}
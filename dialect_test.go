@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRebindQuestion(t *testing.T) {
+	for i, test := range []struct {
+		input    string
+		expected string
+	}{
+		{"SELECT Value FROM txt WHERE Subdomain=$1 LIMIT 2", "SELECT Value FROM txt WHERE Subdomain=? LIMIT 2"},
+		{"UPDATE txt SET Value=$1, LastUpdate=$2 WHERE Subdomain=$3", "UPDATE txt SET Value=?, LastUpdate=? WHERE Subdomain=?"},
+		{"INSERT INTO t VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)", "INSERT INTO t VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"},
+		{"SELECT 1", "SELECT 1"},
+	} {
+		if ret := rebindQuestion(test.input); ret != test.expected {
+			t.Errorf("Test %d: Expected [%s] but got [%s]", i, test.expected, ret)
+		}
+	}
+}
+
+func TestGetDialect(t *testing.T) {
+	for i, test := range []struct {
+		engine   string
+		expected *sqlDialect
+	}{
+		{"sqlite3", dialectSQLite},
+		{"postgres", dialectPostgres},
+		{"mysql", dialectMySQL},
+		{"testdb", dialectPostgres},
+	} {
+		if ret := getDialect(test.engine); ret != test.expected {
+			t.Errorf("Test %d: Expected dialect [%s] but got [%s]", i, test.expected.Name, ret.Name)
+		}
+	}
+}
+
+func TestDialectsComplete(t *testing.T) {
+	for name, d := range dialects {
+		if d.Name != name {
+			t.Errorf("Dialect registered as [%s] has name [%s]", name, d.Name)
+		}
+		if d.AcmeTable == "" || d.UserTable == "" || d.TxtTable == "" || d.UpdateTXT == "" {
+			t.Errorf("Dialect [%s] is missing schema or statements", name)
+		}
+		if d.Rebind == nil || d.Connection == nil {
+			t.Errorf("Dialect [%s] is missing functions", name)
+		}
+		if d.Rebind != nil && d.Rebind("$1") == "?" && placeholderRegexp.MatchString(d.Rebind(d.UpdateTXT)) {
+			t.Errorf("Dialect [%s] left placeholders in the statement", name)
+		}
+	}
+}
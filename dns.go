@@ -2,10 +2,13 @@ package main
 
 import (
 	"fmt"
-	"github.com/miekg/dns"
-	log "github.com/sirupsen/logrus"
+	"net"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
 )
 
 // Records is a slice of ResourceRecords
@@ -13,14 +16,27 @@ type Records struct {
 	Records []dns.RR
 }
 
+// DNSZone is a zone served by the DNS server
+type DNSZone struct {
+	// Name is the fully qualified domain name of the zone
+	Name string
+	// Key is the zone the accounts of the zone are stored with, empty for the default zone
+	Key string
+	SOA dns.RR
+}
+
 // DNSServer is the main struct for acme-dns DNS server
 type DNSServer struct {
-	DB              database
-	Domain          string
-	Server          *dns.Server
-	SOA             dns.RR
-	PersonalKeyAuth string
-	Domains         map[string]Records
+	DB      database
+	Domain  string
+	Server  *dns.Server
+	SOA     dns.RR
+	Zones   []DNSZone
+	Domains map[string]Records
+	// ownChallenges are the key authorizations of the active ACME challenges of the API certificate
+	ownChallenges *ownChallengeStore
+	// mu guards Domains, SOA and Zones, which are replaced when the records are reloaded
+	mu sync.RWMutex
 }
 
 // NewDNSServer parses the DNS records from config and returns a new DNSServer struct
@@ -32,8 +48,8 @@ func NewDNSServer(db database, addr string, proto string, domain string) *DNSSer
 	}
 	server.Domain = strings.ToLower(domain)
 	server.DB = db
-	server.PersonalKeyAuth = ""
 	server.Domains = make(map[string]Records)
+	server.ownChallenges = newOwnChallengeStore()
 	return &server
 }
 
@@ -48,46 +64,130 @@ func (d *DNSServer) Start(errorChannel chan error) {
 	}
 }
 
-// ParseRecords parses a slice of DNS record string
+// ParseRecords loads the static records, the zone files and the SOA records of the zones in
+// config. Errors are logged, and the current records are kept on failure.
 func (d *DNSServer) ParseRecords(config DNSConfig) {
-	for _, v := range config.General.StaticRecords {
-		rr, err := dns.NewRR(strings.ToLower(v))
-		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error(), "rr": v}).Warning("Could not parse RR from config")
-			continue
-		}
-		// Add parsed RR
-		d.appendRR(rr)
+	if err := d.LoadRecords(config); err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Could not load the DNS records")
 	}
+}
+
+// LoadRecords parses the static records, the zone files and the SOA records of the zones in
+// config, and replaces the records served with them. The current records are kept if a zone
+// file or a SOA record is invalid, or if the records of the zone files conflict.
+func (d *DNSServer) LoadRecords(config DNSConfig) error {
+	zr, err := parseZoneRecords(config)
+	if err != nil {
+		return err
+	}
+	d.setRecords(zr)
+	return nil
+}
+
+// zoneRecords holds the parsed records of the zones. It is not modified after parsing, so the
+// DNS servers can share it.
+type zoneRecords struct {
+	domains map[string]Records
+	zones   []DNSZone
+	soa     dns.RR
+}
+
+// parseZoneRecords parses the static records, the zone files and the SOA records of the zones
+func parseZoneRecords(config DNSConfig) (zoneRecords, error) {
+	domains := make(map[string]Records)
+	// The records of the zone files are validated on their own, the static records of the
+	// configuration are served as they are
+	fileDomains := make(map[string]Records)
+	var zones []DNSZone
+	var defaultSOA dns.RR
 	// Create serial
 	serial := time.Now().Format("2006010215")
-	// Add SOA
-	SOAstring := fmt.Sprintf("%s. SOA %s. %s. %s 28800 7200 604800 86400", strings.ToLower(config.General.Domain), strings.ToLower(config.General.Nsname), strings.ToLower(config.General.Nsadmin), serial)
-	soarr, err := dns.NewRR(SOAstring)
-	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error(), "soa": SOAstring}).Error("Error while adding SOA record")
-	} else {
-		d.appendRR(soarr)
-		d.SOA = soarr
+	for i, zone := range configZones(config) {
+		z := DNSZone{Name: dns.Fqdn(normalizeZoneName(zone.Domain))}
+		if i > 0 {
+			z.Key = normalizeZoneName(zone.Domain)
+		}
+		for _, v := range zone.StaticRecords {
+			rr, err := dns.NewRR(strings.ToLower(v))
+			if err != nil {
+				log.WithFields(log.Fields{"error": err.Error(), "rr": v}).Warning("Could not parse RR from config")
+				continue
+			}
+			// Add parsed RR
+			appendRR(domains, rr)
+		}
+		if zone.Zonefile != "" {
+			rrs, err := parseZoneFile(zone.Zonefile, z.Name)
+			if err != nil {
+				return zoneRecords{}, err
+			}
+			for _, rr := range rrs {
+				if rr.Header().Rrtype == dns.TypeSOA && rr.Header().Name == z.Name {
+					z.SOA = rr
+				}
+				appendRR(domains, rr)
+				appendRR(fileDomains, rr)
+			}
+		}
+		if z.SOA == nil {
+			// Add SOA
+			SOAstring := fmt.Sprintf("%s SOA %s. %s. %s 28800 7200 604800 86400", z.Name, strings.ToLower(zone.Nsname), strings.ToLower(zone.Nsadmin), serial)
+			soarr, err := dns.NewRR(SOAstring)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err.Error(), "soa": SOAstring}).Error("Error while adding SOA record")
+				return zoneRecords{}, fmt.Errorf("invalid SOA record of zone %s: %v", z.Name, err)
+			}
+			appendRR(domains, soarr)
+			z.SOA = soarr
+		}
+		if i == 0 {
+			defaultSOA = z.SOA
+		}
+		zones = append(zones, z)
+	}
+	if err := validateRecords(fileDomains); err != nil {
+		return zoneRecords{}, err
 	}
+	if err := validateRecords(domains); err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Warning("Conflicting records in the configuration")
+	}
+	return zoneRecords{domains: domains, zones: zones, soa: defaultSOA}, nil
 }
 
-func (d *DNSServer) appendRR(rr dns.RR) {
-	addDomain := rr.Header().Name
-	_, ok := d.Domains[addDomain]
-	if !ok {
-		d.Domains[addDomain] = Records{[]dns.RR{rr}}
-	} else {
-		drecs := d.Domains[addDomain]
-		drecs.Records = append(drecs.Records, rr)
-		d.Domains[addDomain] = drecs
+// setRecords replaces the records served
+func (d *DNSServer) setRecords(zr zoneRecords) {
+	d.mu.Lock()
+	d.Domains, d.Zones, d.SOA = zr.domains, zr.zones, zr.soa
+	d.mu.Unlock()
+}
+
+// findZone returns the most specific zone the name belongs to, or nil if the name is not in
+// any of the zones
+func (d *DNSServer) findZone(name string) *DNSZone {
+	name = dns.Fqdn(strings.ToLower(name))
+	var found *DNSZone
+	for i := range d.Zones {
+		z := &d.Zones[i]
+		if dns.IsSubDomain(z.Name, name) && (found == nil || len(z.Name) > len(found.Name)) {
+			found = z
+		}
 	}
+	return found
+}
+
+func appendRR(domains map[string]Records, rr dns.RR) {
+	addDomain := rr.Header().Name
+	drecs := domains[addDomain]
+	drecs.Records = append(drecs.Records, rr)
+	domains[addDomain] = drecs
 	log.WithFields(log.Fields{"recordtype": dns.TypeToString[rr.Header().Rrtype], "domain": addDomain}).Debug("Adding new record to domain")
 }
 
 func (d *DNSServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 	m := new(dns.Msg)
 	m.SetReply(r)
+	resolver := resolverIP(w.RemoteAddr())
+	probe := isVisibilityProbe(r)
 
 	// handle edns0
 	opt := r.IsEdns0()
@@ -100,23 +200,42 @@ func (d *DNSServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 			// We can safely do this as we know that we're not setting other OPT RRs within acme-dns.
 			m.SetEdns0(512, false)
 			if r.Opcode == dns.OpcodeQuery {
-				d.readQuery(m)
+				d.readQuery(m, resolver, probe)
 			}
 		}
 	} else {
 		if r.Opcode == dns.OpcodeQuery {
-			d.readQuery(m)
+			d.readQuery(m, resolver, probe)
 		}
 	}
 	_ = w.WriteMsg(m)
 }
 
-func (d *DNSServer) readQuery(m *dns.Msg) {
+// readQuery answers the questions of the query from the resolver. The lookups of the visibility
+// probes of acme-dns itself are not recorded or notified.
+func (d *DNSServer) readQuery(m *dns.Msg, resolver string, probe bool) {
+	events := d.answerQuery(m, resolver, probe)
+	// The webhooks are notified without holding the lock of the records
+	for _, e := range events {
+		Webhooks.Notify(e)
+	}
+}
+
+// answerQuery fills in the answer to the query, and returns the lookup events of the served TXT
+// values
+func (d *DNSServer) answerQuery(m *dns.Msg, resolver string, probe bool) []WebhookEvent {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var events []WebhookEvent
 	var authoritative = false
+	soa := d.SOA
 	for _, que := range m.Question {
-		if rr, rc, auth, err := d.answer(que); err == nil {
+		if rr, rc, auth, err := d.answer(que, resolver, probe, &events); err == nil {
 			if auth {
 				authoritative = auth
+				if z := d.findZone(que.Name); z != nil {
+					soa = z.SOA
+				}
 			}
 			m.MsgHdr.Rcode = rc
 			m.Answer = append(m.Answer, rr...)
@@ -125,9 +244,10 @@ func (d *DNSServer) readQuery(m *dns.Msg) {
 	m.MsgHdr.Authoritative = authoritative
 	if authoritative {
 		if m.MsgHdr.Rcode == dns.RcodeNameError {
-			m.Ns = append(m.Ns, d.SOA)
+			m.Ns = append(m.Ns, soa)
 		}
 	}
+	return events
 }
 
 func (d *DNSServer) getRecord(q dns.Question) ([]dns.RR, error) {
@@ -151,15 +271,29 @@ func (d *DNSServer) getRecord(q dns.Question) ([]dns.RR, error) {
 	return rr, nil
 }
 
-// answeringForDomain checks if we have any records for a domain
+// answeringForDomain checks if the domain is one of the zones or we have any records for it
 func (d *DNSServer) answeringForDomain(name string) bool {
-	if d.Domain == strings.ToLower(name) {
+	if d.isZone(name) {
 		return true
 	}
 	_, ok := d.Domains[strings.ToLower(name)]
 	return ok
 }
 
+// isZone checks if the domain is the default zone or one of the additional zones
+func (d *DNSServer) isZone(domain string) bool {
+	domain = strings.ToLower(domain)
+	if domain == d.Domain {
+		return true
+	}
+	for _, z := range d.Zones {
+		if domain == z.Name {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *DNSServer) isAuthoritative(q dns.Question) bool {
 	if d.answeringForDomain(q.Name) {
 		return true
@@ -173,8 +307,12 @@ func (d *DNSServer) isAuthoritative(q dns.Question) bool {
 	return false
 }
 
-// isOwnChallenge checks if the query is for the domain of this acme-dns instance. Used for answering its own ACME challenges
+// isOwnChallenge checks if the query is for the domain of one of the zones of this acme-dns instance, or for
+// a pending challenge of the API certificate. Used for answering its own ACME challenges
 func (d *DNSServer) isOwnChallenge(name string) bool {
+	if d.ownChallenges.Has(name) {
+		return true
+	}
 	domainParts := strings.SplitN(name, ".", 2)
 	if len(domainParts) == 2 {
 		if strings.ToLower(domainParts[0]) == "_acme-challenge" {
@@ -182,7 +320,7 @@ func (d *DNSServer) isOwnChallenge(name string) bool {
 			if !strings.HasSuffix(domain, ".") {
 				domain = domain + "."
 			}
-			if domain == d.Domain {
+			if d.isZone(domain) {
 				return true
 			}
 		}
@@ -190,7 +328,7 @@ func (d *DNSServer) isOwnChallenge(name string) bool {
 	return false
 }
 
-func (d *DNSServer) answer(q dns.Question) ([]dns.RR, int, bool, error) {
+func (d *DNSServer) answer(q dns.Question, resolver string, probe bool, events *[]WebhookEvent) ([]dns.RR, int, bool, error) {
 	var rcode int
 	var err error
 	var txtRRs []dns.RR
@@ -203,7 +341,7 @@ func (d *DNSServer) answer(q dns.Question) ([]dns.RR, int, bool, error) {
 		if d.isOwnChallenge(q.Name) {
 			txtRRs, err = d.answerOwnChallenge(q)
 		} else {
-			txtRRs, err = d.answerTXT(q)
+			txtRRs, err = d.answerTXT(q, resolver, probe, events)
 		}
 		if err == nil {
 			r = append(r, txtRRs...)
@@ -217,10 +355,15 @@ func (d *DNSServer) answer(q dns.Question) ([]dns.RR, int, bool, error) {
 	return r, rcode, authoritative, nil
 }
 
-func (d *DNSServer) answerTXT(q dns.Question) ([]dns.RR, error) {
+func (d *DNSServer) answerTXT(q dns.Question, resolver string, probe bool, events *[]WebhookEvent) ([]dns.RR, error) {
 	var ra []dns.RR
+	var served []string
 	subdomain := sanitizeDomainQuestion(q.Name)
-	atxt, err := d.DB.GetTXTForDomain(subdomain)
+	zone := ""
+	if z := d.findZone(q.Name); z != nil {
+		zone = z.Key
+	}
+	atxt, err := d.DB.GetTXTForDomain(subdomain, zone)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get record")
 		return ra, err
@@ -231,15 +374,45 @@ func (d *DNSServer) answerTXT(q dns.Question) ([]dns.RR, error) {
 			r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 1}
 			r.Txt = append(r.Txt, v)
 			ra = append(ra, r)
+			served = append(served, v)
+		}
+	}
+	if len(served) > 0 && !probe {
+		Lookups.Record(subdomain, served, resolver)
+		if events != nil {
+			*events = append(*events, WebhookEvent{
+				Event:      webhookEventLookup,
+				Subdomain:  subdomain,
+				Fulldomain: strings.TrimSuffix(strings.ToLower(q.Name), "."),
+				TXT:        served,
+				Resolver:   resolver,
+			})
 		}
 	}
 	return ra, nil
 }
 
-// answerOwnChallenge answers to ACME challenge for acme-dns own certificate
+// resolverIP returns the IP address part of the address of a querying resolver
+func resolverIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// answerOwnChallenge answers to ACME challenge for acme-dns own certificate, with a record for each
+// active challenge of the name
 func (d *DNSServer) answerOwnChallenge(q dns.Question) ([]dns.RR, error) {
-	r := new(dns.TXT)
-	r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 1}
-	r.Txt = append(r.Txt, d.PersonalKeyAuth)
-	return []dns.RR{r}, nil
+	var ra []dns.RR
+	for _, keyAuth := range d.ownChallenges.Values(q.Name) {
+		r := new(dns.TXT)
+		r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 1}
+		r.Txt = append(r.Txt, keyAuth)
+		ra = append(ra, r)
+	}
+	return ra, nil
 }
@@ -66,7 +66,7 @@ func TestQuestionDBError(t *testing.T) {
 	defer DB.SetBackend(oldDb)
 
 	q := dns.Question{Name: dns.Fqdn("whatever.tld"), Qtype: dns.TypeTXT, Qclass: dns.ClassINET}
-	_, err = dnsserver.answerTXT(q)
+	_, err = dnsserver.answerTXT(q, "", false, nil)
 	if err == nil {
 		t.Errorf("Expected error but got none")
 	}
@@ -199,13 +199,13 @@ func TestResolveTXT(t *testing.T) {
 	resolv := resolver{server: "127.0.0.1:15353"}
 	validTXT := "______________valid_response_______________"
 
-	atxt, err := DB.Register(cidrslice{})
+	atxt, err := DB.Register(cidrslice{}, "")
 	if err != nil {
 		t.Errorf("Could not initiate db record: [%v]", err)
 		return
 	}
 	atxt.Value = validTXT
-	err = DB.Update(atxt.ACMETxtPost)
+	_, err = DB.Update(atxt.ACMETxtPost)
 	if err != nil {
 		t.Errorf("Could not update db record: [%v]", err)
 		return
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// dohMessageType is the media type of the DNS messages of DNS over HTTPS
+const dohMessageType = "application/dns-message"
+
+// dohHandler returns the handler of the DNS over HTTPS (RFC 8484) queries, sent as the "dns"
+// parameter of a GET request or as the body of a POST request
+func (d *DNSServer) dohHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, func(w http.ResponseWriter, r *http.Request) {
+		var packed []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			packed, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dohMessageType {
+				http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			packed, err = io.ReadAll(http.MaxBytesReader(w, r.Body, dns.MaxMsgSize))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		msg := new(dns.Msg)
+		if err != nil || len(packed) == 0 || msg.Unpack(packed) != nil {
+			http.Error(w, "malformed query", http.StatusBadRequest)
+			return
+		}
+		rw := &dohResponseWriter{remote: remoteAddr(r.RemoteAddr)}
+		d.handleRequest(rw, msg)
+		if rw.reply == nil {
+			http.Error(w, "no reply", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohMessageType)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(rw.reply)
+	})
+	return mux
+}
+
+// remoteAddr returns the address of the client of a HTTP request
+func remoteAddr(addr string) net.Addr {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+// dohResponseWriter collects the reply of the DNS server to a DNS over HTTPS query
+type dohResponseWriter struct {
+	remote net.Addr
+	reply  []byte
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	packed, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	w.reply = packed
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	w.reply = append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigStatus() error {
+	return errors.New("TSIG is not supported")
+}
+
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+
+func (w *dohResponseWriter) Hijack() {}
@@ -10,6 +10,7 @@ require (
 	github.com/erikstmartin/go-testdb v0.0.0-20160219214506-8d10e4a1bae5
 	github.com/gavv/httpexpect v2.0.0+incompatible
 	github.com/go-acme/lego/v3 v3.9.0
+	github.com/go-sql-driver/mysql v1.8.1
 	github.com/google/uuid v1.6.0
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/lib/pq v1.10.9
@@ -18,10 +19,12 @@ require (
 	github.com/miekg/dns v1.1.62
 	github.com/rs/cors v1.11.1
 	github.com/sirupsen/logrus v1.9.3
+	go.etcd.io/bbolt v1.3.11
 	golang.org/x/crypto v0.31.0
 )
 
 require (
+	filippo.io/edwards25519 v1.1.0 // indirect
 	github.com/ajg/form v1.5.1 // indirect
 	github.com/andybalholm/brotli v1.0.2 // indirect
 	github.com/caddyserver/zerossl v0.1.3 // indirect
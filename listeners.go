@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// listenerRetryMin is the time waited before the first restart of a failed DNS listener
+	listenerRetryMin = time.Second
+	// listenerRetryMax is the longest time waited between the restarts of a failed DNS listener
+	listenerRetryMax = time.Minute
+	// dohPath is the path of the DNS over HTTPS endpoint
+	dohPath = "/dns-query"
+)
+
+// errListenerStopped is returned when binding a listener that has been shut down
+var errListenerStopped = errors.New("listener stopped")
+
+// dnsListenerProtocols are the protocols of the DNS listeners. The "both" protocols are split
+// to an UDP and a TCP listener.
+var dnsListenerProtocols = map[string]bool{
+	"udp": true, "udp4": true, "udp6": true,
+	"tcp": true, "tcp4": true, "tcp6": true,
+	"both": true, "both4": true, "both6": true,
+	"dot": true, "doh": true,
+}
+
+// prepareListenerConfig validates the DNS listeners
+func prepareListenerConfig(listeners []listenerconfig) ([]listenerconfig, error) {
+	seen := make(map[string]bool)
+	for i := range listeners {
+		lc := &listeners[i]
+		lc.Protocol = strings.ToLower(lc.Protocol)
+		if lc.Address == "" {
+			return listeners, errors.New("missing listener configuration option \"address\"")
+		}
+		if !dnsListenerProtocols[lc.Protocol] {
+			return listeners, fmt.Errorf("invalid protocol %q of listener %s", lc.Protocol, lc.Address)
+		}
+		if (lc.Protocol == "dot" || lc.Protocol == "doh") && (lc.TLSCertFullchain == "" || lc.TLSCertPrivkey == "") {
+			return listeners, fmt.Errorf("missing listener configuration option \"tls_cert_fullchain\" or \"tls_cert_privkey\" for listener %s", lc.Address)
+		}
+		for _, s := range splitListener(*lc) {
+			key := s.Address + "/" + s.transport()
+			if seen[key] {
+				return listeners, fmt.Errorf("listener %s %s is configured more than once", s.Address, s.Protocol)
+			}
+			seen[key] = true
+		}
+	}
+	return listeners, nil
+}
+
+// configListeners returns the DNS listeners, with the "both" protocols split to an UDP and a TCP
+// listener. A listener is made of the listen address and the protocol of the general section if
+// no listeners are configured.
+func configListeners(config DNSConfig) []listenerconfig {
+	listeners := config.Listeners
+	if len(listeners) == 0 {
+		lc := listenerconfig{Address: config.General.Listen, Protocol: strings.ToLower(config.General.Proto)}
+		if lc.Address == "" {
+			lc.Address = ":53"
+		}
+		if lc.Protocol == "" {
+			lc.Protocol = "udp"
+		}
+		listeners = []listenerconfig{lc}
+	}
+	var split []listenerconfig
+	for _, lc := range listeners {
+		split = append(split, splitListener(lc)...)
+	}
+	return split
+}
+
+// splitListener splits a listener of a "both" protocol to an UDP and a TCP listener
+func splitListener(lc listenerconfig) []listenerconfig {
+	if !strings.HasPrefix(lc.Protocol, "both") {
+		return []listenerconfig{lc}
+	}
+	udp, tcp := lc, lc
+	udp.Protocol = strings.Replace(lc.Protocol, "both", "udp", 1)
+	tcp.Protocol = strings.Replace(lc.Protocol, "both", "tcp", 1)
+	return []listenerconfig{udp, tcp}
+}
+
+// transport returns the network the listener binds: udp or tcp
+func (lc listenerconfig) transport() string {
+	if strings.HasPrefix(lc.Protocol, "udp") {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// network returns the network of the listener socket, like "udp6"
+func (lc listenerconfig) network() string {
+	if lc.Protocol == "dot" || lc.Protocol == "doh" {
+		return "tcp"
+	}
+	return lc.Protocol
+}
+
+// dnsListener serves the DNS server on one listen address and protocol. The listener is restarted
+// if it fails, independently of the other listeners.
+type dnsListener struct {
+	config listenerconfig
+	server *DNSServer
+	certs  *certReloader
+
+	mu      sync.Mutex
+	stopped bool
+	done    chan struct{}
+	// The bound sockets, before they are handed to a server
+	pc net.PacketConn
+	ln net.Listener
+	// The running server
+	dnsServer  *dns.Server
+	httpServer *http.Server
+}
+
+func newDNSListener(config listenerconfig, server *DNSServer) *dnsListener {
+	return &dnsListener{config: config, server: server, done: make(chan struct{})}
+}
+
+// LoadCertificate loads the certificate of a DNS over TLS or DNS over HTTPS listener
+func (l *dnsListener) LoadCertificate() error {
+	if l.config.Protocol != "dot" && l.config.Protocol != "doh" {
+		return nil
+	}
+	certs, err := newCertReloader(l.config.TLSCertFullchain, l.config.TLSCertPrivkey)
+	if err != nil {
+		return err
+	}
+	l.certs = certs
+	return nil
+}
+
+// Listen binds the socket of the listener, unless it has a socket passed by systemd already
+func (l *dnsListener) Listen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return errListenerStopped
+	}
+	if l.pc != nil || l.ln != nil {
+		return nil
+	}
+	if l.config.transport() == "udp" {
+		pc, err := net.ListenPacket(l.config.network(), l.config.Address)
+		if err != nil {
+			return err
+		}
+		l.pc = pc
+		return nil
+	}
+	ln, err := net.Listen(l.config.network(), l.config.Address)
+	if err != nil {
+		return err
+	}
+	l.ln = ln
+	return nil
+}
+
+// Run serves the listener until it is shut down. A listener that could not be bound, or that
+// fails, is restarted with an increasing delay, unless it has a privileged port and the
+// privileges have been dropped.
+func (l *dnsListener) Run() {
+	retry := listenerRetryMin
+	fields := log.Fields{"addr": l.config.Address, "proto": l.config.Protocol}
+	for {
+		err := l.Listen()
+		if err == nil {
+			started := time.Now()
+			err = l.serve()
+			if time.Since(started) > listenerRetryMax {
+				// Failing after a long run is not a failure to start
+				retry = listenerRetryMin
+			}
+		}
+		if l.isStopped() {
+			return
+		}
+		if err == nil {
+			err = errors.New("server stopped")
+		}
+		if privilegesDropped.Load() && privilegedPort(l.config.Address) {
+			log.WithFields(fields).WithFields(log.Fields{"error": err.Error()}).Error("DNS listener failed, a privileged port can not be bound again after dropping the privileges")
+			return
+		}
+		log.WithFields(fields).WithFields(log.Fields{"error": err.Error(), "retry": retry.String()}).Error("DNS listener failed, restarting")
+		select {
+		case <-l.done:
+			return
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > listenerRetryMax {
+			retry = listenerRetryMax
+		}
+	}
+}
+
+// serve hands the bound socket to a new server, and serves until the server stops
+func (l *dnsListener) serve() error {
+	l.mu.Lock()
+	if l.stopped {
+		l.mu.Unlock()
+		return nil
+	}
+	pc, ln := l.pc, l.ln
+	// The servers close the sockets when they stop
+	l.pc, l.ln = nil, nil
+	fields := log.Fields{"addr": l.config.Address, "proto": l.config.Protocol}
+	if l.config.Protocol == "doh" {
+		l.httpServer = &http.Server{
+			Handler:   l.server.dohHandler(),
+			TLSConfig: l.tlsConfig(),
+		}
+		srv := l.httpServer
+		l.mu.Unlock()
+		log.WithFields(fields).Info("Listening DNS")
+		err := srv.ServeTLS(ln, "", "")
+		if isServerClosed(err) {
+			return nil
+		}
+		return err
+	}
+	srv := &dns.Server{
+		Addr:       l.config.Address,
+		Net:        l.config.network(),
+		PacketConn: pc,
+		Listener:   ln,
+		Handler:    dns.HandlerFunc(l.server.handleRequest),
+	}
+	if l.config.Protocol == "dot" {
+		srv.Net = "tcp-tls"
+		srv.Listener = tls.NewListener(ln, l.tlsConfig())
+	}
+	l.dnsServer = srv
+	l.mu.Unlock()
+	log.WithFields(fields).Info("Listening DNS")
+	return srv.ActivateAndServe()
+}
+
+// tlsConfig returns the TLS configuration of a DNS over TLS or DNS over HTTPS listener
+func (l *dnsListener) tlsConfig() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: l.certs.GetCertificate,
+	}
+	if l.config.Protocol == "dot" {
+		cfg.NextProtos = []string{"dot"}
+	}
+	return cfg
+}
+
+func (l *dnsListener) isStopped() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stopped
+}
+
+// Shutdown stops the listener, and waits until the in-flight queries are answered or the context
+// is done
+func (l *dnsListener) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	if l.stopped {
+		l.mu.Unlock()
+		return nil
+	}
+	l.stopped = true
+	close(l.done)
+	pc, ln, dnsServer, httpServer := l.pc, l.ln, l.dnsServer, l.httpServer
+	l.pc, l.ln = nil, nil
+	l.mu.Unlock()
+
+	// Sockets not handed to a server yet
+	if pc != nil {
+		pc.Close()
+	}
+	if ln != nil {
+		ln.Close()
+	}
+	if httpServer != nil {
+		return httpServer.Shutdown(ctx)
+	}
+	if dnsServer == nil {
+		return nil
+	}
+	err := dnsServer.ShutdownContext(ctx)
+	if err != nil && ctx.Err() == nil {
+		// The server has failed, or has not been started yet. Closing the sockets makes sure it
+		// does not start serving.
+		if dnsServer.PacketConn != nil {
+			dnsServer.PacketConn.Close()
+		}
+		if dnsServer.Listener != nil {
+			dnsServer.Listener.Close()
+		}
+		return nil
+	}
+	return err
+}
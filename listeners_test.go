@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// listenerTestConfig is a configuration with the records of the listener tests
+var listenerTestConfig = DNSConfig{General: general{
+	Domain:        "auth.example.org",
+	Nsname:        "ns1.auth.example.org",
+	Nsadmin:       "admin.example.org",
+	StaticRecords: []string{"auth.example.org. A 192.168.1.100"},
+}}
+
+// newTestListener returns a DNS listener of the test records bound to a free port, and the
+// address it is bound to
+func newTestListener(t *testing.T, config listenerconfig) (*dnsListener, string) {
+	server := NewDNSServer(DB, config.Address, config.network(), listenerTestConfig.General.Domain)
+	if err := server.LoadRecords(listenerTestConfig); err != nil {
+		t.Fatalf("Could not load the records: %v", err)
+	}
+	l := newDNSListener(config, server)
+	if err := l.LoadCertificate(); err != nil {
+		t.Fatalf("Could not load the certificate: %v", err)
+	}
+	if err := l.Listen(); err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	if l.pc != nil {
+		return l, l.pc.LocalAddr().String()
+	}
+	return l, l.ln.Addr().String()
+}
+
+// runTestListener runs the listener until the end of the test
+func runTestListener(t *testing.T, l *dnsListener) {
+	stopped := make(chan struct{})
+	go func() {
+		l.Run()
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		_ = l.Shutdown(context.Background())
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Errorf("Expected the listener to stop")
+		}
+	})
+}
+
+func TestPrepareListenerConfig(t *testing.T) {
+	for i, test := range []struct {
+		listeners []listenerconfig
+		valid     bool
+	}{
+		{nil, true},
+		{[]listenerconfig{{Address: "127.0.0.1:53", Protocol: "both"}, {Address: "[::1]:53", Protocol: "UDP6"}}, true},
+		{[]listenerconfig{{Address: "127.0.0.1:853", Protocol: "dot", TLSCertFullchain: "cert.pem", TLSCertPrivkey: "key.pem"}}, true},
+		{[]listenerconfig{{Address: "127.0.0.1:853", Protocol: "dot"}}, false},
+		{[]listenerconfig{{Address: "127.0.0.1:53", Protocol: "sctp"}}, false},
+		{[]listenerconfig{{Protocol: "udp"}}, false},
+		{[]listenerconfig{{Address: "127.0.0.1:53", Protocol: "both"}, {Address: "127.0.0.1:53", Protocol: "tcp"}}, false},
+	} {
+		_, err := prepareListenerConfig(test.listeners)
+		if test.valid && err != nil {
+			t.Errorf("Test %d: Expected no error, got [%v]", i, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Test %d: Expected error, got none", i)
+		}
+	}
+}
+
+func TestConfigListeners(t *testing.T) {
+	for i, test := range []struct {
+		general   general
+		listeners []listenerconfig
+		expected  []listenerconfig
+	}{
+		{general{Listen: "127.0.0.1:53", Proto: "both4"}, nil, []listenerconfig{{Address: "127.0.0.1:53", Protocol: "udp4"}, {Address: "127.0.0.1:53", Protocol: "tcp4"}}},
+		{general{Listen: "127.0.0.1:53"}, nil, []listenerconfig{{Address: "127.0.0.1:53", Protocol: "udp"}}},
+		{general{Proto: "tcp"}, nil, []listenerconfig{{Address: ":53", Protocol: "tcp"}}},
+		{general{Listen: "127.0.0.1:53", Proto: "udp"}, []listenerconfig{{Address: "[::1]:53", Protocol: "both6"}, {Address: "[::1]:443", Protocol: "doh"}}, []listenerconfig{{Address: "[::1]:53", Protocol: "udp6"}, {Address: "[::1]:53", Protocol: "tcp6"}, {Address: "[::1]:443", Protocol: "doh"}}},
+	} {
+		listeners := configListeners(DNSConfig{General: test.general, Listeners: test.listeners})
+		if !reflect.DeepEqual(listeners, test.expected) {
+			t.Errorf("Test %d: Expected listeners %v, got %v", i, test.expected, listeners)
+		}
+	}
+}
+
+func TestDNSListeners(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir(), "auth.example.org")
+	msg := new(dns.Msg)
+	msg.SetQuestion("auth.example.org.", dns.TypeA)
+	for _, proto := range []string{"udp", "tcp", "dot"} {
+		l, addr := newTestListener(t, listenerconfig{Address: "127.0.0.1:0", Protocol: proto, TLSCertFullchain: certFile, TLSCertPrivkey: keyFile})
+		runTestListener(t, l)
+		client := &dns.Client{Net: l.config.network(), Timeout: 5 * time.Second}
+		if proto == "dot" {
+			client.Net = "tcp-tls"
+			client.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+		// The listener is started in the background
+		var answer *dns.Msg
+		var err error
+		for try := 0; try < 50; try++ {
+			if answer, _, err = client.Exchange(msg, addr); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Errorf("%s: could not query the listener: %v", proto, err)
+		} else if len(answer.Answer) != 1 {
+			t.Errorf("%s: expected an answer, got %v", proto, answer)
+		}
+	}
+
+	l, addr := newTestListener(t, listenerconfig{Address: "127.0.0.1:0", Protocol: "doh", TLSCertFullchain: certFile, TLSCertPrivkey: keyFile})
+	runTestListener(t, l)
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	packed, _ := msg.Pack()
+	var resp *http.Response
+	var err error
+	for try := 0; try < 50; try++ {
+		if resp, err = client.Post("https://"+addr+dohPath, dohMessageType, bytes.NewReader(packed)); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("doh: could not query the listener: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	answer := new(dns.Msg)
+	if err = answer.Unpack(body); err != nil || len(answer.Answer) != 1 {
+		t.Errorf("doh: expected an answer, got %v [%v]", answer, err)
+	}
+}
+
+func TestDNSListenerRetry(t *testing.T) {
+	// The port is taken, so the listener can not be bound at first
+	taken, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	addr := taken.LocalAddr().String()
+	server := NewDNSServer(DB, addr, "udp", listenerTestConfig.General.Domain)
+	if err = server.LoadRecords(listenerTestConfig); err != nil {
+		t.Fatalf("Could not load the records: %v", err)
+	}
+	l := newDNSListener(listenerconfig{Address: addr, Protocol: "udp"}, server)
+	if err = l.Listen(); err == nil {
+		t.Fatalf("Expected error for a taken port, got none")
+	}
+	runTestListener(t, l)
+	// Let the first attempt of the listener fail as well
+	time.Sleep(100 * time.Millisecond)
+	taken.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("auth.example.org.", dns.TypeA)
+	client := &dns.Client{Timeout: 200 * time.Millisecond}
+	// The listener is bound again after the first retry delay
+	for try := 0; try < 25; try++ {
+		if _, _, err = client.Exchange(msg, addr); err == nil {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if err != nil {
+		t.Errorf("Expected the listener to be bound once the port is free, got [%v]", err)
+	}
+}
+
+func TestDNSListenerPrivilegedPort(t *testing.T) {
+	privilegesDropped.Store(true)
+	defer privilegesDropped.Store(false)
+	// The address is not local, so it can not be bound even as root
+	l := newDNSListener(listenerconfig{Address: "192.0.2.1:53", Protocol: "udp"}, NewDNSServer(DB, "192.0.2.1:53", "udp", listenerTestConfig.General.Domain))
+	stopped := make(chan struct{})
+	go func() {
+		l.Run()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		_ = l.Shutdown(context.Background())
+		t.Errorf("Expected the listener of a privileged port not to be restarted without privileges")
+	}
+}
+
+func TestDoHHandler(t *testing.T) {
+	server := NewDNSServer(DB, "", "doh", listenerTestConfig.General.Domain)
+	if err := server.LoadRecords(listenerTestConfig); err != nil {
+		t.Fatalf("Could not load the records: %v", err)
+	}
+	handler := server.dohHandler()
+	msg := new(dns.Msg)
+	msg.SetQuestion("auth.example.org.", dns.TypeA)
+	packed, _ := msg.Pack()
+
+	for i, test := range []struct {
+		method      string
+		target      string
+		contentType string
+		body        []byte
+		status      int
+	}{
+		{"GET", dohPath + "?dns=" + base64.RawURLEncoding.EncodeToString(packed), "", nil, http.StatusOK},
+		{"POST", dohPath, dohMessageType, packed, http.StatusOK},
+		{"GET", dohPath + "?dns=invalid!", "", nil, http.StatusBadRequest},
+		{"GET", dohPath, "", nil, http.StatusBadRequest},
+		{"POST", dohPath, "text/plain", packed, http.StatusUnsupportedMediaType},
+		{"POST", dohPath, dohMessageType, []byte{1, 2, 3}, http.StatusBadRequest},
+		{"PUT", dohPath, dohMessageType, packed, http.StatusMethodNotAllowed},
+		{"GET", "/other", "", nil, http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(test.method, test.target, bytes.NewReader(test.body))
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, rec.Code)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if rec.Header().Get("Content-Type") != dohMessageType {
+			t.Errorf("Test %d: Expected content type %s, got %s", i, dohMessageType, rec.Header().Get("Content-Type"))
+		}
+		answer := new(dns.Msg)
+		if err := answer.Unpack(rec.Body.Bytes()); err != nil || len(answer.Answer) != 1 || answer.Id != msg.Id {
+			t.Errorf("Test %d: Expected an answer, got %v [%v]", i, answer, err)
+		}
+	}
+}
@@ -10,13 +10,13 @@ import (
 	stdlog "log"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/caddyserver/certmagic"
 	legolog "github.com/go-acme/lego/v3/log"
-	"github.com/julienschmidt/httprouter"
-	"github.com/rs/cors"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -27,12 +27,15 @@ func main() {
 	flag.Parse()
 	// Read global config
 	var err error
+	var configFile string
 	if fileIsAccessible(*configPtr) {
-		log.WithFields(log.Fields{"file": *configPtr}).Info("Using config file")
-		Config, err = readConfig(*configPtr)
+		configFile = *configPtr
 	} else if fileIsAccessible("./config.cfg") {
-		log.WithFields(log.Fields{"file": "./config.cfg"}).Info("Using config file")
-		Config, err = readConfig("./config.cfg")
+		configFile = "./config.cfg"
+	}
+	if configFile != "" {
+		log.WithFields(log.Fields{"file": configFile}).Info("Using config file")
+		Config, err = readConfig(configFile)
 	} else {
 		log.Errorf("Configuration file not found.")
 		os.Exit(1)
@@ -44,64 +47,262 @@ func main() {
 
 	setupLogging(Config.Logconfig.Format, Config.Logconfig.Level)
 
+	// Run a subcommand instead of the server
+	if flag.NArg() > 0 {
+		if err = runCommand(flag.Args()); err != nil {
+			log.Errorf("%s: %s", flag.Arg(0), err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	os.Exit(runServer(configFile))
+}
+
+// runServer runs the DNS server and the HTTP API until an error or a signal to stop, and returns
+// the exit code. The servers are drained and the cleanup is run before returning.
+func runServer(configFile string) int {
+	// Deferred first, so the logs of the cleanup get written too
+	defer flushLogs()
+
 	// Open database
-	newDB := new(acmedb)
-	err = newDB.Init(Config.Database.Engine, Config.Database.Connection)
+	newDB := newDatabase(Config.Database.Engine)
+	err := newDB.Init(Config.Database.Engine, Config.Database.Connection)
 	if err != nil {
 		log.Errorf("Could not open database [%v]", err)
-		os.Exit(1)
+		return 1
 	} else {
 		log.Info("Connected to database")
 	}
 	DB = newDB
+	var cache *txtCache
+	if Config.Database.CacheTTL > 0 {
+		cache = newTXTCache(newDB, time.Duration(Config.Database.CacheTTL)*time.Second, Config.Database.CacheSize)
+		DB = cache
+	}
 	defer DB.Close()
+	// Invalidate the cache on the changes made by the other instances sharing the database
+	if sqlDB, ok := newDB.(*acmedb); ok && cache != nil {
+		if feed := sqlDB.ChangeFeed(Config.Database.PollInterval); feed != nil {
+			if err = feed.Start(cache.Changed); err != nil {
+				log.WithFields(log.Fields{"error": err.Error()}).Warning("Could not start the TXT change feed")
+			} else {
+				defer feed.Stop()
+			}
+		}
+	}
+
+	// Webhook notifications
+	Webhooks = newWebhookDispatcher(Config.Webhooks)
+	Webhooks.Start()
+
+	// Replication to the cluster peers
+	Cluster = newClusterNode(Config.Cluster)
+	Cluster.Start()
+
+	// The deliveries still queued on shutdown get the time left of the shutdown timeout, and are
+	// dropped right away if the servers were never started
+	stopDeadline := time.Now()
+	defer func() {
+		ctx, cancel := context.WithDeadline(context.Background(), stopDeadline)
+		defer cancel()
+		webhooksStopped := make(chan struct{})
+		go func() {
+			Webhooks.Stop(ctx)
+			close(webhooksStopped)
+		}()
+		Cluster.Stop(ctx)
+		<-webhooksStopped
+	}()
 
 	// Error channel for servers
 	errChan := make(chan error, 1)
 
-	// DNS server
-	dnsservers := make([]*DNSServer, 0)
-	if strings.HasPrefix(Config.General.Proto, "both") {
-		// Handle the case where DNS server should be started for both udp and tcp
-		udpProto := "udp"
-		tcpProto := "tcp"
-		if strings.HasSuffix(Config.General.Proto, "4") {
-			udpProto += "4"
-			tcpProto += "4"
-		} else if strings.HasSuffix(Config.General.Proto, "6") {
-			udpProto += "6"
-			tcpProto += "6"
-		}
-		dnsServerUDP := NewDNSServer(DB, Config.General.Listen, udpProto, Config.General.Domain)
-		dnsservers = append(dnsservers, dnsServerUDP)
-		dnsServerUDP.ParseRecords(Config)
-		dnsServerTCP := NewDNSServer(DB, Config.General.Listen, tcpProto, Config.General.Domain)
-		dnsservers = append(dnsservers, dnsServerTCP)
-		// No need to parse records from config again
-		dnsServerTCP.Domains = dnsServerUDP.Domains
-		dnsServerTCP.SOA = dnsServerUDP.SOA
-		go dnsServerUDP.Start(errChan)
-		go dnsServerTCP.Start(errChan)
+	// Sockets passed by systemd socket activation
+	sockets, err := activationSockets()
+	if err != nil {
+		log.Errorf("Could not use the sockets passed by systemd: %s", err)
+		return 1
+	}
+	apiConfigs := configAPIListeners(Config)
+	apiSockets, err := sockets.apiSockets(apiConfigs)
+	if err != nil {
+		log.Errorf("Could not use the sockets passed by systemd: %s", err)
+		return 1
+	}
+
+	// DNS listeners, each with a DNS server of its own
+	var listeners []*dnsListener
+	if sockets.hasDNS() {
+		for _, pc := range sockets.dnsUDP {
+			l := newDNSListener(listenerconfig{Address: pc.LocalAddr().String(), Protocol: "udp"}, NewDNSServer(DB, pc.LocalAddr().String(), "udp", Config.General.Domain))
+			l.pc = pc
+			listeners = append(listeners, l)
+		}
+		for _, ln := range sockets.dnsTCP {
+			l := newDNSListener(listenerconfig{Address: ln.Addr().String(), Protocol: "tcp"}, NewDNSServer(DB, ln.Addr().String(), "tcp", Config.General.Domain))
+			l.ln = ln
+			listeners = append(listeners, l)
+		}
 	} else {
-		dnsServer := NewDNSServer(DB, Config.General.Listen, Config.General.Proto, Config.General.Domain)
-		dnsservers = append(dnsservers, dnsServer)
-		dnsServer.ParseRecords(Config)
-		go dnsServer.Start(errChan)
+		for _, lc := range configListeners(Config) {
+			listeners = append(listeners, newDNSListener(lc, NewDNSServer(DB, lc.Address, lc.network(), Config.General.Domain)))
+		}
+	}
+	DNSListeners = nil
+	for _, l := range listeners {
+		DNSListeners = append(DNSListeners, l.config)
+	}
+	servers := &serverGroup{}
+	dnsservers := make([]*DNSServer, 0)
+	var certs, dnsCerts []*certReloader
+	bound := 0
+	for _, l := range listeners {
+		if err = l.server.LoadRecords(Config); err != nil {
+			log.Errorf("Could not load the DNS records: %s", err)
+			return 1
+		}
+		if err = l.LoadCertificate(); err != nil {
+			log.Errorf("Could not load the certificate of DNS listener %s: %s", l.config.Address, err)
+			return 1
+		}
+		// A listener that can not be bound is retried in the background, and does not stop the
+		// other listeners. A privileged port can not be bound after dropping the privileges.
+		if err = l.Listen(); err != nil && Config.General.User != "" && privilegedPort(l.config.Address) {
+			log.Errorf("Could not listen DNS %s %s before dropping privileges: %s", l.config.Address, l.config.Protocol, err)
+			return 1
+		} else if err != nil {
+			log.WithFields(log.Fields{"error": err.Error(), "addr": l.config.Address, "proto": l.config.Protocol}).Error("Could not listen DNS, retrying in the background")
+		} else {
+			bound++
+		}
+		servers.AddDNS(l)
+		dnsservers = append(dnsservers, l.server)
+		if l.certs != nil {
+			dnsCerts = append(dnsCerts, l.certs)
+		}
+	}
+	if bound == 0 {
+		log.Errorf("None of the DNS listeners could be bound")
+		return 1
+	}
+
+	// HTTP API listeners, on the sockets passed by systemd for their addresses
+	apiListeners := make([]*apiListener, 0, len(apiConfigs))
+	for i, lc := range apiConfigs {
+		a := &apiListener{config: lc}
+		if lc.TLS == "cert" {
+			if a.certs, err = newCertReloader(lc.TLSCertFullchain, lc.TLSCertPrivkey); err != nil {
+				log.Errorf("Could not load the certificate of API listener %s: %s", lc.Address, err)
+				return 1
+			}
+			a.certs.SetOCSPStapling(!Config.API.DisableOCSPStapling)
+			certs = append(certs, a.certs)
+		}
+		if apiSockets[i] != nil {
+			a.listener = apiSockets[i]
+		} else if a.listener, err = listenAPI(lc.Address); err != nil {
+			log.Errorf("Could not listen HTTP API %s: %s", lc.Address, err)
+			return 1
+		} else if path, ok := unixSocketPath(lc.Address); ok {
+			// The socket is created before dropping the privileges
+			if err = chownToUser(path, Config.General.User, Config.General.Group); err != nil {
+				log.Errorf("Could not change the owner of API socket %s: %s", path, err)
+				return 1
+			}
+		}
+		apiListeners = append(apiListeners, a)
+	}
+
+	// All the listeners are bound, the privileges are not needed anymore. The database may have
+	// been created as root.
+	if err = chownDatabaseFiles(Config); err != nil {
+		log.Errorf("Could not change the owner of the database files: %s", err)
+		return 1
+	}
+	if err = dropPrivileges(Config.General.User, Config.General.Group); err != nil {
+		log.Errorf("Could not drop privileges: %s", err)
+		return 1
+	}
+	if err = checkAccess(Config); err != nil {
+		log.Errorf("Could not access the files needed after dropping privileges: %s", err)
+		return 1
+	}
+
+	for _, l := range listeners {
+		go l.Run()
+	}
+
+	// Serve the renewed certificates without waiting for a reload
+	certs = append(certs, dnsCerts...)
+	if len(certs) > 0 {
+		stopWatch := make(chan struct{})
+		defer close(stopWatch)
+		go watchCertificates(certs, time.Duration(Config.General.CertCheckInterval)*time.Second, stopWatch)
 	}
 
 	// HTTP API
-	go startHTTPAPI(errChan, Config, dnsservers)
+	reloader := &configReloader{configFile: configFile, dnsservers: dnsservers, dnsCerts: dnsCerts}
+	apiCtx, stopAPI := context.WithCancel(context.Background())
+	defer stopAPI()
+	go startHTTPAPI(apiCtx, errChan, Config, dnsservers, reloader, servers, apiListeners)
+	notifySystemd("READY=1")
 
-	// block waiting for error
+	// Ping the systemd watchdog from the main loop, so a stuck main loop gets noticed
+	var watchdog <-chan time.Time
+	if interval := watchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+
+	// Stop on SIGINT and SIGTERM, so the servers get drained and the deferred cleanup, like
+	// writing the memory database snapshot, gets run
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	// Reload the configuration on SIGHUP
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	// block waiting for error or signal
+	exitCode := 0
+wait:
 	for {
-		err = <-errChan
-		if err != nil {
-			log.Fatal(err)
+		select {
+		case err = <-errChan:
+			if err != nil {
+				log.Error(err)
+				exitCode = 1
+				break wait
+			}
+		case sig := <-sigChan:
+			log.WithFields(log.Fields{"signal": sig.String()}).Info("Shutting down")
+			break wait
+		case <-hupChan:
+			log.Info("Reloading configuration")
+			if _, err = reloader.Reload(); err != nil {
+				log.WithFields(log.Fields{"error": err.Error()}).Error("Could not reload the configuration, keeping the current configuration")
+			}
+		case <-watchdog:
+			notifySystemd("WATCHDOG=1")
 		}
 	}
+	notifySystemd("STOPPING=1")
+
+	// Report not ready, so the load balancers stop sending new requests before the listeners
+	// are closed
+	draining.Store(true)
+	if Config.General.ShutdownDelay > 0 {
+		log.WithFields(log.Fields{"delay": Config.General.ShutdownDelay}).Info("Draining, waiting before closing the listeners")
+		time.Sleep(time.Duration(Config.General.ShutdownDelay) * time.Second)
+	}
+	stopDeadline = time.Now().Add(time.Duration(Config.General.ShutdownTimeout) * time.Second)
+	servers.Shutdown(time.Duration(Config.General.ShutdownTimeout) * time.Second)
+	log.Info("Servers stopped")
+	return exitCode
 }
 
-func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer) {
+func startHTTPAPI(ctx context.Context, errChan chan error, config DNSConfig, dnsservers []*DNSServer, reloader *configReloader, servers *serverGroup, listeners []*apiListener) {
 	// Setup http logger
 	logger := log.New()
 	logwriter := logger.Writer()
@@ -112,99 +313,100 @@ func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer)
 	// Lego
 	legolog.Logger = logger
 
-	api := httprouter.New()
-	c := cors.New(cors.Options{
-		AllowedOrigins:     Config.API.CorsOrigins,
-		AllowedMethods:     []string{"GET", "POST"},
-		OptionsPassthrough: false,
-		Debug:              Config.General.Debug,
-	})
-	if Config.General.Debug {
-		// Logwriter for saner log output
-		c.Log = stdlog.New(logwriter, "", 0)
-	}
-	if !Config.API.DisableRegistration {
-		api.POST("/register", webRegisterPost)
-	}
-	api.POST("/update", Auth(webUpdatePost))
-	api.GET("/health", healthCheck)
-
-	host := Config.API.IP + ":" + Config.API.Port
-
-	// TLS specific general settings
-	cfg := &tls.Config{
-		MinVersion: tls.VersionTLS12,
-	}
-	provider := NewChallengeProvider(dnsservers)
-	storage := certmagic.FileStorage{Path: Config.API.ACMECacheDir}
-
-	// Set up certmagic for getting certificate for acme-dns api
-	certmagic.DefaultACME.DNS01Solver = &provider
-	certmagic.DefaultACME.Agreed = true
-	if Config.API.TLS == "letsencrypt" {
-		certmagic.DefaultACME.CA = certmagic.LetsEncryptProductionCA
-	} else {
-		certmagic.DefaultACME.CA = certmagic.LetsEncryptStagingCA
+	acmeMode := ""
+	for _, a := range listeners {
+		var router http.Handler = newAPIRouter(a.config.Routes, reloader)
+		if _, ok := unixSocketPath(a.config.Address); ok {
+			router = localClients(router)
+		}
+		a.handler = newAPIHandler(router, a.config.CorsOrigins, Config.General.Debug, stdlog.New(logwriter, "", 0))
+		if isACMETLS(a.config.TLS) {
+			acmeMode = a.config.TLS
+		}
 	}
-	certmagic.DefaultACME.Email = Config.API.NotificationEmail
-	magicConf := certmagic.NewDefault()
-	magicConf.Storage = &storage
-	magicConf.DefaultServerName = Config.General.Domain
-
-	magicCache := certmagic.NewCache(certmagic.CacheOptions{
-		GetConfigForCert: func(cert certmagic.Certificate) (*certmagic.Config, error) {
-			return magicConf, nil
-		},
-	})
+	reloader.SetHTTPAPI(listeners)
 
-	magic := certmagic.New(magicCache, *magicConf)
-	var err error
-	switch Config.API.TLS {
-	case "letsencryptstaging":
-		err = magic.ManageAsync(context.Background(), []string{Config.General.Domain})
-		if err != nil {
-			errChan <- err
-			return
+	// TLS specific general settings, shared by all the TLS modes
+	cfg, err := apiTLSConfig(Config.API)
+	if err != nil {
+		for _, a := range listeners {
+			a.listener.Close()
 		}
-		cfg.GetCertificate = magic.GetCertificate
+		errChan <- err
+		return
+	}
+	if acmeMode != "" {
+		provider := NewChallengeProvider(dnsservers)
+		storage := certmagic.FileStorage{Path: Config.API.ACMECacheDir}
 
-		srv := &http.Server{
-			Addr:      host,
-			Handler:   c.Handler(api),
-			TLSConfig: cfg,
-			ErrorLog:  stdlog.New(logwriter, "", 0),
+		// Set up certmagic for getting certificate for acme-dns api
+		template := certmagic.ACMEIssuer{
+			DNS01Solver: &provider,
+			Agreed:      true,
+			Email:       Config.API.NotificationEmail,
 		}
-		log.WithFields(log.Fields{"host": host, "domain": Config.General.Domain}).Info("Listening HTTPS")
-		err = srv.ListenAndServeTLS("", "")
-	case "letsencrypt":
-		err = magic.ManageAsync(context.Background(), []string{Config.General.Domain})
-		if err != nil {
+		if err := configureACME(&template, Config.API, acmeMode); err != nil {
+			for _, a := range listeners {
+				a.listener.Close()
+			}
 			errChan <- err
 			return
 		}
-		cfg.GetCertificate = magic.GetCertificate
-		srv := &http.Server{
-			Addr:      host,
-			Handler:   c.Handler(api),
-			TLSConfig: cfg,
-			ErrorLog:  stdlog.New(logwriter, "", 0),
-		}
-		log.WithFields(log.Fields{"host": host, "domain": Config.General.Domain}).Info("Listening HTTPS")
-		err = srv.ListenAndServeTLS("", "")
+		// The certificate is managed by acmeCertificate, the certmagic configuration only gives
+		// the issuer its storage for the ACME account
+		magic := certmagic.NewDefault()
+		magic.Storage = &storage
+		issuer := certmagic.NewACMEIssuer(magic, template)
+
+		// A single certificate covers all the names of the API
+		cert := newACMECertificate(apiCertNames(Config), issuer, &storage)
+		cert.certs.SetOCSPStapling(!Config.API.DisableOCSPStapling)
+		go cert.Run(ctx)
+		// The OCSP response is refreshed like the ones of the certificate files
+		go watchCertificates([]*certReloader{cert.certs}, time.Duration(Config.General.CertCheckInterval)*time.Second, ctx.Done())
+		cfg.GetCertificate = cert.GetCertificate
+	}
+
+	var wg sync.WaitGroup
+	for _, a := range listeners {
+		wg.Add(1)
+		go func(a *apiListener) {
+			defer wg.Done()
+			serveHTTPAPI(errChan, a, cfg, servers, stdlog.New(logwriter, "", 0))
+		}(a)
+	}
+	// The log writer is closed once all the listeners are stopped
+	wg.Wait()
+}
+
+// serveHTTPAPI serves an API listener with its TLS mode. The TLS configuration has the
+// certificate of the ACME modes.
+func serveHTTPAPI(errChan chan error, a *apiListener, tlsConfig *tls.Config, servers *serverGroup, errorLog *stdlog.Logger) {
+	srv := &http.Server{
+		Addr:     a.config.Address,
+		Handler:  withHSTS(a.handler, hstsHeader(Config.API)),
+		ErrorLog: errorLog,
+	}
+	if !servers.AddHTTP(srv) {
+		a.listener.Close()
+		return
+	}
+	var err error
+	switch a.config.TLS {
+	case "letsencrypt", "letsencryptstaging", "acme":
+		srv.TLSConfig = tlsConfig
+		log.WithFields(log.Fields{"host": a.config.Address, "domains": apiCertNames(Config)}).Info("Listening HTTPS")
+		err = srv.ServeTLS(a.listener, "", "")
 	case "cert":
-		srv := &http.Server{
-			Addr:      host,
-			Handler:   c.Handler(api),
-			TLSConfig: cfg,
-			ErrorLog:  stdlog.New(logwriter, "", 0),
-		}
-		log.WithFields(log.Fields{"host": host}).Info("Listening HTTPS")
-		err = srv.ListenAndServeTLS(Config.API.TLSCertFullchain, Config.API.TLSCertPrivkey)
+		srv.TLSConfig = tlsConfig.Clone()
+		srv.TLSConfig.GetCertificate = a.certs.GetCertificate
+		log.WithFields(log.Fields{"host": a.config.Address}).Info("Listening HTTPS")
+		err = srv.ServeTLS(a.listener, "", "")
 	default:
-		log.WithFields(log.Fields{"host": host}).Info("Listening HTTP")
-		err = http.ListenAndServe(host, c.Handler(api))
+		log.WithFields(log.Fields{"host": a.config.Address}).Info("Listening HTTP")
+		err = srv.Serve(a.listener)
 	}
-	if err != nil {
+	if err != nil && !isServerClosed(err) {
 		errChan <- err
 	}
 }
@@ -17,6 +17,7 @@ var dnsserver *DNSServer
 
 var (
 	postgres = flag.Bool("postgres", false, "run integration tests against PostgreSQL")
+	mysql    = flag.Bool("mysql", false, "run integration tests against MySQL/MariaDB")
 )
 
 var records = []string{
@@ -40,6 +41,13 @@ func TestMain(m *testing.M) {
 			fmt.Println("PostgreSQL integration tests expect database \"acmedns\" running in localhost, with username and password set to \"acmedns\"")
 			os.Exit(1)
 		}
+	} else if *mysql {
+		Config.Database.Engine = "mysql"
+		err := newDb.Init("mysql", "acmedns:acmedns@tcp(localhost:3306)/acmedns")
+		if err != nil {
+			fmt.Println("MySQL integration tests expect database \"acmedns\" running in localhost, with username and password set to \"acmedns\"")
+			os.Exit(1)
+		}
 	} else {
 		Config.Database.Engine = "sqlite3"
 		_ = newDb.Init("sqlite3", ":memory:")
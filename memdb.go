@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MemorySnapshotVersion is the version of the snapshot file format of the memory database engine
+var MemorySnapshotVersion = 1
+
+// memorydb is a database backend holding the data in memory. If the connection string is a
+// filename, the data is loaded from it on start and written to it when the database is closed.
+type memorydb struct {
+	mu       sync.RWMutex
+	snapshot string
+	// records keyed by username
+	records map[string]*dbRecord
+	// usernames keyed by subdomain
+	subdomains map[string]string
+}
+
+// memorySnapshot is the file format of the memory database snapshot
+type memorySnapshot struct {
+	Version int        `json:"version"`
+	Records []dbRecord `json:"records"`
+}
+
+func (d *memorydb) Init(engine string, connection string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.snapshot = connection
+	d.records = make(map[string]*dbRecord)
+	d.subdomains = make(map[string]string)
+	if d.snapshot == "" {
+		return nil
+	}
+	data, err := os.ReadFile(d.snapshot)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var snap memorySnapshot
+	if err = json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("invalid snapshot %s: %v", d.snapshot, err)
+	}
+	if snap.Version > MemorySnapshotVersion {
+		return fmt.Errorf("snapshot version %d is newer than the supported version %d", snap.Version, MemorySnapshotVersion)
+	}
+	for _, rec := range snap.Records {
+		if err = d.putRecord(rec); err != nil {
+			return err
+		}
+	}
+	log.WithFields(log.Fields{"file": d.snapshot, "records": len(snap.Records)}).Info("Loaded database snapshot")
+	return nil
+}
+
+func (d *memorydb) Register(afrom cidrslice, zone string) (ACMETxt, error) {
+	a := newACMETxt()
+	a.AllowFrom = cidrslice(afrom.ValidEntries())
+	a.Zone = zone
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(a.Password), 10)
+	if err != nil {
+		return a, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err = d.putRecord(dbRecord{
+		Username:  a.Username.String(),
+		Password:  string(passwordHash),
+		Subdomain: a.Subdomain,
+		AllowFrom: a.AllowFrom,
+		Zone:      a.Zone,
+	})
+	return a, err
+}
+
+func (d *memorydb) GetByUsername(u uuid.UUID) (ACMETxt, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	rec, ok := d.records[u.String()]
+	if !ok {
+		return ACMETxt{}, errors.New("no user")
+	}
+	txt := ACMETxt{Username: u, Password: rec.Password, AllowFrom: cidrslice(append([]string{}, rec.AllowFrom...))}
+	txt.Subdomain = rec.Subdomain
+	txt.Zone = rec.Zone
+	return txt, nil
+}
+
+func (d *memorydb) GetTXTForDomain(domain string, zone string) ([]string, error) {
+	domain = sanitizeString(domain)
+	var txts []string
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	username, ok := d.subdomains[domain]
+	if !ok || d.records[username].Zone != zone {
+		return txts, nil
+	}
+	for _, v := range d.records[username].TXT {
+		txts = append(txts, v.Value)
+	}
+	return txts, nil
+}
+
+func (d *memorydb) Update(a ACMETxtPost) (int64, error) {
+	timenow := time.Now().Unix()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	username, ok := d.subdomains[a.Subdomain]
+	if !ok {
+		return timenow, nil
+	}
+	values := d.records[username].TXT
+	// Replace the least recently updated value
+	oldest := 0
+	for i, v := range values {
+		if v.LastUpdate < values[oldest].LastUpdate {
+			oldest = i
+		}
+	}
+	values[oldest] = dbTXT{Value: a.Value, LastUpdate: timenow}
+	return timenow, nil
+}
+
+// MergeTXT stores a TXT value with its update time, replacing the least recently updated value
+// of the subdomain, unless the value is older than both of the current values
+func (d *memorydb) MergeTXT(subdomain string, txt dbTXT) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	username, ok := d.subdomains[subdomain]
+	if !ok {
+		return false, errUnknownSubdomain
+	}
+	values := d.records[username].TXT
+	i, ok := txtMergeSlot(values, txt)
+	if ok {
+		values[i] = txt
+	}
+	return ok, nil
+}
+
+// GetRecords returns all the accounts with their TXT values
+func (d *memorydb) GetRecords() ([]dbRecord, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	records := make([]dbRecord, 0, len(d.records))
+	for _, rec := range d.records {
+		records = append(records, copyRecord(*rec))
+	}
+	return records, nil
+}
+
+// PutRecord stores the account with its TXT values, replacing an existing account with the same username
+func (d *memorydb) PutRecord(rec dbRecord) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.putRecord(rec)
+}
+
+// putRecord stores the record. Caller must hold the write lock.
+func (d *memorydb) putRecord(rec dbRecord) error {
+	if owner, ok := d.subdomains[rec.Subdomain]; ok && owner != rec.Username {
+		return fmt.Errorf("subdomain %s is already registered", rec.Subdomain)
+	}
+	if old, ok := d.records[rec.Username]; ok {
+		delete(d.subdomains, old.Subdomain)
+	}
+	afrom := cidrslice(rec.AllowFrom)
+	rec = copyRecord(rec)
+	rec.AllowFrom = afrom.ValidEntries()
+	rec.TXT = recordTXTSlots(rec.TXT)
+	d.records[rec.Username] = &rec
+	d.subdomains[rec.Subdomain] = rec.Username
+	return nil
+}
+
+// Snapshot writes the data to the snapshot file, if one is configured
+func (d *memorydb) Snapshot() error {
+	if d.snapshot == "" {
+		return nil
+	}
+	records, _ := d.GetRecords()
+	data, err := json.Marshal(memorySnapshot{Version: MemorySnapshotVersion, Records: records})
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first to not leave a partially written snapshot behind
+	tmp, err := os.CreateTemp(filepath.Dir(d.snapshot), filepath.Base(d.snapshot)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), d.snapshot)
+}
+
+// Close writes the snapshot file
+func (d *memorydb) Close() {
+	if err := d.Snapshot(); err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "file": d.snapshot}).Error("Could not write database snapshot")
+	}
+}
+
+// GetBackend returns nil, as the memory engine is not an SQL database
+func (d *memorydb) GetBackend() *sql.DB {
+	return nil
+}
+
+func (d *memorydb) SetBackend(backend *sql.DB) {}
+
+// copyRecord returns a deep copy of the record
+func copyRecord(rec dbRecord) dbRecord {
+	rec.AllowFrom = append([]string{}, rec.AllowFrom...)
+	rec.TXT = append([]dbTXT{}, rec.TXT...)
+	return rec
+}
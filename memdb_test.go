@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMemoryRegisterUpdate(t *testing.T) {
+	d := new(memorydb)
+	if err := d.Init("memory", ""); err != nil {
+		t.Fatalf("Could not open memory database: %v", err)
+	}
+	defer d.Close()
+	reg, err := d.Register(cidrslice{"10.0.0.0/8", "invalid"}, "")
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	user, err := d.GetByUsername(reg.Username)
+	if err != nil {
+		t.Fatalf("Could not get test user, got error [%v]", err)
+	}
+	if user.Subdomain != reg.Subdomain {
+		t.Errorf("GetByUsername subdomain [%q] did not match the original [%q]", user.Subdomain, reg.Subdomain)
+	}
+	if !correctPassword(reg.Password, user.Password) {
+		t.Errorf("The password [%s] does not match the hash [%s]", reg.Password, user.Password)
+	}
+	if len(user.AllowFrom) != 1 || user.AllowFrom[0] != "10.0.0.0/8" {
+		t.Errorf("Expected AllowFrom [10.0.0.0/8], got %v", user.AllowFrom)
+	}
+	if _, err = d.GetByUsername(uuid.New()); err == nil {
+		t.Errorf("Expected error for a nonexistent user, got none")
+	}
+
+	for i, value := range []string{"first", "second", "third"} {
+		reg.Value = value
+		if _, err = d.Update(reg.ACMETxtPost); err != nil {
+			t.Errorf("Test %d: update failed, got error [%v]", i, err)
+		}
+	}
+	txts, _ := d.GetTXTForDomain(reg.Subdomain, "")
+	if len(txts) != 2 || !stringInSlice("third", txts) {
+		t.Errorf("Expected two TXT values including the latest, got %q", txts)
+	}
+	if txts, _ = d.GetTXTForDomain("does-not-exist", ""); len(txts) > 0 {
+		t.Errorf("No records should be returned.")
+	}
+	if txts, _ = d.GetTXTForDomain(reg.Subdomain, "auth.brand.com"); len(txts) > 0 {
+		t.Errorf("No records should be returned for another zone.")
+	}
+
+	other := dbRecord{Username: uuid.New().String(), Subdomain: reg.Subdomain}
+	if err = d.PutRecord(other); err == nil {
+		t.Errorf("Expected error when storing an account with a subdomain of another account, got none")
+	}
+}
+
+func TestMemorySnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	d := new(memorydb)
+	if err := d.Init("memory", path); err != nil {
+		t.Fatalf("Could not open memory database: %v", err)
+	}
+	reg, err := d.Register(cidrslice{}, "")
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	reg.Value = "persisted"
+	_, _ = d.Update(reg.ACMETxtPost)
+	d.Close()
+
+	loaded := new(memorydb)
+	if err = loaded.Init("memory", path); err != nil {
+		t.Fatalf("Could not load the snapshot: %v", err)
+	}
+	if _, err = loaded.GetByUsername(reg.Username); err != nil {
+		t.Errorf("Expected the user to be loaded from the snapshot, got error [%v]", err)
+	}
+	if txts, _ := loaded.GetTXTForDomain(reg.Subdomain, ""); !stringInSlice("persisted", txts) {
+		t.Errorf("Expected the TXT value to be loaded from the snapshot, got %q", txts)
+	}
+
+	if err = os.WriteFile(path, []byte(`{"version": 1000, "records": []}`), 0600); err != nil {
+		t.Fatalf("Could not write the snapshot: %v", err)
+	}
+	if err = new(memorydb).Init("memory", path); err == nil {
+		t.Errorf("Expected error when loading a snapshot with a newer version, got none")
+	}
+	if err = os.WriteFile(path, []byte(`not json`), 0600); err != nil {
+		t.Fatalf("Could not write the snapshot: %v", err)
+	}
+	if err = new(memorydb).Init("memory", path); err == nil {
+		t.Errorf("Expected error when loading an invalid snapshot, got none")
+	}
+}
+
+func TestMemoryConcurrentAccess(t *testing.T) {
+	d := new(memorydb)
+	_ = d.Init("memory", "")
+	reg, err := d.Register(cidrslice{}, "")
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				post := reg.ACMETxtPost
+				post.Value = "value"
+				_, _ = d.Update(post)
+				_, _ = d.GetTXTForDomain(reg.Subdomain, "")
+				_, _ = d.GetByUsername(reg.Username)
+				_, _ = d.GetRecords()
+			}
+		}()
+	}
+	wg.Wait()
+}
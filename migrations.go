@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// migration is a step upgrading the database schema to the version. Each migration is applied in
+// a transaction of its own, together with the version update.
+//
+// MySQL commits each DDL statement implicitly, so its migrations are not atomic: a migration
+// failing partway leaves the statements before the failure applied, while the version is not
+// updated. The steps are written so that they can be run again, skipping what is done already.
+type migration struct {
+	Version     int
+	Description string
+	Up          func(tx *sql.Tx, dialect *sqlDialect) error
+}
+
+var migrationTo1 = migration{
+	Version:     1,
+	Description: "create the tables and move the TXT values to a table of their own",
+	Up:          migrateTo1,
+}
+
+// migrationTo2 adds the zone of the accounts. The existing accounts are in the default zone.
+func migrationTo2(columnType string) migration {
+	return migration{
+		Version:     2,
+		Description: "add the zone of the accounts",
+		Up: func(tx *sql.Tx, dialect *sqlDialect) error {
+			return addColumn(tx, dialect, "records", "Zone", columnType+" NOT NULL DEFAULT ''")
+		},
+	}
+}
+
+// Migration steps of the engines, in version order
+var (
+	migrationsSQLite   = []migration{migrationTo1, migrationTo2("TEXT")}
+	migrationsPostgres = []migration{migrationTo1, migrationTo2("TEXT")}
+	// MySQL does not allow defaults for TEXT columns
+	migrationsMySQL = []migration{migrationTo1, migrationTo2("VARCHAR(255)")}
+)
+
+// addColumn adds the column to the table. On engines with implicitly committed DDL the column is
+// added only if it does not exist yet, as a failed migration may have added it already.
+func addColumn(tx *sql.Tx, dialect *sqlDialect, table string, column string, definition string) error {
+	if dialect.ColumnExists != "" {
+		var count int
+		if err := tx.QueryRow(dialect.Rebind(dialect.ColumnExists), table, column).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+	}
+	_, err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// migrateTo1 creates the tables, and for databases created before the versioning, creates the
+// TXT rows of the existing subdomains and drops the old value columns of the records table. The
+// TXT rows are recreated from the records table, so the migration can be run again on MySQL.
+func migrateTo1(tx *sql.Tx, dialect *sqlDialect) error {
+	for _, table := range []string{dialect.UserTable, dialect.TxtTable} {
+		if _, err := tx.Exec(table); err != nil {
+			return err
+		}
+	}
+	var subdomains []string
+	rows, err := tx.Query("SELECT Subdomain FROM records")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var subdomain string
+		if err = rows.Scan(&subdomain); err != nil {
+			rows.Close()
+			return err
+		}
+		subdomains = append(subdomains, subdomain)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM txt"); err != nil {
+		return err
+	}
+	for _, subdomain := range subdomains {
+		if subdomain == "" {
+			continue
+		}
+		// Insert two rows for each subdomain to txt table
+		for i := 0; i < 2; i++ {
+			if _, err = tx.Exec(dialect.Rebind(txtSQL), subdomain); err != nil {
+				return err
+			}
+		}
+	}
+	for _, drop := range dialect.UpgradeDropColumns {
+		if _, err = tx.Exec(drop); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// latestVersion returns the schema version the migrations of the engine lead to
+func latestVersion(migrations []migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// checkSchemaVersion returns an error if the database schema is newer than this version of
+// acme-dns knows about, so an older binary does not start against a database it may corrupt
+func checkSchemaVersion(version int, latest int) error {
+	if version > latest {
+		return fmt.Errorf("database version %d is newer than the version %d supported by this acme-dns, please upgrade acme-dns", version, latest)
+	}
+	return nil
+}
+
+// withMigrationLock runs fn holding the migration lock of the database on a dedicated connection,
+// so several acme-dns instances starting at once do not apply the migrations concurrently. The
+// version table is created if it does not exist.
+func (d *acmedb) withMigrationLock(fn func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := d.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if d.dialect.LockMigrations != "" {
+		var res sql.NullString
+		if err = conn.QueryRowContext(ctx, d.dialect.LockMigrations).Scan(&res); err != nil {
+			return fmt.Errorf("could not acquire the migration lock: %v", err)
+		}
+		if !res.Valid {
+			return errors.New("could not acquire the migration lock")
+		} else if res.String == "0" {
+			return errors.New("timed out waiting for the migration lock")
+		}
+		defer func() {
+			var res sql.NullString
+			if err := conn.QueryRowContext(ctx, d.dialect.UnlockMigrations).Scan(&res); err != nil {
+				log.WithFields(log.Fields{"error": err.Error()}).Error("Could not release the migration lock")
+			}
+		}()
+	}
+	if _, err = conn.ExecContext(ctx, d.dialect.AcmeTable); err != nil {
+		return err
+	}
+	return fn(ctx, conn)
+}
+
+// queryRower is implemented by both *sql.Conn and *sql.Tx
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// readSchemaVersion reads the schema version. Databases without a version are of version 0.
+func readSchemaVersion(ctx context.Context, q queryRower) (int, error) {
+	var versionString string
+	err := q.QueryRowContext(ctx, "SELECT Value FROM acmedns WHERE Name='db_version'").Scan(&versionString)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(versionString)
+}
+
+func writeSchemaVersion(tx *sql.Tx, dialect *sqlDialect, version int) error {
+	res, err := tx.Exec(dialect.Rebind("UPDATE acmedns SET Value=$1 WHERE Name='db_version'"), strconv.Itoa(version))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return nil
+	}
+	_, err = tx.Exec(dialect.Rebind("INSERT INTO acmedns (Name, Value) values('db_version', $1)"), strconv.Itoa(version))
+	return err
+}
+
+// SchemaVersion returns the schema version of the database
+func (d *acmedb) SchemaVersion() (int, error) {
+	var version int
+	err := d.withMigrationLock(func(ctx context.Context, conn *sql.Conn) error {
+		var err error
+		version, err = readSchemaVersion(ctx, conn)
+		return err
+	})
+	return version, err
+}
+
+// Migrate applies the pending migrations and returns the number of migrations applied
+func (d *acmedb) Migrate() (int, error) {
+	applied := 0
+	err := d.withMigrationLock(func(ctx context.Context, conn *sql.Conn) error {
+		version, err := readSchemaVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err = checkSchemaVersion(version, latestVersion(d.dialect.Migrations)); err != nil {
+			return err
+		}
+		for _, m := range d.dialect.Migrations {
+			if m.Version <= version {
+				continue
+			}
+			ok, err := d.applyMigration(ctx, conn, m)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err.Error(), "version": m.Version}).Error("Database migration failed")
+				return fmt.Errorf("migration to version %d failed: %v", m.Version, err)
+			}
+			if !ok {
+				continue
+			}
+			log.WithFields(log.Fields{"version": m.Version, "description": m.Description}).Info("Applied database migration")
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// applyMigration applies the migration, and returns false if another instance applied it first
+func (d *acmedb) applyMigration(ctx context.Context, conn *sql.Conn, m migration) (bool, error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	// Engines without a migration lock rely on the transaction to serialize the migrations, so
+	// check that the migration was not applied by another instance in the meantime
+	version, err := readSchemaVersion(ctx, tx)
+	if err == nil && version >= m.Version {
+		return false, tx.Rollback()
+	}
+	if err == nil {
+		err = m.Up(tx, d.dialect)
+	}
+	if err == nil {
+		err = writeSchemaVersion(tx, d.dialect, m.Version)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestDialectMigrations(t *testing.T) {
+	for name, d := range dialects {
+		if latestVersion(d.Migrations) != DBVersion {
+			t.Errorf("Dialect %s: expected migrations to lead to version %d, got %d", name, DBVersion, latestVersion(d.Migrations))
+		}
+		for i, m := range d.Migrations {
+			if m.Version != i+1 {
+				t.Errorf("Dialect %s: expected migration %d to have version %d, got %d", name, i, i+1, m.Version)
+			}
+		}
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acme-dns.db")
+	legacy, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	// Schema of the databases created before the versioning
+	for _, q := range []string{
+		"CREATE TABLE records(Username TEXT UNIQUE NOT NULL PRIMARY KEY, Password TEXT UNIQUE NOT NULL, Subdomain TEXT UNIQUE NOT NULL, Value TEXT, LastActive INT, AllowFrom TEXT)",
+		"INSERT INTO records VALUES('user', 'hash', 'legacy', 'value', 0, '[]')",
+	} {
+		if _, err = legacy.Exec(q); err != nil {
+			t.Fatalf("Could not create the legacy database: %v", err)
+		}
+	}
+	legacy.Close()
+
+	d := new(acmedb)
+	if err = d.Init("sqlite3", path); err != nil {
+		t.Fatalf("Could not migrate the legacy database: %v", err)
+	}
+	defer d.Close()
+	version, err := d.SchemaVersion()
+	if err != nil || version != DBVersion {
+		t.Errorf("Expected database version %d, got %d (%v)", DBVersion, version, err)
+	}
+	if txts, _ := d.GetTXTForDomain("legacy", ""); len(txts) != 2 {
+		t.Errorf("Expected two TXT rows for the legacy subdomain, got %d", len(txts))
+	}
+	if n, err := d.Migrate(); err != nil || n != 0 {
+		t.Errorf("Expected no pending migrations, got %d (%v)", n, err)
+	}
+}
+
+func TestMigrateNewerDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acme-dns.db")
+	d := new(acmedb)
+	if err := d.Init("sqlite3", path); err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	if _, err := d.DB.Exec("UPDATE acmedns SET Value='1000' WHERE Name='db_version'"); err != nil {
+		t.Fatalf("Could not set the database version: %v", err)
+	}
+	d.Close()
+
+	newer := new(acmedb)
+	if err := newer.Init("sqlite3", path); err == nil {
+		t.Errorf("Expected error when opening a database newer than the binary, got none")
+	}
+	newer.Close()
+}
+
+func TestMigrateManual(t *testing.T) {
+	Config.Database.ManualMigrate = true
+	defer func() { Config.Database.ManualMigrate = false }()
+	path := filepath.Join(t.TempDir(), "acme-dns.db")
+	d := new(acmedb)
+	if err := d.Init("sqlite3", path); err == nil {
+		t.Errorf("Expected error when opening a database with pending migrations, got none")
+	}
+	if n, err := d.Migrate(); err != nil || n != len(migrationsSQLite) {
+		t.Errorf("Expected %d migrations to be applied, got %d (%v)", len(migrationsSQLite), n, err)
+	}
+	d.Close()
+	d = new(acmedb)
+	if err := d.Init("sqlite3", path); err != nil {
+		t.Errorf("Expected migrated database to open, got error [%v]", err)
+	}
+	d.Close()
+}
+
+func TestMigrateConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acme-dns.db")
+	// SQLite does not wait for a busy database when switching a new database file to WAL mode
+	if created, err := sql.Open("sqlite3", sqliteConnection(path)); err == nil {
+		_ = created.Ping()
+		created.Close()
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	applied := 0
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d := new(acmedb)
+			if err := d.open("sqlite3", path); err != nil {
+				t.Errorf("Could not open database: %v", err)
+				return
+			}
+			defer d.Close()
+			n, err := d.Migrate()
+			if err != nil {
+				t.Errorf("Migration failed: %v", err)
+			}
+			mu.Lock()
+			applied += n
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if applied != len(migrationsSQLite) {
+		t.Errorf("Expected the migrations to be applied once, got %d", applied)
+	}
+	d := new(acmedb)
+	_ = d.open("sqlite3", path)
+	defer d.Close()
+	var count int
+	_ = d.DB.QueryRow("SELECT COUNT(*) FROM acmedns WHERE Name='db_version'").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected a single version row, got %d", count)
+	}
+}
+
+func TestAddColumnRerun(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	defer db.Close()
+	if _, err = db.Exec("CREATE TABLE records(Username TEXT)"); err != nil {
+		t.Fatalf("Could not create table: %v", err)
+	}
+	// A dialect checking the columns, like MySQL
+	dialect := *dialectSQLite
+	dialect.ColumnExists = "SELECT COUNT(*) FROM pragma_table_info($1) WHERE name=$2"
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Could not begin transaction: %v", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+	for i := 0; i < 2; i++ {
+		if err = addColumn(tx, &dialect, "records", "Zone", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			t.Errorf("Run %d: Expected the column to be added once, got error [%v]", i, err)
+		}
+	}
+	if err = addColumn(tx, dialectSQLite, "records", "Zone", "TEXT NOT NULL DEFAULT ''"); err == nil {
+		t.Errorf("Expected error adding an existing column without the check, got none")
+	}
+}
+
+func TestMigrationLockResult(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	defer db.Close()
+	for i, test := range []struct {
+		lock      string
+		shouldErr bool
+	}{
+		{"SELECT 1", false},
+		{"SELECT 0", true},
+		// GET_LOCK of MySQL returns NULL on an error
+		{"SELECT NULL", true},
+	} {
+		dialect := *dialectSQLite
+		dialect.LockMigrations = test.lock
+		dialect.UnlockMigrations = "SELECT 1"
+		d := &acmedb{DB: db, dialect: &dialect}
+		ran := false
+		err := d.withMigrationLock(func(ctx context.Context, conn *sql.Conn) error {
+			ran = true
+			return nil
+		})
+		if test.shouldErr != (err != nil) || ran == test.shouldErr {
+			t.Errorf("Test %d: Expected error %t, got [%v] and ran %t", i, test.shouldErr, err, ran)
+		}
+	}
+}
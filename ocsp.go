@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspTimeout is the timeout of the requests to the OCSP responders
+	ocspTimeout = 10 * time.Second
+	// ocspRetryInterval is the time waited before retrying a failed OCSP request
+	ocspRetryInterval = 5 * time.Minute
+	// ocspMaxRefreshInterval is the longest time an OCSP response is stapled before refreshing it
+	ocspMaxRefreshInterval = 24 * time.Hour
+)
+
+// ocspClient is the HTTP client of the requests to the OCSP responders
+var ocspClient = &http.Client{Timeout: ocspTimeout}
+
+// stapleOCSP fetches the OCSP response of a certificate from the OCSP responder of the
+// certificate, and returns a copy of the certificate with the response stapled. The certificate is
+// returned as is if it has no OCSP responder or no issuer certificate in the chain.
+func stapleOCSP(cert *tls.Certificate) (*tls.Certificate, *ocsp.Response, error) {
+	if len(cert.Certificate) < 2 {
+		return cert, nil, nil
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return cert, nil, nil
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := ocspClient.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder %s returned status %d", leaf.OCSPServer[0], resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	parsed, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parsed.Status != ocsp.Good {
+		return nil, parsed, fmt.Errorf("OCSP responder %s reports the certificate as not good, status %d", leaf.OCSPServer[0], parsed.Status)
+	}
+	stapled := *cert
+	stapled.OCSPStaple = parsed.Raw
+	return &stapled, parsed, nil
+}
+
+// ocspRefreshTime returns the time to refresh an OCSP response, halfway through its validity
+func ocspRefreshTime(resp *ocsp.Response) time.Time {
+	if resp.NextUpdate.IsZero() {
+		return time.Now().Add(ocspMaxRefreshInterval)
+	}
+	refresh := resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+	if latest := time.Now().Add(ocspMaxRefreshInterval); refresh.After(latest) {
+		return latest
+	}
+	return refresh
+}
+
+// SetOCSPStapling enables or disables stapling the OCSP responses to the certificate
+func (c *certReloader) SetOCSPStapling(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ocsp = enabled
+}
+
+// RefreshOCSP staples a new OCSP response to the certificate, if OCSP stapling is enabled and the
+// current response is due for a refresh. A failed request is retried later, and the current
+// response is kept meanwhile.
+func (c *certReloader) RefreshOCSP() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.ocsp || c.ocspDone || time.Now().Before(c.ocspRefresh) || c.cert.Load() == nil {
+		return false, nil
+	}
+	stapled, resp, err := stapleOCSP(c.cert.Load())
+	if err != nil {
+		c.ocspRefresh = time.Now().Add(ocspRetryInterval)
+		return false, err
+	}
+	if resp == nil {
+		// Nothing to staple until the certificate is replaced
+		c.ocspDone = true
+		return false, nil
+	}
+	c.ocspRefresh = ocspRefreshTime(resp)
+	c.cert.Store(stapled)
+	return true, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// testOCSPResponder is an OCSP responder of a test CA, answering with the status it is set to
+type testOCSPResponder struct {
+	server   *httptest.Server
+	ca       *x509.Certificate
+	caKey    crypto.Signer
+	status   atomic.Int64
+	requests atomic.Int64
+}
+
+func newTestOCSPResponder(t *testing.T) *testOCSPResponder {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	r := &testOCSPResponder{ca: ca, caKey: caKey}
+	r.status.Store(ocsp.Good)
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.requests.Add(1)
+		body, _ := io.ReadAll(req.Body)
+		parsed, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp, err := ocsp.CreateResponse(r.ca, r.ca, ocsp.Response{
+			Status:       int(r.status.Load()),
+			SerialNumber: parsed.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}, r.caKey)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		_, _ = w.Write(resp)
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// writeCertificate writes a certificate of the test CA with the OCSP responder, along with the
+// CA certificate in the chain
+func (r *testOCSPResponder) writeCertificate(t *testing.T, dir string, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		OCSPServer:   []string{r.server.URL},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, r.ca, &key.PublicKey, r.caKey)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: r.ca.Raw})...)
+	certFile, keyFile := filepath.Join(dir, "fullchain.pem"), filepath.Join(dir, "privkey.pem")
+	_ = os.WriteFile(certFile, chain, 0600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestRefreshOCSP(t *testing.T) {
+	responder := newTestOCSPResponder(t)
+	certs, err := newCertReloader(responder.writeCertificate(t, t.TempDir(), "auth.example.org"))
+	if err != nil {
+		t.Fatalf("Could not load certificate: %v", err)
+	}
+
+	// Nothing is stapled unless enabled
+	if stapled, err := certs.RefreshOCSP(); stapled || err != nil || responder.requests.Load() != 0 {
+		t.Errorf("Expected no OCSP request when disabled, got %t [%v]", stapled, err)
+	}
+	certs.SetOCSPStapling(true)
+	if stapled, err := certs.RefreshOCSP(); !stapled || err != nil {
+		t.Fatalf("Expected the OCSP response to be stapled, got %t [%v]", stapled, err)
+	}
+	first, _ := certs.GetCertificate(nil)
+	if len(first.OCSPStaple) == 0 {
+		t.Fatalf("Expected a stapled OCSP response")
+	}
+
+	// The response is not refreshed until halfway through its validity
+	if stapled, err := certs.RefreshOCSP(); stapled || err != nil || responder.requests.Load() != 1 {
+		t.Errorf("Expected the current response to be kept, got %t [%v]", stapled, err)
+	}
+
+	// The stapled response is served in the handshake
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = &tls.Config{GetCertificate: certs.GetCertificate}
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(responder.ca)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "auth.example.org"}}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if string(resp.TLS.OCSPResponse) != string(first.OCSPStaple) {
+		t.Errorf("Expected the stapled OCSP response in the handshake")
+	}
+
+	// A revoked certificate gets no new response, and the current one is kept
+	responder.status.Store(ocsp.Revoked)
+	certs.mu.Lock()
+	certs.ocspRefresh = time.Time{}
+	certs.mu.Unlock()
+	if stapled, err := certs.RefreshOCSP(); stapled || err == nil {
+		t.Errorf("Expected error for a revoked certificate, got %t [%v]", stapled, err)
+	}
+	if current, _ := certs.GetCertificate(nil); current != first {
+		t.Errorf("Expected the current certificate to be kept")
+	}
+}
+
+func TestRefreshOCSPWithoutResponder(t *testing.T) {
+	certs, err := newCertReloader(writeTestCertificate(t, t.TempDir(), "auth.example.org"))
+	if err != nil {
+		t.Fatalf("Could not load certificate: %v", err)
+	}
+	certs.SetOCSPStapling(true)
+	first, _ := certs.GetCertificate(nil)
+	if stapled, err := certs.RefreshOCSP(); stapled || err != nil {
+		t.Errorf("Expected nothing to staple, got %t [%v]", stapled, err)
+	}
+	if current, _ := certs.GetCertificate(nil); current != first {
+		t.Errorf("Expected the certificate to be kept as is")
+	}
+}
+
+func TestRefreshOCSPWithoutCertificate(t *testing.T) {
+	// The API certificate issued with ACME is watched before it has been issued
+	certs := &certReloader{}
+	certs.SetOCSPStapling(true)
+	if stapled, err := certs.RefreshOCSP(); stapled || err != nil {
+		t.Errorf("Expected nothing to staple, got %t [%v]", stapled, err)
+	}
+}
+
+func TestOCSPRefreshTime(t *testing.T) {
+	now := time.Now()
+	refresh := ocspRefreshTime(&ocsp.Response{ThisUpdate: now, NextUpdate: now.Add(4 * time.Hour)})
+	if refresh.Sub(now) != 2*time.Hour {
+		t.Errorf("Expected the refresh halfway through the validity, got %s", refresh.Sub(now))
+	}
+	refresh = ocspRefreshTime(&ocsp.Response{ThisUpdate: now, NextUpdate: now.Add(7 * 24 * time.Hour)})
+	if refresh.After(time.Now().Add(ocspMaxRefreshInterval)) {
+		t.Errorf("Expected the refresh within %s, got %s", ocspMaxRefreshInterval, refresh.Sub(now))
+	}
+	refresh = ocspRefreshTime(&ocsp.Response{ThisUpdate: now})
+	if refresh.Before(now) {
+		t.Errorf("Expected a refresh in the future without the next update, got %s", refresh.Sub(now))
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/caddyserver/certmagic"
+	log "github.com/sirupsen/logrus"
+)
+
+// privilegesDropped is set once the process has switched to an unprivileged user, and the
+// privileged ports can not be bound anymore
+var privilegesDropped atomic.Bool
+
+// accessCheckKey is the certmagic storage key written and removed to check the storage access
+const accessCheckKey = "acme-dns-access-check"
+
+// lookupIDs returns the user id, the group id and the supplementary group ids of the user. The
+// group defaults to the primary group of the user. Numeric ids are accepted as well.
+func lookupIDs(username string, groupname string) (int, int, []int, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		if u, err = user.LookupId(username); err != nil {
+			return 0, 0, nil, fmt.Errorf("unknown user %s", username)
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("user %s has a non-numeric id %s", username, u.Uid)
+	}
+	gidStr := u.Gid
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupname); err != nil {
+				return 0, 0, nil, fmt.Errorf("unknown group %s", groupname)
+			}
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("group %s has a non-numeric id %s", groupname, gidStr)
+	}
+	groups := []int{gid}
+	groupIds, _ := u.GroupIds()
+	for _, id := range groupIds {
+		if g, err := strconv.Atoi(id); err == nil && g != gid {
+			groups = append(groups, g)
+		}
+	}
+	return uid, gid, groups, nil
+}
+
+// privilegedPort checks if the port of the listen address can only be bound by root
+func privilegedPort(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	p, err := strconv.Atoi(port)
+	return err == nil && p > 0 && p < 1024
+}
+
+// dropPrivileges switches the process to the user and the group, after the privileged ports
+// have been bound. Nothing is done if no user is configured.
+func dropPrivileges(username string, groupname string) error {
+	if username == "" {
+		return nil
+	}
+	uid, gid, groups, err := lookupIDs(username, groupname)
+	if err != nil {
+		return err
+	}
+	if uid == os.Getuid() && gid == os.Getgid() {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("switching to user %s needs acme-dns to be started as root", username)
+	}
+	// The groups have to be changed first, as they can not be changed after the user
+	if err = syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("could not set the supplementary groups: %v", err)
+	}
+	if err = syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("could not set the group id %d: %v", gid, err)
+	}
+	if err = syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("could not set the user id %d: %v", uid, err)
+	}
+	// Make sure there is no way back to root
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return fmt.Errorf("could regain root privileges after switching to user %s", username)
+	}
+	privilegesDropped.Store(uid != 0)
+	log.WithFields(log.Fields{"user": username, "uid": uid, "gid": gid}).Info("Dropped privileges")
+	return nil
+}
+
+// chownToUser changes the owner of a file created before dropping the privileges, like an API
+// Unix socket, to the user and the group. Nothing is done if no user is configured.
+func chownToUser(path string, username string, groupname string) error {
+	if username == "" {
+		return nil
+	}
+	uid, gid, _, err := lookupIDs(username, groupname)
+	if err != nil {
+		return err
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// chownDatabaseFiles changes the owner of the database files created by the process before
+// dropping the privileges, like a new SQLite database with its write-ahead log, to the user and
+// the group. The files of other owners are left alone. Nothing is done if no user is configured.
+func chownDatabaseFiles(config DNSConfig) error {
+	if config.General.User == "" {
+		return nil
+	}
+	for _, path := range ownedDatabaseFiles(config.Database.Engine, config.Database.Connection) {
+		if err := chownToUser(path, config.General.User, config.General.Group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownedDatabaseFiles returns the existing database files owned by the effective user, with the
+// journal files of SQLite
+func ownedDatabaseFiles(engine string, connection string) []string {
+	var files []string
+	for _, path := range databaseFiles(engine, connection) {
+		candidates := []string{path}
+		if engine == "sqlite3" {
+			candidates = append(candidates, path+"-wal", path+"-shm", path+"-journal")
+		}
+		for _, file := range candidates {
+			info, err := os.Stat(file)
+			if err != nil || info.IsDir() {
+				continue
+			}
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) == os.Geteuid() {
+				files = append(files, file)
+			}
+		}
+	}
+	return files
+}
+
+// checkAccess checks that the database, the certificate storage and the certificate files can
+// still be used after dropping the privileges
+func checkAccess(config DNSConfig) error {
+	for _, path := range databaseFiles(config.Database.Engine, config.Database.Connection) {
+		if err := checkWritable(path); err != nil {
+			return fmt.Errorf("database: %v", err)
+		}
+	}
+	if backend := DB.GetBackend(); backend != nil {
+		if err := backend.Ping(); err != nil {
+			return fmt.Errorf("database: %v", err)
+		}
+	}
+	acme := false
+	for _, lc := range configAPIListeners(config) {
+		switch lc.TLS {
+		case "letsencrypt", "letsencryptstaging", "acme":
+			acme = true
+		case "cert":
+			if _, err := loadCertificate(lc.TLSCertFullchain, lc.TLSCertPrivkey); err != nil {
+				return fmt.Errorf("certificate: %v", err)
+			}
+		}
+	}
+	if acme {
+		storage := &certmagic.FileStorage{Path: config.API.ACMECacheDir}
+		ctx := context.Background()
+		if err := storage.Store(ctx, accessCheckKey, []byte{}); err != nil {
+			return fmt.Errorf("certificate storage: %v", err)
+		}
+		if err := storage.Delete(ctx, accessCheckKey); err != nil {
+			return fmt.Errorf("certificate storage: %v", err)
+		}
+		if config.API.ACMECARoot != "" {
+			if _, err := loadTrustedRoots(config.API.ACMECARoot); err != nil {
+				return fmt.Errorf("ACME CA root: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// databaseFiles returns the files and the directories the database engine writes to. SQLite
+// creates its journal files, and the memory engine its temporary snapshot files next to the
+// database file.
+func databaseFiles(engine string, connection string) []string {
+	switch engine {
+	case "sqlite3":
+		if isSQLiteMemory(connection) {
+			return nil
+		}
+		path := strings.TrimPrefix(connection, "file:")
+		if i := strings.Index(path, "?"); i >= 0 {
+			path = path[:i]
+		}
+		return []string{path, filepath.Dir(path)}
+	case "memory":
+		if connection == "" {
+			return nil
+		}
+		return []string{connection, filepath.Dir(connection)}
+	case "bolt":
+		return []string{connection}
+	}
+	return nil
+}
+
+// checkWritable checks that a file can be opened for writing, or that files can be created in
+// a directory. Missing files are skipped, as they are created in a directory that is checked.
+func checkWritable(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	f, err := os.CreateTemp(path, ".acme-dns-access-check*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	stdlog "log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/cors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// adminReloadPath is the API endpoint reloading the configuration
+	adminReloadPath = "/admin/reload"
+	// certCheckDefaultInterval is the default interval in seconds of checking the certificate files
+	// for changes
+	certCheckDefaultInterval = 60
+)
+
+// reloadableOptions are the configuration options applied without a restart
+var reloadableOptions = map[string]bool{
+	"general.records":        true,
+	"general.nsname":         true,
+	"general.nsadmin":        true,
+	"general.zonefile":       true,
+	"zone":                   true,
+	"logconfig.loglevel":     true,
+	"logconfig.logformat":    true,
+	"api.corsorigins":        true,
+	"api.tls_cert_privkey":   true,
+	"api.tls_cert_fullchain": true,
+}
+
+// ReloadResponse is a struct for the configuration reload response JSON
+type ReloadResponse struct {
+	Reloaded        []string `json:"reloaded"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// configReloader re-reads the configuration file on SIGHUP or on a request to the admin
+// endpoint, and applies the changed options that do not need a restart
+type configReloader struct {
+	mu         sync.Mutex
+	configFile string
+	dnsservers []*DNSServer
+	// The certificates of the DNS over TLS and DNS over HTTPS listeners
+	dnsCerts []*certReloader
+	apis     []*apiListener
+}
+
+// SetHTTPAPI sets the HTTP API listeners, whose CORS origins and certificates are reloaded with
+// the configuration. They are in the order of configAPIListeners.
+func (c *configReloader) SetHTTPAPI(apis []*apiListener) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.apis = apis
+}
+
+// Reload reads the configuration file and applies the reloadable changes. Nothing is applied if
+// the configuration, the zone files or the certificate files are invalid.
+func (c *configReloader) Reload() (ReloadResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resp := ReloadResponse{Reloaded: []string{}, RestartRequired: []string{}}
+	newConfig, err := readConfig(c.configFile)
+	if err != nil {
+		return resp, err
+	}
+	for _, option := range configChanges(Config, newConfig) {
+		if reloadableOptions[option] && (option != "zone" || sameZones(Config.Zones, newConfig.Zones)) {
+			resp.Reloaded = append(resp.Reloaded, option)
+		} else {
+			resp.RestartRequired = append(resp.RestartRequired, option)
+		}
+	}
+
+	// The configuration with the reloadable options of the new configuration
+	reloaded := Config
+	reloaded.General.StaticRecords = newConfig.General.StaticRecords
+	reloaded.General.Nsname = newConfig.General.Nsname
+	reloaded.General.Nsadmin = newConfig.General.Nsadmin
+	reloaded.General.Zonefile = newConfig.General.Zonefile
+	if sameZones(Config.Zones, newConfig.Zones) {
+		reloaded.Zones = newConfig.Zones
+	}
+	reloaded.Logconfig = newConfig.Logconfig
+	reloaded.API.CorsOrigins = newConfig.API.CorsOrigins
+	reloaded.API.TLSCertPrivkey = newConfig.API.TLSCertPrivkey
+	reloaded.API.TLSCertFullchain = newConfig.API.TLSCertFullchain
+
+	// Parse everything before applying anything, so a failure leaves the current state in place
+	zr, err := parseZoneRecords(reloaded)
+	if err != nil {
+		return resp, err
+	}
+	// The API listeners section is not reloaded, so the listeners stay in the same order
+	apiConfigs := configAPIListeners(reloaded)
+	if len(apiConfigs) != len(c.apis) {
+		return resp, errors.New("the API listeners do not match the configuration")
+	}
+	certs := make([]*loadedCertificate, len(c.apis))
+	for i, a := range c.apis {
+		if a.certs == nil {
+			continue
+		}
+		if certs[i], err = loadCertificateFiles(apiConfigs[i].TLSCertFullchain, apiConfigs[i].TLSCertPrivkey); err != nil {
+			return resp, err
+		}
+	}
+	// The DNS listeners are not reloaded, their certificates are reloaded from the same files
+	dnsCerts := make([]*loadedCertificate, len(c.dnsCerts))
+	for i, cr := range c.dnsCerts {
+		if dnsCerts[i], err = loadCertificateFiles(cr.Files()); err != nil {
+			return resp, err
+		}
+	}
+
+	for _, d := range c.dnsservers {
+		d.setRecords(zr)
+	}
+	for i, cr := range c.dnsCerts {
+		cr.set(dnsCerts[i])
+	}
+	for i, a := range c.apis {
+		if a.certs != nil {
+			a.certs.set(certs[i])
+		}
+		if a.handler != nil {
+			a.handler.SetOrigins(apiConfigs[i].CorsOrigins)
+		}
+	}
+	setupLogging(reloaded.Logconfig.Format, reloaded.Logconfig.Level)
+	// Only the main goroutine and the reloader read these options after starting
+	Config.General.StaticRecords = reloaded.General.StaticRecords
+	Config.General.Nsname = reloaded.General.Nsname
+	Config.General.Nsadmin = reloaded.General.Nsadmin
+	Config.General.Zonefile = reloaded.General.Zonefile
+	for i := range Config.Zones {
+		Config.Zones[i].Nsname = reloaded.Zones[i].Nsname
+		Config.Zones[i].Nsadmin = reloaded.Zones[i].Nsadmin
+		Config.Zones[i].StaticRecords = reloaded.Zones[i].StaticRecords
+		Config.Zones[i].Zonefile = reloaded.Zones[i].Zonefile
+	}
+	Config.Logconfig = reloaded.Logconfig
+	Config.API.CorsOrigins = reloaded.API.CorsOrigins
+	Config.API.TLSCertPrivkey = reloaded.API.TLSCertPrivkey
+	Config.API.TLSCertFullchain = reloaded.API.TLSCertFullchain
+
+	log.WithFields(log.Fields{"changed": resp.Reloaded}).Info("Reloaded configuration")
+	if len(resp.RestartRequired) > 0 {
+		log.WithFields(log.Fields{"options": resp.RestartRequired}).Warning("Changed configuration options need a restart to take effect")
+	}
+	return resp, nil
+}
+
+// configChanges returns the names of the configuration options that differ, like
+// "general.listen". The webhook and zone sections are compared as a whole.
+func configChanges(a DNSConfig, b DNSConfig) []string {
+	var changes []string
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < va.NumField(); i++ {
+		section := tomlName(va.Type().Field(i))
+		fa, fb := va.Field(i), vb.Field(i)
+		if fa.Kind() != reflect.Struct {
+			if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+				changes = append(changes, section)
+			}
+			continue
+		}
+		for j := 0; j < fa.NumField(); j++ {
+			if !reflect.DeepEqual(fa.Field(j).Interface(), fb.Field(j).Interface()) {
+				changes = append(changes, section+"."+tomlName(fa.Type().Field(j)))
+			}
+		}
+	}
+	return changes
+}
+
+// tomlName returns the configuration file name of a configuration struct field
+func tomlName(f reflect.StructField) string {
+	if name := f.Tag.Get("toml"); name != "" {
+		return name
+	}
+	return strings.ToLower(f.Name)
+}
+
+// sameZones checks if the same zones are configured, in the same order
+func sameZones(a []zoneconfig, b []zoneconfig) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Domain != b[i].Domain {
+			return false
+		}
+	}
+	return true
+}
+
+// apiHandler serves the API router through the CORS handler, which is replaced when the CORS
+// origins are reloaded
+type apiHandler struct {
+	router  http.Handler
+	debug   bool
+	logger  *stdlog.Logger
+	handler atomic.Value
+}
+
+func newAPIHandler(router http.Handler, origins []string, debug bool, logger *stdlog.Logger) *apiHandler {
+	a := &apiHandler{router: router, debug: debug, logger: logger}
+	a.SetOrigins(origins)
+	return a
+}
+
+// SetOrigins replaces the allowed CORS origins
+func (a *apiHandler) SetOrigins(origins []string) {
+	c := cors.New(cors.Options{
+		AllowedOrigins:     origins,
+		AllowedMethods:     []string{"GET", "POST"},
+		OptionsPassthrough: false,
+		Debug:              a.debug,
+	})
+	if a.debug && a.logger != nil {
+		// Logwriter for saner log output
+		c.Log = a.logger
+	}
+	a.handler.Store(c.Handler(a.router))
+}
+
+func (a *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.handler.Load().(http.Handler).ServeHTTP(w, r)
+}
+
+// certReloader serves the certificate loaded from the certificate files, which is replaced when
+// the configuration is reloaded or when the files are changed. The OCSP response is stapled to the
+// certificate if enabled.
+type certReloader struct {
+	cert atomic.Pointer[tls.Certificate]
+
+	mu       sync.Mutex
+	certFile string
+	keyFile  string
+	// The state of the files the current certificate, or the last rejected one, was loaded from
+	state [2]fileState
+	// OCSP stapling, the time to refresh the stapled response, and whether the certificate has
+	// nothing to staple
+	ocsp        bool
+	ocspRefresh time.Time
+	ocspDone    bool
+}
+
+// fileState is the state of a file used to notice that it has been replaced
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// loadedCertificate is a certificate loaded from the files, not served yet
+type loadedCertificate struct {
+	certFile string
+	keyFile  string
+	state    [2]fileState
+	cert     *tls.Certificate
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	loaded, err := loadCertificateFiles(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	c := &certReloader{}
+	c.set(loaded)
+	return c, nil
+}
+
+// loadCertificateFiles loads the certificate from the files, along with the state of the files
+func loadCertificateFiles(certFile string, keyFile string) (*loadedCertificate, error) {
+	state := statFiles(certFile, keyFile)
+	cert, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &loadedCertificate{certFile: certFile, keyFile: keyFile, state: state, cert: cert}, nil
+}
+
+// Files returns the files the certificate is loaded from
+func (c *certReloader) Files() (string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.certFile, c.keyFile
+}
+
+func (c *certReloader) set(loaded *loadedCertificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.certFile, c.keyFile, c.state = loaded.certFile, loaded.keyFile, loaded.state
+	c.cert.Store(loaded.cert)
+	c.ocspRefresh, c.ocspDone = time.Time{}, false
+}
+
+// GetCertificate returns the current certificate, for use in tls.Config
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// ReloadIfChanged reloads the certificate if the certificate or the key file has changed since
+// the certificate was loaded. An invalid replacement is rejected, and the current certificate is
+// kept until the files change again.
+func (c *certReloader) ReloadIfChanged() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := statFiles(c.certFile, c.keyFile)
+	if state == c.state {
+		return false, nil
+	}
+	// The files are not retried until they change again
+	c.state = state
+	cert, err := loadCertificate(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	c.cert.Store(cert)
+	c.ocspRefresh, c.ocspDone = time.Time{}, false
+	return true, nil
+}
+
+// watchCertificates reloads the certificates whose files have changed, and refreshes their
+// stapled OCSP responses, checking them at the interval until done is closed
+func watchCertificates(certs []*certReloader, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, c := range certs {
+			certFile, keyFile := c.Files()
+			fields := log.Fields{"cert": certFile, "key": keyFile}
+			reloaded, err := c.ReloadIfChanged()
+			if err != nil {
+				log.WithFields(fields).WithFields(log.Fields{"error": err.Error()}).Error("Could not reload the changed certificate, keeping the current certificate")
+			} else if reloaded {
+				log.WithFields(fields).Info("Reloaded the changed certificate")
+			}
+			if stapled, err := c.RefreshOCSP(); err != nil {
+				log.WithFields(fields).WithFields(log.Fields{"error": err.Error()}).Warning("Could not staple the OCSP response")
+			} else if stapled {
+				log.WithFields(fields).Debug("Stapled the OCSP response")
+			}
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// statFiles returns the state of the files. A missing file has the zero state.
+func statFiles(certFile string, keyFile string) [2]fileState {
+	var state [2]fileState
+	for i, path := range []string{certFile, keyFile} {
+		if info, err := os.Stat(path); err == nil {
+			state[i] = fileState{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return state
+}
+
+// loadCertificate loads the certificate chain and the private key
+func loadCertificate(certFile string, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// AdminAuth middleware for the admin endpoints, authenticated with the admin token as a bearer
+// token
+func AdminAuth(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if Config.API.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(Config.API.AdminToken)) != 1 {
+			log.WithFields(log.Fields{"error": "admin_unauthorized"}).Error("Admin request with an invalid token")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write(jsonError("forbidden"))
+			return
+		}
+		handle(w, r, p)
+	}
+}
+
+// webAdminReload reloads the configuration
+func (c *configReloader) webAdminReload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	status := http.StatusOK
+	resp, err := c.Reload()
+	var body []byte
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Could not reload the configuration, keeping the current configuration")
+		status = http.StatusInternalServerError
+		body = jsonError("reload_failed")
+	} else if body, err = json.Marshal(resp); err != nil {
+		status = http.StatusInternalServerError
+		body = jsonError("json_error")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const reloadTestConfig = `
+[general]
+listen = "%s"
+protocol = "udp"
+domain = "auth.example.org"
+nsname = "ns1.auth.example.org"
+nsadmin = "admin.example.org"
+records = ["%s"]
+zonefile = "%s"
+
+[database]
+engine = "sqlite3"
+connection = ":memory:"
+
+[api]
+corsorigins = ["%s"]
+tls = "none"
+tls_cert_fullchain = "%s"
+tls_cert_privkey = "%s"
+admin_token = "secret"
+
+[[api_listener]]
+address = "127.0.0.1:8080"
+tls = "none"
+routes = ["acme", "health", "admin"]
+
+[logconfig]
+loglevel = "%s"
+`
+
+// reloadTestOptions are the options of the configuration file written by writeReloadConfig
+type reloadTestOptions struct {
+	listen   string
+	record   string
+	origin   string
+	certFile string
+	keyFile  string
+	level    string
+	zonefile string
+}
+
+func writeReloadConfig(t *testing.T, path string, o reloadTestOptions) {
+	content := fmt.Sprintf(reloadTestConfig, o.listen, o.record, o.zonefile, o.origin, o.certFile, o.keyFile, o.level)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Could not write config: %v", err)
+	}
+}
+
+func defaultReloadOptions() reloadTestOptions {
+	return reloadTestOptions{
+		listen: "127.0.0.1:15353",
+		record: "auth.example.org. A 192.168.1.100",
+		origin: "*",
+		level:  "info",
+	}
+}
+
+// setupReloader loads the configuration file to the global configuration and returns a reloader
+// of a DNS server and an API handler using it
+func setupReloader(t *testing.T, path string) (*configReloader, *DNSServer, *apiHandler) {
+	oldConfig, oldLevel := Config, log.GetLevel()
+	t.Cleanup(func() {
+		Config = oldConfig
+		log.SetLevel(oldLevel)
+		log.SetFormatter(&log.TextFormatter{})
+	})
+	var err error
+	if Config, err = readConfig(path); err != nil {
+		t.Fatalf("Could not read config: %v", err)
+	}
+	server := NewDNSServer(DB, Config.General.Listen, "udp", Config.General.Domain)
+	if err = server.LoadRecords(Config); err != nil {
+		t.Fatalf("Could not load records: %v", err)
+	}
+	router := httprouter.New()
+	router.GET("/health", healthCheck)
+	handler := newAPIHandler(router, Config.API.CorsOrigins, false, nil)
+	reloader := &configReloader{configFile: path, dnsservers: []*DNSServer{server}}
+	reloader.SetHTTPAPI([]*apiListener{{config: configAPIListeners(Config)[0], handler: handler}})
+	return reloader, server, handler
+}
+
+func TestConfigChanges(t *testing.T) {
+	a := DNSConfig{General: general{Listen: "127.0.0.1:53", StaticRecords: []string{"a"}}}
+	b := a
+	if changes := configChanges(a, b); len(changes) != 0 {
+		t.Errorf("Expected no changes, got %v", changes)
+	}
+	b.General.Listen = "127.0.0.1:5353"
+	b.General.StaticRecords = []string{"b"}
+	b.API.TLSCertPrivkey = "key.pem"
+	b.Webhooks = []webhookconfig{{URL: "https://example.org"}}
+	changes := configChanges(a, b)
+	for _, expected := range []string{"general.listen", "general.records", "api.tls_cert_privkey", "webhook"} {
+		if !stringInSlice(expected, changes) {
+			t.Errorf("Expected %s in changes %v", expected, changes)
+		}
+	}
+	if len(changes) != 4 {
+		t.Errorf("Expected 4 changes, got %v", changes)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.cfg")
+	options := defaultReloadOptions()
+	options.origin = "https://one.example.org"
+	writeReloadConfig(t, path, options)
+	reloader, server, handler := setupReloader(t, path)
+
+	options = reloadTestOptions{
+		listen: "127.0.0.1:25353",
+		record: "auth.example.org. A 192.168.1.200",
+		origin: "https://two.example.org",
+		level:  "error",
+	}
+	writeReloadConfig(t, path, options)
+	resp, err := reloader.Reload()
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	for _, option := range []string{"general.records", "api.corsorigins", "logconfig.loglevel"} {
+		if !stringInSlice(option, resp.Reloaded) {
+			t.Errorf("Expected %s to be reloaded, got %v", option, resp.Reloaded)
+		}
+	}
+	if len(resp.RestartRequired) != 1 || resp.RestartRequired[0] != "general.listen" {
+		t.Errorf("Expected general.listen to need a restart, got %v", resp.RestartRequired)
+	}
+	if Config.General.Listen != "127.0.0.1:15353" {
+		t.Errorf("Expected the listen address to not change before a restart, got %s", Config.General.Listen)
+	}
+	if log.GetLevel() != log.ErrorLevel {
+		t.Errorf("Expected the log level to be reloaded, got %s", log.GetLevel())
+	}
+	if records := server.Domains["auth.example.org."].Records; len(records) != 2 || records[0].String() != "auth.example.org.\t3600\tIN\tA\t192.168.1.200" {
+		t.Errorf("Expected the reloaded record, got %v", records)
+	}
+	req := httptest.NewRequest("GET", "/health", nil)
+	req.Header.Set("Origin", "https://two.example.org")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "https://two.example.org" {
+		t.Errorf("Expected the reloaded CORS origin to be allowed, got headers %v", rec.Header())
+	}
+
+	// An invalid configuration is not applied
+	options = defaultReloadOptions()
+	options.zonefile = filepath.Join(t.TempDir(), "missing.zone")
+	options.origin = "https://three.example.org"
+	writeReloadConfig(t, path, options)
+	if _, err = reloader.Reload(); err == nil {
+		t.Errorf("Expected error for a missing zone file, got none")
+	}
+	if len(Config.API.CorsOrigins) != 1 || Config.API.CorsOrigins[0] != "https://two.example.org" {
+		t.Errorf("Expected the configuration to not change, got %v", Config.API.CorsOrigins)
+	}
+	if _, ok := server.Domains["auth.example.org."]; !ok {
+		t.Errorf("Expected the current records to be kept")
+	}
+	if err = os.WriteFile(path, []byte("[general"), 0600); err != nil {
+		t.Fatalf("Could not write config: %v", err)
+	}
+	if _, err = reloader.Reload(); err == nil {
+		t.Errorf("Expected error for a malformed configuration file, got none")
+	}
+}
+
+func TestApiAdminReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.cfg")
+	options := defaultReloadOptions()
+	writeReloadConfig(t, path, options)
+	reloader, _, _ := setupReloader(t, path)
+	router := httprouter.New()
+	router.POST(adminReloadPath, AdminAuth(reloader.webAdminReload))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	e.POST(adminReloadPath).
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.POST(adminReloadPath).
+		WithHeader("Authorization", "Bearer wrong").
+		Expect().
+		Status(http.StatusUnauthorized)
+
+	options.record = "auth.example.org. A 192.168.1.200"
+	writeReloadConfig(t, path, options)
+	response := e.POST(adminReloadPath).
+		WithHeader("Authorization", "Bearer secret").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	response.Value("reloaded").Array().Contains("general.records")
+	response.Value("restart_required").Array().Empty()
+
+	if err := os.WriteFile(path, []byte("[general"), 0600); err != nil {
+		t.Fatalf("Could not write config: %v", err)
+	}
+	e.POST(adminReloadPath).
+		WithHeader("Authorization", "Bearer secret").
+		Expect().
+		Status(http.StatusInternalServerError).
+		JSON().Object().
+		ValueEqual("error", "reload_failed")
+}
+
+// writeTestCertificate writes a self-signed certificate and its key for the name to the directory
+func writeTestCertificate(t *testing.T, dir string, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Could not marshal key: %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, "fullchain.pem"), filepath.Join(dir, "privkey.pem")
+	_ = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestReloadCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "auth.example.org")
+	path := filepath.Join(dir, "config.cfg")
+	options := defaultReloadOptions()
+	options.certFile, options.keyFile = certFile, keyFile
+	writeReloadConfig(t, path, options)
+	reloader, _, handler := setupReloader(t, path)
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Could not load certificate: %v", err)
+	}
+	reloader.SetHTTPAPI([]*apiListener{{config: configAPIListeners(Config)[0], handler: handler, certs: certs}})
+	first, _ := certs.GetCertificate(nil)
+
+	// The replaced certificate files are loaded on reload
+	writeTestCertificate(t, dir, "auth.example.org")
+	if _, err = reloader.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	second, _ := certs.GetCertificate(nil)
+	if second == first {
+		t.Errorf("Expected the certificate to be reloaded")
+	}
+
+	// Invalid certificate files are not loaded
+	if err = os.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+		t.Fatalf("Could not write key: %v", err)
+	}
+	if _, err = reloader.Reload(); err == nil {
+		t.Errorf("Expected error for an invalid certificate, got none")
+	}
+	if current, _ := certs.GetCertificate(nil); current != second {
+		t.Errorf("Expected the current certificate to be kept")
+	}
+}
+
+func TestReloadDNSListenerCertificate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.cfg")
+	writeReloadConfig(t, path, defaultReloadOptions())
+	reloader, _, _ := setupReloader(t, path)
+	certs, err := newCertReloader(writeTestCertificate(t, t.TempDir(), "dns.example.org"))
+	if err != nil {
+		t.Fatalf("Could not load certificate: %v", err)
+	}
+	reloader.dnsCerts = []*certReloader{certs}
+	first, _ := certs.GetCertificate(nil)
+
+	// The certificate is reloaded from the same files
+	certFile, keyFile := certs.Files()
+	writeTestCertificate(t, filepath.Dir(certFile), "dns.example.org")
+	if _, err = reloader.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if second, _ := certs.GetCertificate(nil); second == first {
+		t.Errorf("Expected the certificate to be reloaded")
+	}
+	if reloadedCert, reloadedKey := certs.Files(); reloadedCert != certFile || reloadedKey != keyFile {
+		t.Errorf("Expected the same certificate files, got %s and %s", reloadedCert, reloadedKey)
+	}
+}
+
+func TestCertReloaderReloadIfChanged(t *testing.T) {
+	dir := t.TempDir()
+	certs, err := newCertReloader(writeTestCertificate(t, dir, "auth.example.org"))
+	if err != nil {
+		t.Fatalf("Could not load certificate: %v", err)
+	}
+	certFile, keyFile := certs.Files()
+	first, _ := certs.GetCertificate(nil)
+	if reloaded, err := certs.ReloadIfChanged(); reloaded || err != nil {
+		t.Errorf("Expected no reload of the unchanged files, got %t [%v]", reloaded, err)
+	}
+
+	// The renewed certificate is loaded
+	writeTestCertificate(t, dir, "auth.example.org")
+	setModTime(t, time.Now().Add(time.Minute), certFile, keyFile)
+	if reloaded, err := certs.ReloadIfChanged(); !reloaded || err != nil {
+		t.Errorf("Expected the changed files to be reloaded, got %t [%v]", reloaded, err)
+	}
+	second, _ := certs.GetCertificate(nil)
+	if second == first {
+		t.Errorf("Expected the certificate to be replaced")
+	}
+
+	// An invalid replacement is rejected once, and the current certificate is kept
+	if err = os.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+		t.Fatalf("Could not write key: %v", err)
+	}
+	setModTime(t, time.Now().Add(2*time.Minute), keyFile)
+	if reloaded, err := certs.ReloadIfChanged(); reloaded || err == nil {
+		t.Errorf("Expected error for an invalid replacement, got %t [%v]", reloaded, err)
+	}
+	if reloaded, err := certs.ReloadIfChanged(); reloaded || err != nil {
+		t.Errorf("Expected the rejected files to not be retried, got %t [%v]", reloaded, err)
+	}
+	if current, _ := certs.GetCertificate(nil); current != second {
+		t.Errorf("Expected the current certificate to be kept")
+	}
+}
+
+func TestWatchCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certs, err := newCertReloader(writeTestCertificate(t, dir, "auth.example.org"))
+	if err != nil {
+		t.Fatalf("Could not load certificate: %v", err)
+	}
+	first, _ := certs.GetCertificate(nil)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		watchCertificates([]*certReloader{certs}, 10*time.Millisecond, done)
+		close(stopped)
+	}()
+
+	certFile, keyFile := writeTestCertificate(t, dir, "auth.example.org")
+	setModTime(t, time.Now().Add(time.Minute), certFile, keyFile)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if current, _ := certs.GetCertificate(nil); current != first {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the renewed certificate to be served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the watcher to stop")
+	}
+}
+
+// setModTime sets the modification time of the files, so they are seen as changed even if written
+// within the resolution of the file system timestamps
+func setModTime(t *testing.T, at time.Time, files ...string) {
+	for _, path := range files {
+		if err := os.Chtimes(path, at, at); err != nil {
+			t.Fatalf("Could not set the modification time of %s: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// shutdownDefaultTimeout is the default time in seconds the in-flight requests are waited for
+// on shutdown
+const shutdownDefaultTimeout = 10
+
+// draining is set on shutdown, and makes the readiness endpoint report that the server is not ready
+var draining atomic.Bool
+
+// serverGroup holds the running DNS and HTTP servers, so they can be shut down together
+type serverGroup struct {
+	mu     sync.Mutex
+	closed bool
+	http   []*http.Server
+	dns    []*dnsListener
+}
+
+// AddHTTP adds a HTTP server to the group. It returns false if the group has been shut down
+// already, and the server should not be started.
+func (g *serverGroup) AddHTTP(srv *http.Server) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	g.http = append(g.http, srv)
+	return true
+}
+
+// AddDNS adds a DNS listener to the group
+func (g *serverGroup) AddDNS(l *dnsListener) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.dns = append(g.dns, l)
+}
+
+// Shutdown stops the servers from accepting new requests, and waits until the in-flight requests
+// are finished or the timeout is reached. The connections still open after the timeout are closed.
+func (g *serverGroup) Shutdown(timeout time.Duration) {
+	g.mu.Lock()
+	g.closed = true
+	httpServers, dnsServers := g.http, g.dns
+	g.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range httpServers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.WithFields(log.Fields{"error": err.Error(), "addr": srv.Addr}).Warning("HTTP API did not drain in time, closing the remaining connections")
+				srv.Close()
+			}
+		}(srv)
+	}
+	for _, l := range dnsServers {
+		wg.Add(1)
+		go func(l *dnsListener) {
+			defer wg.Done()
+			if err := l.Shutdown(ctx); err != nil {
+				log.WithFields(log.Fields{"error": err.Error(), "addr": l.config.Address, "proto": l.config.Protocol}).Warning("Could not shut down the DNS server cleanly")
+			}
+		}(l)
+	}
+	wg.Wait()
+}
+
+// isServerClosed checks if the error is returned by a server that was shut down
+func isServerClosed(err error) bool {
+	return errors.Is(err, http.ErrServerClosed)
+}
+
+// Endpoint used to check the readiness of the server. It reports not ready while the server
+// is shutting down.
+func readinessCheck(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	if draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("{\"status\": \"draining\"}"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("{\"status\": \"ready\"}"))
+}
+
+// flushLogs syncs the log output to the disk, if it is a file
+func flushLogs() {
+	if f, ok := log.StandardLogger().Out.(*os.File); ok {
+		_ = f.Sync()
+	}
+}
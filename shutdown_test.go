@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestReadinessCheck(t *testing.T) {
+	defer draining.Store(false)
+	router := httprouter.New()
+	router.GET("/ready", readinessCheck)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	e.GET("/ready").Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("status", "ready")
+	draining.Store(true)
+	e.GET("/ready").Expect().
+		Status(http.StatusServiceUnavailable).
+		JSON().Object().
+		ValueEqual("status", "draining")
+}
+
+func TestServerGroupShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})}
+	servers := &serverGroup{}
+	if !servers.AddHTTP(srv) {
+		t.Fatalf("Expected the server to be added")
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(listener) }()
+
+	dnsListener := newDNSListener(listenerconfig{Address: "127.0.0.1:0", Protocol: "udp"}, NewDNSServer(DB, "127.0.0.1:0", "udp", "auth.example.org"))
+	if err = dnsListener.Listen(); err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	servers.AddDNS(dnsListener)
+	dnsStopped := make(chan struct{})
+	go func() {
+		dnsListener.Run()
+		close(dnsStopped)
+	}()
+
+	// The in-flight request is finished before the server stops
+	respStatus := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			respStatus <- 0
+			return
+		}
+		resp.Body.Close()
+		respStatus <- resp.StatusCode
+	}()
+	<-started
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+	}()
+	servers.Shutdown(5 * time.Second)
+	if status := <-respStatus; status != http.StatusOK {
+		t.Errorf("Expected the in-flight request to finish, got status %d", status)
+	}
+	if err := <-serveErr; !isServerClosed(err) {
+		t.Errorf("Expected the server to be closed, got %v", err)
+	}
+	if _, err := http.Get("http://" + listener.Addr().String()); err == nil {
+		t.Errorf("Expected the listener to be closed")
+	}
+	select {
+	case <-dnsStopped:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the DNS listener to stop")
+	}
+	if servers.AddHTTP(&http.Server{}) {
+		t.Errorf("Expected the server to not be added after shutdown")
+	}
+}
+
+func TestServerGroupShutdownTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})}
+	servers := &serverGroup{}
+	servers.AddHTTP(srv)
+	go func() { _ = srv.Serve(listener) }()
+	go func() {
+		if resp, err := http.Get("http://" + listener.Addr().String()); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	// The connections still open after the timeout are closed
+	start := time.Now()
+	servers.Shutdown(100 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the shutdown to not wait for the request, took %s", elapsed)
+	}
+}
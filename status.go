@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// lookupMaxResolvers is the maximum number of resolver addresses remembered for a single TXT value
+const lookupMaxResolvers = 32
+
+// lookupTracker keeps track of when the TXT values of the subdomains were served by answerTXT, and to whom
+type lookupTracker struct {
+	mu      sync.RWMutex
+	lookups map[string]map[string]*valueLookups
+}
+
+// valueLookups holds the lookup information of a single TXT value
+type valueLookups struct {
+	LastServed time.Time
+	Resolvers  map[string]time.Time
+}
+
+// ResolverLookup is the JSON representation of a resolver that fetched a TXT value
+type ResolverLookup struct {
+	IP       string `json:"ip"`
+	LastSeen int64  `json:"last_seen"`
+}
+
+func newLookupTracker() *lookupTracker {
+	return &lookupTracker{lookups: make(map[string]map[string]*valueLookups)}
+}
+
+// Record stores a lookup of the subdomain where the values were served to the resolver. Values
+// that are no longer served for the subdomain are forgotten.
+func (l *lookupTracker) Record(subdomain string, values []string, resolver string) {
+	if l == nil || len(values) == 0 {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old := l.lookups[subdomain]
+	current := make(map[string]*valueLookups, len(values))
+	for _, v := range values {
+		vl, ok := old[v]
+		if !ok {
+			vl = &valueLookups{Resolvers: make(map[string]time.Time)}
+		}
+		vl.LastServed = now
+		if resolver != "" {
+			vl.Resolvers[resolver] = now
+			vl.pruneResolvers()
+		}
+		current[v] = vl
+	}
+	l.lookups[subdomain] = current
+}
+
+// pruneResolvers drops the least recently seen resolvers over the lookupMaxResolvers limit
+func (v *valueLookups) pruneResolvers() {
+	for len(v.Resolvers) > lookupMaxResolvers {
+		var oldestIP string
+		var oldest time.Time
+		for ip, seen := range v.Resolvers {
+			if oldestIP == "" || seen.Before(oldest) {
+				oldestIP = ip
+				oldest = seen
+			}
+		}
+		delete(v.Resolvers, oldestIP)
+	}
+}
+
+// Get returns the time when the value of the subdomain was last served, and the resolvers it
+// was served to, most recent first. The returned bool is false if the value has not been served.
+func (l *lookupTracker) Get(subdomain string, value string) (time.Time, []ResolverLookup, bool) {
+	resolvers := []ResolverLookup{}
+	if l == nil {
+		return time.Time{}, resolvers, false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	vl, ok := l.lookups[subdomain][value]
+	if !ok {
+		return time.Time{}, resolvers, false
+	}
+	for ip, seen := range vl.Resolvers {
+		resolvers = append(resolvers, ResolverLookup{IP: ip, LastSeen: seen.Unix()})
+	}
+	sort.Slice(resolvers, func(i, j int) bool {
+		if resolvers[i].LastSeen == resolvers[j].LastSeen {
+			return resolvers[i].IP < resolvers[j].IP
+		}
+		return resolvers[i].LastSeen > resolvers[j].LastSeen
+	})
+	return vl.LastServed, resolvers, true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLookupTrackerRecord(t *testing.T) {
+	tracker := newLookupTracker()
+	tracker.Record("sub", []string{"first", "second"}, "192.0.2.1")
+	tracker.Record("sub", []string{"first", "second"}, "192.0.2.2")
+	tracker.Record("other", []string{"third"}, "")
+
+	for i, test := range []struct {
+		subdomain string
+		value     string
+		served    bool
+		resolvers []string
+	}{
+		{"sub", "first", true, []string{"192.0.2.1", "192.0.2.2"}},
+		{"sub", "second", true, []string{"192.0.2.1", "192.0.2.2"}},
+		{"sub", "third", false, []string{}},
+		{"other", "third", true, []string{}},
+		{"nonexistent", "first", false, []string{}},
+	} {
+		lastServed, resolvers, served := tracker.Get(test.subdomain, test.value)
+		if served != test.served {
+			t.Errorf("Test %d: Expected served to be %t", i, test.served)
+		}
+		if served && lastServed.IsZero() {
+			t.Errorf("Test %d: Expected last served time to be set", i)
+		}
+		if len(resolvers) != len(test.resolvers) {
+			t.Errorf("Test %d: Expected %d resolvers, but got %d", i, len(test.resolvers), len(resolvers))
+			continue
+		}
+		found := map[string]bool{}
+		for _, r := range resolvers {
+			found[r.IP] = true
+		}
+		for _, r := range test.resolvers {
+			if !found[r] {
+				t.Errorf("Test %d: Expected resolver %s in the list", i, r)
+			}
+		}
+	}
+}
+
+func TestLookupTrackerForgetsOldValues(t *testing.T) {
+	tracker := newLookupTracker()
+	tracker.Record("sub", []string{"first", "second"}, "192.0.2.1")
+	tracker.Record("sub", []string{"second", "third"}, "192.0.2.2")
+	if _, _, served := tracker.Get("sub", "first"); served {
+		t.Errorf("Expected the value no longer served to be forgotten")
+	}
+	_, resolvers, served := tracker.Get("sub", "second")
+	if !served || len(resolvers) != 2 {
+		t.Errorf("Expected the value still served to keep its resolvers, got %v", resolvers)
+	}
+}
+
+func TestLookupTrackerResolverLimit(t *testing.T) {
+	tracker := newLookupTracker()
+	for i := 0; i < lookupMaxResolvers+10; i++ {
+		tracker.Record("sub", []string{"value"}, fmt.Sprintf("192.0.2.%d", i))
+	}
+	_, resolvers, _ := tracker.Get("sub", "value")
+	if len(resolvers) != lookupMaxResolvers {
+		t.Errorf("Expected %d resolvers, but got %d", lookupMaxResolvers, len(resolvers))
+	}
+}
+
+func TestLookupTrackerNil(t *testing.T) {
+	var tracker *lookupTracker
+	tracker.Record("sub", []string{"value"}, "192.0.2.1")
+	if _, resolvers, served := tracker.Get("sub", "value"); served || len(resolvers) != 0 {
+		t.Errorf("Expected nil tracker to return nothing")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// listenFdsStart is the first file descriptor passed by systemd socket activation
+	listenFdsStart = 3
+	// socketNameDNS is the FileDescriptorName of the DNS sockets, both UDP and TCP
+	socketNameDNS = "dns"
+	// socketNameAPI is the FileDescriptorName of the HTTP API socket
+	socketNameAPI = "api"
+)
+
+// activatedSockets are the sockets passed by systemd socket activation, by their use
+type activatedSockets struct {
+	dnsUDP []net.PacketConn
+	dnsTCP []net.Listener
+	api    []net.Listener
+}
+
+// hasDNS checks if DNS sockets were passed, in which case the listen address and the protocol
+// of the configuration are not used
+func (s *activatedSockets) hasDNS() bool {
+	return len(s.dnsUDP) > 0 || len(s.dnsTCP) > 0
+}
+
+// apiSockets returns the API sockets of the listeners, nil for a listener without one. The
+// sockets are matched by the address they are bound to, and a socket bound to an unspecified
+// address, like the one of ListenStream=443, matches a listener on any unspecified address of
+// its port. A socket that matches none of the listeners is an error.
+func (s *activatedSockets) apiSockets(listeners []apilistenerconfig) ([]net.Listener, error) {
+	matched := make([]net.Listener, len(listeners))
+	for _, l := range s.api {
+		found := false
+		for i, lc := range listeners {
+			if matched[i] == nil && socketMatches(l.Addr(), lc.Address) {
+				matched[i] = l
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s socket %s does not match the address of any API listener", socketNameAPI, l.Addr())
+		}
+	}
+	return matched, nil
+}
+
+// socketMatches checks if a socket bound to addr serves the listen address of the configuration
+func socketMatches(addr net.Addr, address string) bool {
+	if path, ok := unixSocketPath(address); ok {
+		return addr.Network() == "unix" && addr.String() == path
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || addr.Network() != "tcp" {
+		return false
+	}
+	boundHost, boundPort, err := net.SplitHostPort(addr.String())
+	if err != nil || boundPort != port {
+		return false
+	}
+	unspecified := func(host string) bool {
+		ip := net.ParseIP(host)
+		return host == "" || ip != nil && ip.IsUnspecified()
+	}
+	if unspecified(host) || unspecified(boundHost) {
+		return unspecified(host) && unspecified(boundHost)
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.Equal(net.ParseIP(boundHost))
+}
+
+// listenEnv returns the number of the sockets passed by systemd and their names. The number is
+// zero if acme-dns was not socket activated. The variables are unset, so they are not inherited.
+func listenEnv() (int, []string, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		// Not meant for this process
+		return 0, nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return 0, nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := make([]string, count)
+	if env := os.Getenv("LISTEN_FDNAMES"); env != "" {
+		copy(names, strings.Split(env, ":"))
+	}
+	return count, names, nil
+}
+
+// activationSockets returns the sockets passed by systemd socket activation, matched by their
+// FileDescriptorName
+func activationSockets() (*activatedSockets, error) {
+	count, names, err := listenEnv()
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*os.File, count)
+	for i := range files {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		files[i] = os.NewFile(uintptr(fd), names[i])
+	}
+	return socketsFromFiles(files, names)
+}
+
+// socketsFromFiles sorts the socket files by their names. The DNS sockets are told apart by
+// their type, so both UDP and TCP sockets can be passed with the name "dns".
+func socketsFromFiles(files []*os.File, names []string) (*activatedSockets, error) {
+	sockets := &activatedSockets{}
+	for i, f := range files {
+		// The net package uses duplicates of the descriptors
+		defer f.Close()
+		sotype, err := syscall.GetsockoptInt(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_TYPE)
+		if err != nil {
+			return nil, fmt.Errorf("file descriptor %d (%s) is not a socket: %v", listenFdsStart+i, names[i], err)
+		}
+		switch {
+		case names[i] == socketNameDNS && sotype == syscall.SOCK_DGRAM:
+			pc, err := net.FilePacketConn(f)
+			if err != nil {
+				return nil, err
+			}
+			sockets.dnsUDP = append(sockets.dnsUDP, pc)
+		case names[i] == socketNameDNS && sotype == syscall.SOCK_STREAM:
+			l, err := net.FileListener(f)
+			if err != nil {
+				return nil, err
+			}
+			sockets.dnsTCP = append(sockets.dnsTCP, l)
+		case names[i] == socketNameAPI && sotype == syscall.SOCK_STREAM:
+			l, err := net.FileListener(f)
+			if err != nil {
+				return nil, err
+			}
+			sockets.api = append(sockets.api, l)
+		case names[i] == socketNameDNS:
+			return nil, fmt.Errorf("socket %s is not a datagram or a stream socket", names[i])
+		case names[i] == socketNameAPI:
+			return nil, fmt.Errorf("socket %s is not a stream socket", names[i])
+		default:
+			log.WithFields(log.Fields{"name": names[i], "fd": listenFdsStart + i}).Warning("Ignoring a socket passed by systemd with an unknown name")
+		}
+	}
+	return sockets, nil
+}
+
+// sdNotify sends the state, like "READY=1", to the systemd notification socket. Nothing is
+// sent if acme-dns was not started by systemd with Type=notify.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// Abstract socket names starting with @ are handled by the net package
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notifySystemd sends the state to systemd, and logs the errors
+func notifySystemd(state string) {
+	if err := sdNotify(state); err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "state": state}).Warning("Could not notify systemd")
+	}
+}
+
+// watchdogInterval returns the interval of the systemd watchdog pings, half of the WatchdogSec
+// of the service. It is zero if the watchdog is not enabled for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestListenEnv(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	for i, test := range []struct {
+		pid      string
+		fds      string
+		names    string
+		count    int
+		expected []string
+		valid    bool
+	}{
+		{pid, "2", "dns:api", 2, []string{"dns", "api"}, true},
+		{pid, "2", "", 2, []string{"", ""}, true},
+		{pid, "1", "dns:api", 1, []string{"dns"}, true},
+		{"1", "2", "dns:api", 0, nil, true},
+		{"", "", "", 0, nil, true},
+		{pid, "invalid", "", 0, nil, false},
+	} {
+		t.Setenv("LISTEN_PID", test.pid)
+		t.Setenv("LISTEN_FDS", test.fds)
+		t.Setenv("LISTEN_FDNAMES", test.names)
+		count, names, err := listenEnv()
+		if !test.valid {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got [%v]", i, err)
+		}
+		if count != test.count || !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("Test %d: Expected %d sockets %v, got %d %v", i, test.count, test.expected, count, names)
+		}
+		if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+			t.Errorf("Test %d: Expected the environment variables to be unset", i)
+		}
+	}
+}
+
+func TestSocketsFromFiles(t *testing.T) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer udp.Close()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer tcp.Close()
+	api, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer api.Close()
+	files := func(conns ...interface{ File() (*os.File, error) }) []*os.File {
+		var fs []*os.File
+		for _, c := range conns {
+			f, err := c.File()
+			if err != nil {
+				t.Fatalf("Could not get the file of the socket: %v", err)
+			}
+			fs = append(fs, f)
+		}
+		return fs
+	}
+
+	sockets, err := socketsFromFiles(files(udp.(*net.UDPConn), tcp.(*net.TCPListener), api.(*net.TCPListener), api.(*net.TCPListener)), []string{"dns", "dns", "api", "unknown"})
+	if err != nil {
+		t.Fatalf("Expected no error, got [%v]", err)
+	}
+	if len(sockets.dnsUDP) != 1 || sockets.dnsUDP[0].LocalAddr().String() != udp.LocalAddr().String() {
+		t.Errorf("Expected the UDP socket to be used for DNS, got %v", sockets.dnsUDP)
+	}
+	if len(sockets.dnsTCP) != 1 || sockets.dnsTCP[0].Addr().String() != tcp.Addr().String() {
+		t.Errorf("Expected the TCP socket to be used for DNS, got %v", sockets.dnsTCP)
+	}
+	if len(sockets.api) != 1 || sockets.api[0].Addr().String() != api.Addr().String() {
+		t.Errorf("Expected the API socket, got %v", sockets.api)
+	}
+	if !sockets.hasDNS() {
+		t.Errorf("Expected DNS sockets")
+	}
+	for _, s := range sockets.dnsUDP {
+		s.Close()
+	}
+	for _, l := range append(sockets.dnsTCP, sockets.api...) {
+		l.Close()
+	}
+
+	if _, err = socketsFromFiles(files(udp.(*net.UDPConn)), []string{"api"}); err == nil {
+		t.Errorf("Expected error for a datagram API socket, got none")
+	}
+	sockets, err = socketsFromFiles(nil, nil)
+	if err != nil || sockets.hasDNS() || len(sockets.api) != 0 {
+		t.Errorf("Expected no sockets, got %v [%v]", sockets, err)
+	}
+}
+
+func TestAPISockets(t *testing.T) {
+	public, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer public.Close()
+	internal, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer internal.Close()
+	path := filepath.Join(t.TempDir(), "api.sock")
+	unix, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer unix.Close()
+	_, publicPort, _ := net.SplitHostPort(public.Addr().String())
+
+	// The sockets are matched by their addresses, not by their order
+	sockets := &activatedSockets{api: []net.Listener{unix, internal, public}}
+	listeners := []apilistenerconfig{
+		{Address: "0.0.0.0:" + publicPort},
+		{Address: "127.0.0.1:8080"},
+		{Address: internal.Addr().String()},
+		{Address: unixSocketPrefix + path},
+	}
+	matched, err := sockets.apiSockets(listeners)
+	if err != nil {
+		t.Fatalf("Expected no error, got [%v]", err)
+	}
+	expected := []net.Listener{public, nil, internal, unix}
+	if !reflect.DeepEqual(matched, expected) {
+		t.Errorf("Expected the sockets %v, got %v", expected, matched)
+	}
+
+	if _, err = sockets.apiSockets(listeners[:2]); err == nil {
+		t.Errorf("Expected error for sockets without a listener, got none")
+	}
+	sockets = &activatedSockets{api: []net.Listener{internal}}
+	if _, err = sockets.apiSockets([]apilistenerconfig{{Address: "0.0.0.0:" + publicPort}}); err == nil {
+		t.Errorf("Expected error for a socket on another address, got none")
+	}
+}
+
+func TestSocketMatches(t *testing.T) {
+	tcp := func(address string) net.Addr {
+		addr, err := net.ResolveTCPAddr("tcp", address)
+		if err != nil {
+			t.Fatalf("Could not resolve %s: %v", address, err)
+		}
+		return addr
+	}
+	for i, test := range []struct {
+		addr    net.Addr
+		address string
+		matches bool
+	}{
+		{tcp("[::]:443"), "0.0.0.0:443", true},
+		{tcp("0.0.0.0:443"), ":443", true},
+		{tcp("[::]:443"), "0.0.0.0:8443", false},
+		{tcp("[::]:443"), "198.51.100.1:443", false},
+		{tcp("198.51.100.1:443"), "0.0.0.0:443", false},
+		{tcp("198.51.100.1:443"), "198.51.100.1:443", true},
+		{tcp("[2001:db8::1]:443"), "[2001:db8:0::1]:443", true},
+		{&net.UnixAddr{Name: "/run/acme-dns/api.sock", Net: "unix"}, "unix:/run/acme-dns/api.sock", true},
+		{&net.UnixAddr{Name: "/run/acme-dns/api.sock", Net: "unix"}, "unix:/run/other.sock", false},
+		{tcp("127.0.0.1:443"), "unix:/run/acme-dns/api.sock", false},
+	} {
+		if matches := socketMatches(test.addr, test.address); matches != test.matches {
+			t.Errorf("Test %d: Expected %s matching %s %t, got %t", i, test.addr, test.address, test.matches, matches)
+		}
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("Expected no error without a notification socket, got [%v]", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+	if err = sdNotify("READY=1"); err != nil {
+		t.Fatalf("Expected no error, got [%v]", err)
+	}
+	buf := make([]byte, 64)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Errorf("Expected READY=1, got %q [%v]", buf[:n], err)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing.sock"))
+	if err = sdNotify("READY=1"); err == nil {
+		t.Errorf("Expected error for a missing notification socket, got none")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	for i, test := range []struct {
+		usec     string
+		pid      string
+		expected time.Duration
+	}{
+		{"30000000", "", 15 * time.Second},
+		{"30000000", pid, 15 * time.Second},
+		{"30000000", "1", 0},
+		{"", "", 0},
+		{"invalid", "", 0},
+	} {
+		t.Setenv("WATCHDOG_USEC", test.usec)
+		t.Setenv("WATCHDOG_PID", test.pid)
+		if interval := watchdogInterval(); interval != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, interval)
+		}
+	}
+}
@@ -0,0 +1,4 @@
+#!/bin/sh
+sudo mysql -e "CREATE DATABASE acmedns"
+sudo mysql -e "CREATE USER 'acmedns'@'localhost' IDENTIFIED BY 'acmedns'"
+sudo mysql -e "GRANT ALL PRIVILEGES ON acmedns.* TO 'acmedns'@'localhost'"
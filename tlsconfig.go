@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// tlsDefaultMinVersion is the default minimum TLS version of the API
+const tlsDefaultMinVersion = "1.2"
+
+// tlsVersions are the TLS versions of the tls_min_version and tls_max_version options
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves are the elliptic curves of the tls_curves option
+var tlsCurves = map[string]tls.CurveID{
+	"x25519": tls.X25519,
+	"p-256":  tls.CurveP256,
+	"p-384":  tls.CurveP384,
+	"p-521":  tls.CurveP521,
+}
+
+// prepareTLSConfig validates the TLS options of the API
+func prepareTLSConfig(api httpapi) error {
+	_, err := apiTLSConfig(api)
+	return err
+}
+
+// apiTLSConfig returns the TLS configuration shared by the API listeners of all the TLS modes,
+// without the certificate
+func apiTLSConfig(api httpapi) (*tls.Config, error) {
+	cfg := &tls.Config{}
+	minVersion := api.TLSMinVersion
+	if minVersion == "" {
+		minVersion = tlsDefaultMinVersion
+	}
+	var ok bool
+	if cfg.MinVersion, ok = tlsVersions[minVersion]; !ok {
+		return nil, fmt.Errorf("invalid tls_min_version %q, expected one of 1.0, 1.1, 1.2, 1.3", api.TLSMinVersion)
+	}
+	if api.TLSMaxVersion != "" {
+		if cfg.MaxVersion, ok = tlsVersions[api.TLSMaxVersion]; !ok {
+			return nil, fmt.Errorf("invalid tls_max_version %q, expected one of 1.0, 1.1, 1.2, 1.3", api.TLSMaxVersion)
+		}
+		if cfg.MaxVersion < cfg.MinVersion {
+			return nil, errors.New("tls_max_version is lower than tls_min_version")
+		}
+	}
+	for _, name := range api.TLSCurves {
+		curve, ok := tlsCurves[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("invalid tls_curves curve %q, expected one of X25519, P-256, P-384, P-521", name)
+		}
+		cfg.CurvePreferences = append(cfg.CurvePreferences, curve)
+	}
+	for _, name := range api.TLSCiphers {
+		id, err := tlsCipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+	return cfg, nil
+}
+
+// tlsCipherSuite returns the ID of a secure TLS 1.0 - 1.2 cipher suite. The TLS 1.3 cipher suites
+// are not configurable.
+func tlsCipherSuite(name string) (uint16, error) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name != name {
+			continue
+		}
+		for _, version := range suite.SupportedVersions {
+			if version != tls.VersionTLS13 {
+				return suite.ID, nil
+			}
+		}
+		return 0, fmt.Errorf("invalid tls_ciphers cipher suite %s, the TLS 1.3 cipher suites are not configurable", name)
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return 0, fmt.Errorf("invalid tls_ciphers cipher suite %s, the cipher suite is insecure", name)
+		}
+	}
+	return 0, fmt.Errorf("invalid tls_ciphers cipher suite %q", name)
+}
+
+// hstsHeader returns the value of the Strict-Transport-Security header, or an empty string if
+// HSTS is disabled
+func hstsHeader(api httpapi) string {
+	if api.HSTSMaxAge <= 0 {
+		return ""
+	}
+	value := "max-age=" + strconv.Itoa(api.HSTSMaxAge)
+	if api.HSTSIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return value
+}
+
+// withHSTS adds the Strict-Transport-Security header to the responses sent over TLS
+func withHSTS(h http.Handler, value string) http.Handler {
+	if value == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
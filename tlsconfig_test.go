@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAPITLSConfig(t *testing.T) {
+	for i, test := range []struct {
+		api     httpapi
+		min     uint16
+		max     uint16
+		curves  []tls.CurveID
+		ciphers []uint16
+		valid   bool
+	}{
+		{httpapi{}, tls.VersionTLS12, 0, nil, nil, true},
+		{httpapi{TLSMinVersion: "1.3"}, tls.VersionTLS13, 0, nil, nil, true},
+		{httpapi{TLSMinVersion: "1.2", TLSMaxVersion: "1.2"}, tls.VersionTLS12, tls.VersionTLS12, nil, nil, true},
+		{httpapi{TLSCurves: []string{"X25519", "P-256"}}, tls.VersionTLS12, 0, []tls.CurveID{tls.X25519, tls.CurveP256}, nil, true},
+		{httpapi{TLSCiphers: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256"}}, tls.VersionTLS12, 0, nil, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256}, true},
+		{httpapi{TLSMinVersion: "1.4"}, 0, 0, nil, nil, false},
+		{httpapi{TLSMaxVersion: "2"}, 0, 0, nil, nil, false},
+		{httpapi{TLSMinVersion: "1.3", TLSMaxVersion: "1.2"}, 0, 0, nil, nil, false},
+		{httpapi{TLSCurves: []string{"P-224"}}, 0, 0, nil, nil, false},
+		{httpapi{TLSCiphers: []string{"TLS_AES_128_GCM_SHA256"}}, 0, 0, nil, nil, false},
+		{httpapi{TLSCiphers: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, 0, 0, nil, nil, false},
+		{httpapi{TLSCiphers: []string{"TLS_NONEXISTENT"}}, 0, 0, nil, nil, false},
+	} {
+		cfg, err := apiTLSConfig(test.api)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got [%v]", i, err)
+			continue
+		}
+		if cfg.MinVersion != test.min || cfg.MaxVersion != test.max {
+			t.Errorf("Test %d: Expected versions %x - %x, got %x - %x", i, test.min, test.max, cfg.MinVersion, cfg.MaxVersion)
+		}
+		if !reflect.DeepEqual(cfg.CurvePreferences, test.curves) {
+			t.Errorf("Test %d: Expected curves %v, got %v", i, test.curves, cfg.CurvePreferences)
+		}
+		if !reflect.DeepEqual(cfg.CipherSuites, test.ciphers) {
+			t.Errorf("Test %d: Expected cipher suites %v, got %v", i, test.ciphers, cfg.CipherSuites)
+		}
+	}
+}
+
+func TestAPITLSMinVersion(t *testing.T) {
+	cfg, err := apiTLSConfig(httpapi{TLSMinVersion: "1.3"})
+	if err != nil {
+		t.Fatalf("Expected no error, got [%v]", err)
+	}
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = cfg
+	server.StartTLS()
+	defer server.Close()
+
+	// A TLS 1.2 client is refused by a TLS 1.3 only server
+	client := server.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.MaxVersion = tls.VersionTLS12
+	if resp, err := client.Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Errorf("Expected the TLS 1.2 handshake to fail")
+	}
+	client.Transport.(*http.Transport).TLSClientConfig.MaxVersion = 0
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Expected the TLS 1.3 handshake to succeed, got [%v]", err)
+	}
+	defer resp.Body.Close()
+	if resp.TLS.Version != tls.VersionTLS13 {
+		t.Errorf("Expected TLS 1.3, got %x", resp.TLS.Version)
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	for i, test := range []struct {
+		api      httpapi
+		expected string
+	}{
+		{httpapi{}, ""},
+		{httpapi{HSTSMaxAge: 31536000}, "max-age=31536000"},
+		{httpapi{HSTSMaxAge: 31536000, HSTSIncludeSubdomains: true}, "max-age=31536000; includeSubDomains"},
+		{httpapi{HSTSIncludeSubdomains: true}, ""},
+	} {
+		if value := hstsHeader(test.api); value != test.expected {
+			t.Errorf("Test %d: Expected header %q, got %q", i, test.expected, value)
+		}
+	}
+
+	handler := withHSTS(http.NotFoundHandler(), "max-age=600")
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+	resp, err := tlsServer.Client().Get(tlsServer.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if value := resp.Header.Get("Strict-Transport-Security"); value != "max-age=600" {
+		t.Errorf("Expected the HSTS header over TLS, got %q", value)
+	}
+
+	// The header is not sent over plain HTTP
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	e := getExpect(t, server)
+	e.GET("/").Expect().Header("Strict-Transport-Security").Empty()
+}
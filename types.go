@@ -13,45 +13,119 @@ var Config DNSConfig
 // DB is used to access the database functions in acme-dns
 var DB database
 
+// Webhooks is used to deliver event notifications to the configured webhook endpoints
+var Webhooks *webhookDispatcher
+
+// Cluster replicates the changes to the peer nodes, nil when clustering is not configured
+var Cluster *clusterNode
+
+// DNSListeners are the DNS listeners of the running server, with the sockets passed by systemd
+var DNSListeners []listenerconfig
+
+// Lookups keeps track of the TXT values served to the resolvers
+var Lookups = newLookupTracker()
+
 // DNSConfig holds the config structure
 type DNSConfig struct {
-	General   general
-	Database  dbsettings
-	API       httpapi
-	Logconfig logconfig
+	General      general
+	Database     dbsettings
+	API          httpapi
+	Logconfig    logconfig
+	Cluster      clustersettings
+	Webhooks     []webhookconfig     `toml:"webhook"`
+	Zones        []zoneconfig        `toml:"zone"`
+	Listeners    []listenerconfig    `toml:"listener"`
+	APIListeners []apilistenerconfig `toml:"api_listener"`
 }
 
 // Config file general section
 type general struct {
-	Listen        string
-	Proto         string `toml:"protocol"`
+	Listen            string
+	Proto             string `toml:"protocol"`
+	Domain            string
+	Nsname            string
+	Nsadmin           string
+	Debug             bool
+	StaticRecords     []string `toml:"records"`
+	Zonefile          string   `toml:"zonefile"`
+	ShutdownTimeout   int      `toml:"shutdown_timeout"`
+	ShutdownDelay     int      `toml:"shutdown_delay"`
+	CertCheckInterval int      `toml:"cert_check_interval"`
+	User              string
+	Group             string
+}
+
+// Additional zone config. The zone of the general section is the default zone.
+type zoneconfig struct {
 	Domain        string
 	Nsname        string
 	Nsadmin       string
-	Debug         bool
 	StaticRecords []string `toml:"records"`
+	Zonefile      string   `toml:"zonefile"`
+}
+
+// DNS listener config. The listen address and the protocol of the general section are used if
+// no listeners are configured.
+type listenerconfig struct {
+	Address          string
+	Protocol         string
+	TLSCertPrivkey   string `toml:"tls_cert_privkey"`
+	TLSCertFullchain string `toml:"tls_cert_fullchain"`
+}
+
+// HTTP API listener config. The address, the TLS mode, the certificate files and the CORS
+// origins of the api section are used if no listeners are configured.
+type apilistenerconfig struct {
+	Address          string
+	TLS              string
+	TLSCertPrivkey   string `toml:"tls_cert_privkey"`
+	TLSCertFullchain string `toml:"tls_cert_fullchain"`
+	CorsOrigins      []string
+	Routes           []string
 }
 
 type dbsettings struct {
-	Engine     string
-	Connection string
+	Engine          string
+	Connection      string
+	CacheTTL        int  `toml:"cache_ttl"`
+	CacheSize       int  `toml:"cache_size"`
+	MaxOpenConns    int  `toml:"max_open_conns"`
+	MaxIdleConns    int  `toml:"max_idle_conns"`
+	ConnMaxLifetime int  `toml:"conn_max_lifetime"`
+	ManualMigrate   bool `toml:"manual_migrate"`
+	PollInterval    int  `toml:"poll_interval"`
 }
 
 // API config
 type httpapi struct {
-	Domain              string `toml:"api_domain"`
-	IP                  string
-	DisableRegistration bool   `toml:"disable_registration"`
-	AutocertPort        string `toml:"autocert_port"`
-	Port                string `toml:"port"`
-	TLS                 string
-	TLSCertPrivkey      string `toml:"tls_cert_privkey"`
-	TLSCertFullchain    string `toml:"tls_cert_fullchain"`
-	ACMECacheDir        string `toml:"acme_cache_dir"`
-	NotificationEmail   string `toml:"notification_email"`
-	CorsOrigins         []string
-	UseHeader           bool   `toml:"use_header"`
-	HeaderName          string `toml:"header_name"`
+	Domain                string   `toml:"api_domain"`
+	AltNames              []string `toml:"api_alt_names"`
+	IP                    string
+	DisableRegistration   bool   `toml:"disable_registration"`
+	AutocertPort          string `toml:"autocert_port"`
+	Port                  string `toml:"port"`
+	TLS                   string
+	TLSCertPrivkey        string `toml:"tls_cert_privkey"`
+	TLSCertFullchain      string `toml:"tls_cert_fullchain"`
+	ACMECacheDir          string `toml:"acme_cache_dir"`
+	NotificationEmail     string `toml:"notification_email"`
+	ACMEDirectory         string `toml:"acme_directory"`
+	ACMEEABKeyID          string `toml:"acme_eab_kid"`
+	ACMEEABHMAC           string `toml:"acme_eab_hmac"`
+	ACMECARoot            string `toml:"acme_ca_root"`
+	CorsOrigins           []string
+	UseHeader             bool     `toml:"use_header"`
+	HeaderName            string   `toml:"header_name"`
+	WaitTimeout           int      `toml:"wait_timeout"`
+	WaitNameservers       []string `toml:"wait_nameservers"`
+	AdminToken            string   `toml:"admin_token"`
+	TLSMinVersion         string   `toml:"tls_min_version"`
+	TLSMaxVersion         string   `toml:"tls_max_version"`
+	TLSCurves             []string `toml:"tls_curves"`
+	TLSCiphers            []string `toml:"tls_ciphers"`
+	DisableOCSPStapling   bool     `toml:"disable_ocsp_stapling"`
+	HSTSMaxAge            int      `toml:"hsts_max_age"`
+	HSTSIncludeSubdomains bool     `toml:"hsts_include_subdomains"`
 }
 
 // Logging config
@@ -62,18 +136,68 @@ type logconfig struct {
 	Format  string `toml:"logformat"`
 }
 
+// Webhook config
+type webhookconfig struct {
+	URL        string
+	Secret     string
+	Events     []string
+	Timeout    int `toml:"timeout"`
+	MaxRetries int `toml:"max_retries"`
+	QueueSize  int `toml:"queue_size"`
+}
+
+// Cluster config
+type clustersettings struct {
+	NodeID     string `toml:"node_id"`
+	Secret     string
+	Peers      []string
+	Quorum     int
+	Timeout    int `toml:"timeout"`
+	MaxRetries int `toml:"max_retries"`
+	QueueSize  int `toml:"queue_size"`
+}
+
 type acmedb struct {
-	Mutex sync.Mutex
-	DB *sql.DB
+	DB                *sql.DB
+	connection        string
+	dialect           *sqlDialect
+	writeMu           sync.Mutex
+	stmtErr           error
+	regStmt           *sql.Stmt
+	txtStmt           *sql.Stmt
+	getByUsernameStmt *sql.Stmt
+	getTXTStmt        *sql.Stmt
+	updStmt           *sql.Stmt
 }
 
 type database interface {
 	Init(string, string) error
-	Register(cidrslice) (ACMETxt, error)
+	Register(cidrslice, string) (ACMETxt, error)
 	GetByUsername(uuid.UUID) (ACMETxt, error)
-	GetTXTForDomain(string) ([]string, error)
-	Update(ACMETxtPost) error
+	GetTXTForDomain(string, string) ([]string, error)
+	// Update stores the TXT value, and returns the update time stored with it
+	Update(ACMETxtPost) (int64, error)
+	GetRecords() ([]dbRecord, error)
+	PutRecord(dbRecord) error
+	MergeTXT(string, dbTXT) (bool, error)
 	GetBackend() *sql.DB
 	SetBackend(*sql.DB)
 	Close()
 }
+
+// dbRecord holds an account with the TXT values of its subdomain. It is used to copy the data
+// between databases, and the password is the bcrypt hash stored in the database.
+type dbRecord struct {
+	Username  string   `json:"username"`
+	Password  string   `json:"password"`
+	Subdomain string   `json:"subdomain"`
+	AllowFrom []string `json:"allowfrom"`
+	Zone      string   `json:"zone,omitempty"`
+	TXT       []dbTXT  `json:"txt"`
+}
+
+// dbTXT is a TXT value of a subdomain and the unix time of its last update
+type dbTXT struct {
+	Value      string `json:"value"`
+	LastUpdate int64  `json:"lastupdate"`
+}
@@ -45,7 +45,8 @@ func prepareConfig(conf DNSConfig) (DNSConfig, error) {
 	if conf.Database.Engine == "" {
 		return conf, errors.New("missing database configuration option \"engine\"")
 	}
-	if conf.Database.Connection == "" {
+	// The memory engine works without a snapshot file
+	if conf.Database.Connection == "" && conf.Database.Engine != "memory" {
 		return conf, errors.New("missing database configuration option \"connection\"")
 	}
 
@@ -53,6 +54,62 @@ func prepareConfig(conf DNSConfig) (DNSConfig, error) {
 	if conf.API.ACMECacheDir == "" {
 		conf.API.ACMECacheDir = "api-certs"
 	}
+	if conf.Database.PollInterval == 0 {
+		conf.Database.PollInterval = pollDefaultInterval
+	}
+	if conf.API.WaitTimeout <= 0 {
+		conf.API.WaitTimeout = waitDefaultTimeout
+	}
+	if conf.General.Group != "" && conf.General.User == "" {
+		return conf, errors.New("configuration option \"group\" needs the option \"user\"")
+	}
+	if conf.General.ShutdownTimeout <= 0 {
+		conf.General.ShutdownTimeout = shutdownDefaultTimeout
+	}
+	if conf.General.CertCheckInterval <= 0 {
+		conf.General.CertCheckInterval = certCheckDefaultInterval
+	}
+
+	webhooks, err := prepareWebhookConfig(conf.Webhooks)
+	if err != nil {
+		return conf, err
+	}
+	conf.Webhooks = webhooks
+
+	zones, err := prepareZoneConfig(conf.General, conf.Zones)
+	if err != nil {
+		return conf, err
+	}
+	conf.Zones = zones
+
+	listeners, err := prepareListenerConfig(conf.Listeners)
+	if err != nil {
+		return conf, err
+	}
+	conf.Listeners = listeners
+
+	apiListeners, err := prepareAPIListenerConfig(conf.API, conf.APIListeners)
+	if err != nil {
+		return conf, err
+	}
+	conf.APIListeners = apiListeners
+
+	if err = prepareACMEConfig(conf); err != nil {
+		return conf, err
+	}
+	if err = prepareTLSConfig(conf.API); err != nil {
+		return conf, err
+	}
+
+	cluster, err := prepareClusterConfig(conf.Cluster)
+	if err != nil {
+		return conf, err
+	}
+	conf.Cluster = cluster
+
+	if err = checkAPIRoutes(conf); err != nil {
+		return conf, err
+	}
 
 	return conf, nil
 }
@@ -93,6 +150,8 @@ func sanitizeDomainQuestion(d string) string {
 func setupLogging(format string, level string) {
 	if format == "json" {
 		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{})
 	}
 	switch level {
 	default:
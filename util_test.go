@@ -135,6 +135,9 @@ func TestPrepareConfig(t *testing.T) {
 		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}}, false},
 		{DNSConfig{Database: dbsettings{Engine: "", Connection: "whatever_too"}}, true},
 		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: ""}}, true},
+		{DNSConfig{Database: dbsettings{Engine: "memory", Connection: ""}}, false},
+		{DNSConfig{Database: dbsettings{Engine: "memory"}, General: general{User: "acme-dns", Group: "acme-dns"}}, false},
+		{DNSConfig{Database: dbsettings{Engine: "memory"}, General: general{Group: "acme-dns"}}, true},
 	} {
 		_, err := prepareConfig(test.input)
 		if test.shoulderror {
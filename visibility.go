@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Default values for the visibility wait options
+const (
+	waitDefaultTimeout = 10
+	waitPollInterval   = 250 * time.Millisecond
+)
+
+// visibilityProbeOption is the EDNS0 option code, from the range for local use, that marks the
+// queries of the visibility checks. acme-dns does not record the lookups of the marked queries or
+// notify the webhooks of them, so the checks do not show up as lookups of the resolvers.
+const visibilityProbeOption = 65431
+
+// visibilityTarget is a nameserver that is queried to check if an updated TXT value is visible
+type visibilityTarget struct {
+	Addr  string
+	Proto string
+}
+
+// ServerVisibility is the per server result in the update response JSON
+type ServerVisibility struct {
+	Server   string `json:"server"`
+	Protocol string `json:"protocol"`
+	Visible  bool   `json:"visible"`
+	Elapsed  int64  `json:"elapsed_ms"`
+	Error    string `json:"error,omitempty"`
+}
+
+// visibilityTargets returns the nameservers the TXT values should be visible from: the local DNS
+// listeners and the configured peer nameservers. The listeners of the running server are used,
+// or the configured listeners before the server has been started. The DNS over TLS and DNS over
+// HTTPS listeners serve the same records as the others, and are not queried.
+func visibilityTargets(conf DNSConfig) []visibilityTarget {
+	var targets []visibilityTarget
+	listeners := DNSListeners
+	if listeners == nil {
+		listeners = configListeners(conf)
+	}
+	for _, lc := range listeners {
+		if lc.Protocol == "dot" || lc.Protocol == "doh" {
+			continue
+		}
+		targets = append(targets, visibilityTarget{localQueryAddr(lc.Address), lc.transport()})
+	}
+	for _, ns := range conf.API.WaitNameservers {
+		if _, _, err := net.SplitHostPort(ns); err != nil {
+			ns = net.JoinHostPort(ns, "53")
+		}
+		targets = append(targets, visibilityTarget{ns, "udp"})
+	}
+	return targets
+}
+
+// localQueryAddr converts a listen address to an address that can be used to query the listener
+func localQueryAddr(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	ip := net.ParseIP(host)
+	if host == "" || (ip != nil && ip.IsUnspecified()) {
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		} else {
+			host = "127.0.0.1"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// waitForVisibility queries all the targets concurrently until the value is visible in the TXT
+// answer for the name, or the timeout is reached.
+func waitForVisibility(targets []visibilityTarget, name string, value string, timeout time.Duration) []ServerVisibility {
+	results := make([]ServerVisibility, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target visibilityTarget) {
+			defer wg.Done()
+			results[i] = waitForTarget(target, name, value, timeout)
+		}(i, target)
+	}
+	wg.Wait()
+	return results
+}
+
+func waitForTarget(target visibilityTarget, name string, value string, timeout time.Duration) ServerVisibility {
+	result := ServerVisibility{Server: target.Addr, Protocol: target.Proto}
+	client := &dns.Client{Net: target.Proto, Timeout: waitPollInterval * 4}
+	start := time.Now()
+	deadline := start.Add(timeout)
+	for {
+		visible, err := txtVisible(client, target.Addr, name, value)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Error = ""
+		}
+		if visible || time.Now().Add(waitPollInterval).After(deadline) {
+			result.Visible = visible
+			result.Elapsed = time.Since(start).Milliseconds()
+			return result
+		}
+		time.Sleep(waitPollInterval)
+	}
+}
+
+// txtVisible checks if the nameserver answers with the value to a TXT query of the name
+func txtVisible(client *dns.Client, addr string, name string, value string) (bool, error) {
+	in, _, err := client.Exchange(newVisibilityProbe(name), addr)
+	if err != nil {
+		return false, err
+	}
+	for _, rr := range in.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			for _, v := range txt.Txt {
+				if v == value {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// newVisibilityProbe returns a TXT query of the name, marked as a visibility probe
+func newVisibilityProbe(name string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+	msg.SetEdns0(512, false)
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: visibilityProbeOption, Data: []byte("acme-dns")})
+	return msg
+}
+
+// isVisibilityProbe checks if the query is marked as a visibility probe
+func isVisibilityProbe(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == visibilityProbeOption {
+			return true
+		}
+	}
+	return false
+}
+
+// allVisible checks if the value was visible from every queried nameserver
+func allVisible(results []ServerVisibility) bool {
+	for _, r := range results {
+		if !r.Visible {
+			return false
+		}
+	}
+	return true
+}
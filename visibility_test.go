@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocalQueryAddr(t *testing.T) {
+	for i, test := range []struct {
+		listen   string
+		expected string
+	}{
+		{"127.0.0.1:53", "127.0.0.1:53"},
+		{"0.0.0.0:53", "127.0.0.1:53"},
+		{":5353", "127.0.0.1:5353"},
+		{"[::]:53", "[::1]:53"},
+		{"[2001:db8::1]:53", "[2001:db8::1]:53"},
+		{"invalid", "invalid"},
+	} {
+		if ret := localQueryAddr(test.listen); ret != test.expected {
+			t.Errorf("Test %d: Expected [%s] but got [%s]", i, test.expected, ret)
+		}
+	}
+}
+
+func TestVisibilityTargets(t *testing.T) {
+	for i, test := range []struct {
+		proto       string
+		listeners   []listenerconfig
+		nameservers []string
+		expected    []visibilityTarget
+	}{
+		{"udp", nil, nil, []visibilityTarget{{"127.0.0.1:53", "udp"}}},
+		{"tcp6", nil, nil, []visibilityTarget{{"127.0.0.1:53", "tcp"}}},
+		{"both", nil, nil, []visibilityTarget{{"127.0.0.1:53", "udp"}, {"127.0.0.1:53", "tcp"}}},
+		{"udp4", nil, []string{"192.0.2.1", "192.0.2.2:5353"}, []visibilityTarget{{"127.0.0.1:53", "udp"}, {"192.0.2.1:53", "udp"}, {"192.0.2.2:5353", "udp"}}},
+		{"", []listenerconfig{
+			{Address: "[::]:5353", Protocol: "both6"},
+			{Address: "0.0.0.0:853", Protocol: "dot"},
+			{Address: "0.0.0.0:443", Protocol: "doh"},
+		}, nil, []visibilityTarget{{"[::1]:5353", "udp"}, {"[::1]:5353", "tcp"}}},
+	} {
+		conf := DNSConfig{General: general{Listen: "0.0.0.0:53", Proto: test.proto}, Listeners: test.listeners, API: httpapi{WaitNameservers: test.nameservers}}
+		if test.listeners != nil {
+			conf.General.Listen = ""
+		}
+		ret := visibilityTargets(conf)
+		if len(ret) != len(test.expected) {
+			t.Errorf("Test %d: Expected %d targets but got %d", i, len(test.expected), len(ret))
+			continue
+		}
+		for j := range ret {
+			if ret[j] != test.expected[j] {
+				t.Errorf("Test %d: Expected target %v but got %v", i, test.expected[j], ret[j])
+			}
+		}
+	}
+
+	// The listeners of the running server, like the sockets passed by systemd, are used instead
+	// of the configuration
+	oldListeners := DNSListeners
+	defer func() { DNSListeners = oldListeners }()
+	DNSListeners = []listenerconfig{{Address: "127.0.0.1:15353", Protocol: "udp"}}
+	ret := visibilityTargets(DNSConfig{General: general{Listen: "0.0.0.0:53", Proto: "tcp"}})
+	if len(ret) != 1 || ret[0] != (visibilityTarget{"127.0.0.1:15353", "udp"}) {
+		t.Errorf("Expected the target of the running listener, got %v", ret)
+	}
+}
+
+func TestWaitForVisibility(t *testing.T) {
+	atxt, err := DB.Register(cidrslice{}, "")
+	if err != nil {
+		t.Fatalf("Could not initiate db record: [%v]", err)
+	}
+	atxt.Value = "______________visible_txt_value_____________"
+	_, _ = DB.Update(atxt.ACMETxtPost)
+
+	targets := []visibilityTarget{{"127.0.0.1:15353", "udp"}, {"127.0.0.1:1", "udp"}}
+	results := waitForVisibility(targets, atxt.Subdomain+".auth.example.org", atxt.Value, time.Second)
+	if !results[0].Visible || results[0].Error != "" {
+		t.Errorf("Expected value to be visible from the local server, got %+v", results[0])
+	}
+	if results[1].Visible || results[1].Error == "" {
+		t.Errorf("Expected an error from the unreachable server, got %+v", results[1])
+	}
+	if allVisible(results) {
+		t.Errorf("Expected the value not to be visible from every server")
+	}
+	// The checks are not lookups of a resolver
+	if _, _, served := Lookups.Get(atxt.Subdomain, atxt.Value); served {
+		t.Errorf("Expected the visibility checks not to be recorded as lookups")
+	}
+
+	results = waitForVisibility(targets[:1], atxt.Subdomain+".auth.example.org", "______________not_the_txt_value____________", time.Second)
+	if results[0].Visible || results[0].Elapsed < 500 {
+		t.Errorf("Expected to wait for the timeout for a value that is not visible, got %+v", results[0])
+	}
+}
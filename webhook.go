@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Webhook event types
+const (
+	webhookEventUpdate = "update"
+	webhookEventLookup = "lookup"
+)
+
+// WebhookEvent is the JSON payload delivered to the configured webhook endpoints
+type WebhookEvent struct {
+	ID         string   `json:"id"`
+	Event      string   `json:"event"`
+	Subdomain  string   `json:"subdomain"`
+	Fulldomain string   `json:"fulldomain"`
+	TXT        []string `json:"txt"`
+	Resolver   string   `json:"resolver,omitempty"`
+	Timestamp  int64    `json:"timestamp"`
+}
+
+// webhookDispatcher fans out events to all of the configured webhook endpoints
+type webhookDispatcher struct {
+	endpoints []*webhookEndpoint
+}
+
+// webhookDropLogInterval is the shortest interval of logging the events dropped on a full queue
+const webhookDropLogInterval = time.Minute
+
+// webhookEndpoint holds the delivery queue of a single webhook
+type webhookEndpoint struct {
+	config     webhookconfig
+	deliveries *deliveryQueue
+	// The events dropped on a full queue since the last summary in the log
+	mu          sync.Mutex
+	dropped     int
+	droppedLogs time.Time
+}
+
+// newWebhookDispatcher creates a dispatcher for the webhook configuration. The delivery workers
+// are not running before Start is called.
+func newWebhookDispatcher(configs []webhookconfig) *webhookDispatcher {
+	dispatcher := &webhookDispatcher{}
+	for _, c := range configs {
+		e := &webhookEndpoint{
+			config:     c,
+			deliveries: newDeliveryQueue(c.URL, c.Timeout, c.MaxRetries, c.QueueSize, log.Fields{"url": c.URL}),
+		}
+		if c.Secret != "" {
+			secret := c.Secret
+			e.deliveries.sign = func(req *http.Request, payload []byte) {
+				req.Header.Set("X-Acme-Dns-Signature", "sha256="+signPayload(secret, payload))
+			}
+		}
+		dispatcher.endpoints = append(dispatcher.endpoints, e)
+	}
+	return dispatcher
+}
+
+// Start starts the delivery worker for every webhook endpoint
+func (w *webhookDispatcher) Start() {
+	if w == nil {
+		return
+	}
+	for _, e := range w.endpoints {
+		e.deliveries.Start()
+	}
+}
+
+// Stop closes the delivery queues and waits for the workers to finish with the queued events
+// until the context is done. The events not delivered by then are dropped.
+func (w *webhookDispatcher) Stop(ctx context.Context) {
+	if w == nil {
+		return
+	}
+	queues := make([]*deliveryQueue, 0, len(w.endpoints))
+	for _, e := range w.endpoints {
+		queues = append(queues, e.deliveries)
+	}
+	stopQueues(ctx, queues)
+}
+
+// Notify queues the event for all the endpoints subscribed to it. It never blocks: if the
+// queue of an endpoint is full, the event is dropped for that endpoint. After Stop, the events
+// of the DNS queries still answered during the shutdown are dropped.
+func (w *webhookDispatcher) Notify(event WebhookEvent) {
+	if w == nil {
+		return
+	}
+	if event.ID == "" {
+		event.ID = uuid.New().String()
+	}
+	if event.Timestamp == 0 {
+		event.Timestamp = time.Now().Unix()
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Could not marshal webhook payload")
+		return
+	}
+	d := delivery{
+		payload: payload,
+		header: http.Header{
+			"X-Acme-Dns-Event":    {event.Event},
+			"X-Acme-Dns-Delivery": {event.ID},
+		},
+		fields: log.Fields{"event": event.Event, "subdomain": event.Subdomain},
+	}
+	for _, e := range w.endpoints {
+		if !e.subscribed(event.Event) {
+			continue
+		}
+		if err := e.deliveries.Enqueue(d); errors.Is(err, errDeliveryQueueFull) {
+			e.drop()
+		}
+	}
+}
+
+// drop counts an event dropped on a full queue. A summary of the dropped events is logged at most
+// once in webhookDropLogInterval, so a flood of lookups does not flood the log as well.
+func (e *webhookEndpoint) drop() {
+	e.mu.Lock()
+	e.dropped++
+	if time.Since(e.droppedLogs) < webhookDropLogInterval {
+		e.mu.Unlock()
+		return
+	}
+	dropped := e.dropped
+	e.dropped, e.droppedLogs = 0, time.Now()
+	e.mu.Unlock()
+	log.WithFields(log.Fields{"url": e.config.URL, "dropped": dropped}).Warning("Webhook queue full, dropping events")
+}
+
+func (e *webhookEndpoint) subscribed(event string) bool {
+	for _, v := range e.config.Events {
+		if v == event {
+			return true
+		}
+	}
+	return false
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of the payload
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validWebhookEvent checks if the event name is one of the supported webhook events
+func validWebhookEvent(event string) bool {
+	return event == webhookEventUpdate || event == webhookEventLookup
+}
+
+// prepareWebhookConfig validates the webhook configuration and sets the default values
+func prepareWebhookConfig(configs []webhookconfig) ([]webhookconfig, error) {
+	for i := range configs {
+		c := &configs[i]
+		if c.URL == "" {
+			return configs, errors.New("missing webhook configuration option \"url\"")
+		}
+		if len(c.Events) == 0 {
+			c.Events = []string{webhookEventUpdate, webhookEventLookup}
+		}
+		for _, ev := range c.Events {
+			if !validWebhookEvent(ev) {
+				return configs, fmt.Errorf("invalid webhook event \"%s\"", ev)
+			}
+		}
+		prepareDeliveryConfig(&c.Timeout, &c.MaxRetries, &c.QueueSize)
+	}
+	return configs, nil
+}
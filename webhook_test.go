@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// webhookReceiver is a local HTTP stand-in for a webhook endpoint
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+	received chan WebhookEvent
+}
+
+func newWebhookReceiver(statuses ...int) (*webhookReceiver, *httptest.Server) {
+	recv := &webhookReceiver{statuses: statuses, received: make(chan WebhookEvent, 10)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		recv.mu.Lock()
+		attempt := len(recv.requests)
+		recv.requests = append(recv.requests, r)
+		recv.bodies = append(recv.bodies, body)
+		status := http.StatusOK
+		if attempt < len(recv.statuses) {
+			status = recv.statuses[attempt]
+		}
+		recv.mu.Unlock()
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			var ev WebhookEvent
+			_ = json.Unmarshal(body, &ev)
+			recv.received <- ev
+		}
+	}))
+	return recv, server
+}
+
+func (r *webhookReceiver) attempts() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+func (r *webhookReceiver) wait(t *testing.T) WebhookEvent {
+	select {
+	case ev := <-r.received:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for webhook delivery")
+	}
+	return WebhookEvent{}
+}
+
+func testWebhookDispatcher(url string, secret string, events []string, maxRetries int) *webhookDispatcher {
+	configs, _ := prepareWebhookConfig([]webhookconfig{{URL: url, Secret: secret, Events: events, MaxRetries: maxRetries}})
+	dispatcher := newWebhookDispatcher(configs)
+	for _, e := range dispatcher.endpoints {
+		e.deliveries.backoff = time.Millisecond
+	}
+	return dispatcher
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	recv, server := newWebhookReceiver()
+	defer server.Close()
+	dispatcher := testWebhookDispatcher(server.URL, "verysecret", nil, 0)
+	dispatcher.Start()
+	defer dispatcher.Stop(context.Background())
+
+	dispatcher.Notify(WebhookEvent{Event: webhookEventUpdate, Subdomain: "sub", Fulldomain: "sub.auth.example.org", TXT: []string{"value"}})
+	ev := recv.wait(t)
+	if ev.Event != webhookEventUpdate || ev.Subdomain != "sub" || len(ev.TXT) != 1 || ev.TXT[0] != "value" {
+		t.Errorf("Unexpected webhook payload: %+v", ev)
+	}
+	if ev.ID == "" || ev.Timestamp == 0 {
+		t.Errorf("Expected webhook payload to have an id and timestamp, got: %+v", ev)
+	}
+
+	recv.mu.Lock()
+	req, body := recv.requests[0], recv.bodies[0]
+	recv.mu.Unlock()
+	expected := "sha256=" + signPayload("verysecret", body)
+	if req.Header.Get("X-Acme-Dns-Signature") != expected {
+		t.Errorf("Expected signature header [%s] but got [%s]", expected, req.Header.Get("X-Acme-Dns-Signature"))
+	}
+	if req.Header.Get("X-Acme-Dns-Event") != webhookEventUpdate {
+		t.Errorf("Expected event header [%s] but got [%s]", webhookEventUpdate, req.Header.Get("X-Acme-Dns-Event"))
+	}
+	if req.Header.Get("X-Acme-Dns-Delivery") != ev.ID {
+		t.Errorf("Expected delivery header to match the event id")
+	}
+}
+
+func TestWebhookEventFilter(t *testing.T) {
+	recv, server := newWebhookReceiver()
+	defer server.Close()
+	dispatcher := testWebhookDispatcher(server.URL, "", []string{webhookEventLookup}, 0)
+	dispatcher.Start()
+
+	dispatcher.Notify(WebhookEvent{Event: webhookEventUpdate, Subdomain: "sub"})
+	dispatcher.Notify(WebhookEvent{Event: webhookEventLookup, Subdomain: "sub"})
+	dispatcher.Stop(context.Background())
+	if recv.attempts() != 1 {
+		t.Fatalf("Expected exactly one delivery, got %d", recv.attempts())
+	}
+	if ev := recv.wait(t); ev.Event != webhookEventLookup {
+		t.Errorf("Expected only the lookup event to be delivered, got [%s]", ev.Event)
+	}
+	recv.mu.Lock()
+	defer recv.mu.Unlock()
+	if recv.requests[0].Header.Get("X-Acme-Dns-Signature") != "" {
+		t.Errorf("Did not expect a signature without a secret")
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	for i, test := range []struct {
+		statuses   []int
+		maxRetries int
+		attempts   int
+		delivered  bool
+	}{
+		{[]int{500, 502}, 5, 3, true},
+		{[]int{429}, 5, 2, true},
+		{[]int{500, 500, 500}, 2, 3, false},
+		{[]int{400}, 5, 1, false},
+		{[]int{500}, -1, 1, false},
+	} {
+		recv, server := newWebhookReceiver(test.statuses...)
+		dispatcher := testWebhookDispatcher(server.URL, "secret", nil, test.maxRetries)
+		dispatcher.Start()
+		dispatcher.Notify(WebhookEvent{Event: webhookEventUpdate, Subdomain: "sub"})
+		dispatcher.Stop(context.Background())
+		server.Close()
+		if recv.attempts() != test.attempts {
+			t.Errorf("Test %d: Expected %d delivery attempts, got %d", i, test.attempts, recv.attempts())
+		}
+		if delivered := len(recv.received) == 1; delivered != test.delivered {
+			t.Errorf("Test %d: Expected delivered to be %t", i, test.delivered)
+		}
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	loghook.Reset()
+	configs, _ := prepareWebhookConfig([]webhookconfig{{URL: "http://127.0.0.1:1", QueueSize: 1}})
+	dispatcher := newWebhookDispatcher(configs)
+	// Workers are not started, so the second event can not fit in the queue
+	done := make(chan struct{})
+	go func() {
+		dispatcher.Notify(WebhookEvent{Event: webhookEventUpdate})
+		dispatcher.Notify(WebhookEvent{Event: webhookEventUpdate})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Notify blocked on a full queue")
+	}
+	if !loggerHasEntryWithMessage("Webhook queue full, dropping events") {
+		t.Errorf("Expected a log entry about the dropped event")
+	}
+
+	// The following drops are counted, and not logged one by one
+	loghook.Reset()
+	for i := 0; i < 10; i++ {
+		dispatcher.Notify(WebhookEvent{Event: webhookEventUpdate})
+	}
+	if loggerHasEntryWithMessage("Webhook queue full, dropping events") {
+		t.Errorf("Expected the dropped events not to be logged before the log interval")
+	}
+	if e := dispatcher.endpoints[0]; e.dropped != 10 {
+		t.Errorf("Expected 10 dropped events to be counted, got %d", e.dropped)
+	}
+}
+
+func TestWebhookNilDispatcher(t *testing.T) {
+	var dispatcher *webhookDispatcher
+	dispatcher.Start()
+	dispatcher.Notify(WebhookEvent{Event: webhookEventUpdate})
+	dispatcher.Stop(context.Background())
+}
+
+func TestPrepareWebhookConfig(t *testing.T) {
+	for i, test := range []struct {
+		input     webhookconfig
+		shouldErr bool
+	}{
+		{webhookconfig{URL: "https://example.org/hook"}, false},
+		{webhookconfig{URL: "https://example.org/hook", Events: []string{"update"}}, false},
+		{webhookconfig{}, true},
+		{webhookconfig{URL: "https://example.org/hook", Events: []string{"update", "invalid"}}, true},
+	} {
+		ret, err := prepareWebhookConfig([]webhookconfig{test.input})
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error, but there was none", i)
+		}
+		if !test.shouldErr {
+			if err != nil {
+				t.Errorf("Test %d: Expected no error, but got [%v]", i, err)
+			}
+			c := ret[0]
+			if len(c.Events) == 0 || c.Timeout != deliveryDefaultTimeout || c.MaxRetries != deliveryDefaultMaxRetries || c.QueueSize != deliveryDefaultQueueSize {
+				t.Errorf("Test %d: Default values were not set: %+v", i, c)
+			}
+		}
+	}
+}
+
+func TestWebhookUpdateAndLookupEvents(t *testing.T) {
+	recv, server := newWebhookReceiver()
+	defer server.Close()
+	Webhooks = testWebhookDispatcher(server.URL, "secret", nil, 0)
+	Webhooks.Start()
+	defer func() {
+		Webhooks.Stop(context.Background())
+		Webhooks = nil
+	}()
+
+	router := setupRouter(false, false)
+	apiserver := httptest.NewServer(router)
+	defer apiserver.Close()
+	e := getExpect(t, apiserver)
+	Config.General.Domain = "auth.example.org"
+	defer func() { Config.General.Domain = "" }()
+
+	user, err := DB.Register(cidrslice{}, "")
+	if err != nil {
+		t.Fatalf("Could not create new user, got error [%v]", err)
+	}
+	validTXT := "______________webhook_validation_value_____"
+	e.POST("/update").
+		WithJSON(map[string]interface{}{"subdomain": user.Subdomain, "txt": validTXT}).
+		WithHeader("X-Api-User", user.Username.String()).
+		WithHeader("X-Api-Key", user.Password).
+		Expect().
+		Status(http.StatusOK)
+	ev := recv.wait(t)
+	if ev.Event != webhookEventUpdate || ev.Subdomain != user.Subdomain || ev.Fulldomain != user.Subdomain+".auth.example.org" {
+		t.Errorf("Unexpected update event: %+v", ev)
+	}
+
+	resolv := resolver{server: "127.0.0.1:15353"}
+	if _, err := resolv.lookup(user.Subdomain+".auth.example.org", dns.TypeTXT); err != nil {
+		t.Fatalf("Could not resolve TXT record: %v", err)
+	}
+	ev = recv.wait(t)
+	if ev.Event != webhookEventLookup || ev.Subdomain != user.Subdomain || ev.Resolver != "127.0.0.1" {
+		t.Errorf("Unexpected lookup event: %+v", ev)
+	}
+	if len(ev.TXT) != 1 || ev.TXT[0] != validTXT {
+		t.Errorf("Expected lookup event to contain the served value, got %v", ev.TXT)
+	}
+}
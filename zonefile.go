@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// parseZoneFile reads the records of an RFC 1035 master file. Relative names are relative to the
+// origin, unless the file changes it with $ORIGIN. $INCLUDE is not allowed, as it could read any
+// file readable by the process.
+func parseZoneFile(filename string, origin string) ([]dns.RR, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(f, dns.Fqdn(origin), filename)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(dns.Fqdn(origin), rr.Header().Name) {
+			return nil, fmt.Errorf("%s: record %s is outside of the zone %s", filename, rr.Header().Name, origin)
+		}
+		rrs = append(rrs, rr)
+	}
+	if err = zp.Err(); err != nil {
+		return nil, err
+	}
+	return rrs, nil
+}
+
+// validateRecords checks that the records do not conflict: a name with a CNAME record may not
+// have any other records, and NS records may not point to an alias
+func validateRecords(domains map[string]Records) error {
+	for name, recs := range domains {
+		cnames, other := 0, 0
+		for _, rr := range recs.Records {
+			switch rr.Header().Rrtype {
+			case dns.TypeCNAME:
+				cnames++
+			case dns.TypeRRSIG, dns.TypeNSEC:
+			default:
+				other++
+			}
+		}
+		if cnames > 1 {
+			return fmt.Errorf("%s has more than one CNAME record", name)
+		}
+		if cnames > 0 && other > 0 {
+			return fmt.Errorf("%s has a CNAME record and other records", name)
+		}
+		for _, rr := range recs.Records {
+			ns, ok := rr.(*dns.NS)
+			if !ok {
+				continue
+			}
+			target := strings.ToLower(ns.Ns)
+			for _, t := range domains[target].Records {
+				if t.Header().Rrtype == dns.TypeCNAME {
+					return fmt.Errorf("NS record of %s points to the alias %s", name, target)
+				}
+			}
+		}
+	}
+	return nil
+}
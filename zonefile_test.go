@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testZoneFile = `$ORIGIN auth.example.org.
+$TTL 300
+@	IN	SOA	ns1 hostmaster.example.org. (
+		2024010101 ; serial
+		7200       ; refresh
+		3600       ; retry
+		1209600    ; expire
+		300 )      ; minimum
+	IN	NS	ns1
+	IN	A	192.168.1.100
+ns1	IN	A	192.168.1.101
+WWW	IN	CNAME	auth.example.org.
+`
+
+func writeZoneFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "auth.example.org.zone")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Could not write zone file: %v", err)
+	}
+	return path
+}
+
+func TestParseZoneFile(t *testing.T) {
+	rrs, err := parseZoneFile(writeZoneFile(t, testZoneFile), "auth.example.org")
+	if err != nil {
+		t.Fatalf("Could not parse zone file: %v", err)
+	}
+	if len(rrs) != 5 {
+		t.Fatalf("Expected 5 records, got %d", len(rrs))
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok || soa.Ns != "ns1.auth.example.org." || soa.Serial != 2024010101 {
+		t.Errorf("Expected the multi-line SOA record, got %v", rrs[0])
+	}
+	if rrs[2].Header().Ttl != 300 {
+		t.Errorf("Expected the $TTL to be used, got %d", rrs[2].Header().Ttl)
+	}
+	if rrs[4].Header().Name != "www.auth.example.org." {
+		t.Errorf("Expected lower case owner name, got %s", rrs[4].Header().Name)
+	}
+
+	for i, content := range []string{
+		"other.example.com. A 192.168.1.1\n",
+		"@ IN A not-an-address\n",
+		"$INCLUDE /etc/hosts\n",
+	} {
+		if _, err = parseZoneFile(writeZoneFile(t, content), "auth.example.org"); err == nil {
+			t.Errorf("Test %d: Expected error, got none", i)
+		}
+	}
+	if _, err = parseZoneFile(filepath.Join(t.TempDir(), "missing.zone"), "auth.example.org"); err == nil {
+		t.Errorf("Expected error for a missing zone file, got none")
+	}
+}
+
+func TestValidateRecords(t *testing.T) {
+	for i, test := range []struct {
+		records []string
+		valid   bool
+	}{
+		{[]string{"a.example.org. CNAME b.example.org.", "b.example.org. A 192.168.1.1"}, true},
+		{[]string{"a.example.org. CNAME b.example.org.", "a.example.org. A 192.168.1.1"}, false},
+		{[]string{"a.example.org. CNAME b.example.org.", "a.example.org. CNAME c.example.org."}, false},
+		{[]string{"example.org. NS ns.example.org.", "ns.example.org. A 192.168.1.1"}, true},
+		{[]string{"example.org. NS ns.example.org.", "ns.example.org. CNAME b.example.org."}, false},
+		{[]string{"sub.example.org. NS ns.example.org.", "sub.example.org. CNAME b.example.org."}, false},
+	} {
+		domains := make(map[string]Records)
+		for _, r := range test.records {
+			rr, err := dns.NewRR(r)
+			if err != nil {
+				t.Fatalf("Test %d: could not parse %s: %v", i, r, err)
+			}
+			appendRR(domains, rr)
+		}
+		err := validateRecords(domains)
+		if test.valid && err != nil {
+			t.Errorf("Test %d: Expected no error, got [%v]", i, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Test %d: Expected error, got none", i)
+		}
+	}
+}
+
+func TestLoadRecordsZoneFile(t *testing.T) {
+	path := writeZoneFile(t, testZoneFile)
+	config := DNSConfig{General: general{Domain: "auth.example.org", Zonefile: path}}
+	server := NewDNSServer(DB, "", "udp", config.General.Domain)
+	if err := server.LoadRecords(config); err != nil {
+		t.Fatalf("Could not load the records: %v", err)
+	}
+	if soa, ok := server.SOA.(*dns.SOA); !ok || soa.Serial != 2024010101 {
+		t.Errorf("Expected the SOA record of the zone file, got %v", server.SOA)
+	}
+	if len(server.Domains["auth.example.org."].Records) != 3 {
+		t.Errorf("Expected SOA, NS and A records for the zone apex, got %v", server.Domains["auth.example.org."].Records)
+	}
+
+	// A conflicting zone file is rejected and the current records are kept
+	if err := os.WriteFile(path, []byte(testZoneFile+"www IN A 192.168.1.1\n"), 0600); err != nil {
+		t.Fatalf("Could not write zone file: %v", err)
+	}
+	if err := server.LoadRecords(config); err == nil {
+		t.Errorf("Expected error for a conflicting zone file, got none")
+	}
+	if _, ok := server.Domains["ns1.auth.example.org."]; !ok {
+		t.Errorf("Expected the current records to be kept")
+	}
+
+	// Reloading picks up the changes of the zone file
+	if err := os.WriteFile(path, []byte("$ORIGIN auth.example.org.\nnew IN A 192.168.1.2\n"), 0600); err != nil {
+		t.Fatalf("Could not write zone file: %v", err)
+	}
+	config.General.Nsname = "ns1.auth.example.org"
+	config.General.Nsadmin = "admin.example.org"
+	if err := server.LoadRecords(config); err != nil {
+		t.Fatalf("Could not reload the records: %v", err)
+	}
+	if _, ok := server.Domains["new.auth.example.org."]; !ok {
+		t.Errorf("Expected the reloaded record to be served")
+	}
+	if _, ok := server.Domains["ns1.auth.example.org."]; ok {
+		t.Errorf("Expected the removed record to not be served")
+	}
+	if soa, ok := server.SOA.(*dns.SOA); !ok || soa.Ns != "ns1.auth.example.org." || soa.Serial == 2024010101 {
+		t.Errorf("Expected a generated SOA record, got %v", server.SOA)
+	}
+}
+
+func TestLoadRecordsConflictingConfig(t *testing.T) {
+	// Conflicting static records of the configuration are served as they used to be
+	config := DNSConfig{General: general{Domain: "auth.example.org", Nsname: "auth.example.org", Nsadmin: "admin.example.org", StaticRecords: []string{
+		"www.auth.example.org. CNAME auth.example.org.",
+		"www.auth.example.org. A 192.168.1.1",
+	}}}
+	server := NewDNSServer(DB, "", "udp", config.General.Domain)
+	loghook.Reset()
+	if err := server.LoadRecords(config); err != nil {
+		t.Fatalf("Expected conflicting static records to be loaded, got error [%v]", err)
+	}
+	if len(server.Domains["www.auth.example.org."].Records) != 2 {
+		t.Errorf("Expected both of the records to be served, got %v", server.Domains["www.auth.example.org."].Records)
+	}
+	if !loggerHasEntryWithMessage("Conflicting records in the configuration") {
+		t.Errorf("Expected a warning about the conflicting records")
+	}
+}
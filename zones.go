@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// normalizeZoneName returns the zone domain in lower case without the trailing dot
+func normalizeZoneName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// configZones returns the zones served by acme-dns: the default zone of the general section
+// first, followed by the additional zones
+func configZones(config DNSConfig) []zoneconfig {
+	zones := []zoneconfig{{
+		Domain:        config.General.Domain,
+		Nsname:        config.General.Nsname,
+		Nsadmin:       config.General.Nsadmin,
+		StaticRecords: config.General.StaticRecords,
+		Zonefile:      config.General.Zonefile,
+	}}
+	return append(zones, config.Zones...)
+}
+
+// zoneKey returns the key the accounts of the zone are stored with: an empty string for the
+// default zone, and the domain of an additional zone. The bool is false for unknown zones.
+func zoneKey(config DNSConfig, name string) (string, bool) {
+	name = normalizeZoneName(name)
+	if name == "" || name == normalizeZoneName(config.General.Domain) {
+		return "", true
+	}
+	for _, z := range config.Zones {
+		if name == normalizeZoneName(z.Domain) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// zoneDomain returns the domain of the zone an account is stored with
+func zoneDomain(zone string) string {
+	if zone == "" {
+		return Config.General.Domain
+	}
+	return zone
+}
+
+// fullDomain returns the domain name of the subdomain in the zone
+func fullDomain(subdomain string, zone string) string {
+	return subdomain + "." + zoneDomain(zone)
+}
+
+// prepareZoneConfig validates the additional zones
+func prepareZoneConfig(general general, zones []zoneconfig) ([]zoneconfig, error) {
+	seen := map[string]bool{normalizeZoneName(general.Domain): true}
+	for i := range zones {
+		z := &zones[i]
+		z.Domain = normalizeZoneName(z.Domain)
+		if z.Domain == "" {
+			return zones, errors.New("missing zone configuration option \"domain\"")
+		}
+		// The SOA record may come from the zone file instead
+		if z.Zonefile == "" && (z.Nsname == "" || z.Nsadmin == "") {
+			return zones, fmt.Errorf("missing zone configuration option \"nsname\" or \"nsadmin\" for zone %s", z.Domain)
+		}
+		if seen[z.Domain] {
+			return zones, fmt.Errorf("zone %s is configured more than once", z.Domain)
+		}
+		seen[z.Domain] = true
+	}
+	return zones, nil
+}
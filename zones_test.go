@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func multiZoneConfig() DNSConfig {
+	return DNSConfig{
+		General: general{
+			Domain:        "auth.example.org",
+			Nsname:        "ns1.auth.example.org",
+			Nsadmin:       "admin.example.org",
+			StaticRecords: []string{"auth.example.org. A 192.168.1.100"},
+		},
+		Zones: []zoneconfig{{
+			Domain:        "Auth.Brand.com.",
+			Nsname:        "ns1.auth.brand.com",
+			Nsadmin:       "admin.brand.com",
+			StaticRecords: []string{"auth.brand.com. A 192.168.2.100"},
+		}},
+	}
+}
+
+func TestPrepareZoneConfig(t *testing.T) {
+	for i, test := range []struct {
+		zones  []zoneconfig
+		domain string
+		valid  bool
+	}{
+		{[]zoneconfig{}, "", true},
+		{[]zoneconfig{{Domain: "Auth.Brand.com.", Nsname: "ns", Nsadmin: "admin"}}, "auth.brand.com", true},
+		{[]zoneconfig{{Nsname: "ns", Nsadmin: "admin"}}, "", false},
+		{[]zoneconfig{{Domain: "auth.brand.com", Nsadmin: "admin"}}, "", false},
+		{[]zoneconfig{{Domain: "auth.example.org", Nsname: "ns", Nsadmin: "admin"}}, "", false},
+		{[]zoneconfig{
+			{Domain: "auth.brand.com", Nsname: "ns", Nsadmin: "admin"},
+			{Domain: "auth.brand.com.", Nsname: "ns", Nsadmin: "admin"},
+		}, "", false},
+	} {
+		zones, err := prepareZoneConfig(general{Domain: "auth.example.org"}, test.zones)
+		if test.valid && err != nil {
+			t.Errorf("Test %d: Expected no error, got [%v]", i, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Test %d: Expected error, got none", i)
+		}
+		if test.valid && len(zones) > 0 && zones[0].Domain != test.domain {
+			t.Errorf("Test %d: Expected zone domain %s, got %s", i, test.domain, zones[0].Domain)
+		}
+	}
+}
+
+func TestZoneKey(t *testing.T) {
+	config := multiZoneConfig()
+	config.Zones, _ = prepareZoneConfig(config.General, config.Zones)
+	for i, test := range []struct {
+		name  string
+		key   string
+		known bool
+	}{
+		{"", "", true},
+		{"auth.example.org", "", true},
+		{"AUTH.example.org.", "", true},
+		{"auth.brand.com", "auth.brand.com", true},
+		{"auth.brand.com.", "auth.brand.com", true},
+		{"auth.other.com", "", false},
+	} {
+		key, known := zoneKey(config, test.name)
+		if key != test.key || known != test.known {
+			t.Errorf("Test %d: Expected (%q, %t), got (%q, %t)", i, test.key, test.known, key, known)
+		}
+	}
+}
+
+func TestDNSZones(t *testing.T) {
+	config := multiZoneConfig()
+	config.Zones, _ = prepareZoneConfig(config.General, config.Zones)
+	server := NewDNSServer(DB, "", "udp", config.General.Domain)
+	server.ParseRecords(config)
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		m.SetReply(m)
+		server.readQuery(m, "", false)
+		return m
+	}
+
+	for i, test := range []struct {
+		name string
+		soa  string
+	}{
+		{"nonexistent.auth.example.org.", "auth.example.org."},
+		{"nonexistent.auth.brand.com.", "auth.brand.com."},
+	} {
+		m := query(test.name, dns.TypeA)
+		if m.Rcode != dns.RcodeNameError || !m.Authoritative {
+			t.Errorf("Test %d: Expected authoritative NXDOMAIN, got %s", i, dns.RcodeToString[m.Rcode])
+			continue
+		}
+		if len(m.Ns) != 1 || m.Ns[0].Header().Name != test.soa {
+			t.Errorf("Test %d: Expected SOA of %s, got %v", i, test.soa, m.Ns)
+		}
+	}
+	if m := query("auth.brand.com.", dns.TypeSOA); len(m.Answer) != 1 || !m.Authoritative {
+		t.Errorf("Expected the SOA record of the additional zone, got %v", m.Answer)
+	}
+	if m := query("auth.brand.com.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("Expected the static record of the additional zone, got %v", m.Answer)
+	}
+	if !server.isOwnChallenge("_acme-challenge.auth.brand.com.") {
+		t.Errorf("Expected the challenge of the additional zone to be an own challenge")
+	}
+
+	// The TXT values are only served in the zone of the account
+	reg, err := DB.Register(cidrslice{}, "auth.brand.com")
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	value := "_____________zone_scoped_value_____________"
+	reg.Value = value
+	if _, err = DB.Update(reg.ACMETxtPost); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	m := query(reg.Subdomain+".auth.brand.com.", dns.TypeTXT)
+	if err = hasExpectedTXTAnswer(m.Answer, value); err != nil {
+		t.Errorf("Expected the TXT value in the zone of the account: %v", err)
+	}
+	m = query(reg.Subdomain+".auth.example.org.", dns.TypeTXT)
+	if err = hasExpectedTXTAnswer(m.Answer, value); err == nil {
+		t.Errorf("Did not expect the TXT value in another zone")
+	}
+}
+
+func TestApiRegisterZone(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	Config.General.Domain = "auth.example.org"
+	Config.Zones = []zoneconfig{{Domain: "auth.brand.com", Nsname: "ns1.auth.brand.com", Nsadmin: "admin.brand.com"}}
+	defer func() { Config.Zones = nil }()
+
+	response := e.POST("/register").
+		WithJSON(map[string]interface{}{"zone": "auth.brand.com"}).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object()
+	subdomain := response.Value("subdomain").String().Raw()
+	response.ValueEqual("fulldomain", subdomain+".auth.brand.com")
+	user := response.Value("username").String().Raw()
+	password := response.Value("password").String().Raw()
+
+	e.GET("/status").
+		WithHeader("X-Api-User", user).
+		WithHeader("X-Api-Key", password).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("fulldomain", subdomain+".auth.brand.com")
+
+	response = e.POST("/register").
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object()
+	subdomain = response.Value("subdomain").String().Raw()
+	response.ValueEqual("fulldomain", subdomain+".auth.example.org")
+
+	e.POST("/register").
+		WithJSON(map[string]interface{}{"zone": "auth.other.com"}).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ContainsKey("error").
+		ValueEqual("error", "invalid_zone")
+}